@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// Device is a device listed by `adb devices -l`.
+type Device struct {
+	Serial string
+	State  string
+	Model  string
+}
+
+func (d Device) String() string {
+	if d.Model == "" {
+		return d.Serial
+	}
+	return d.Model + " (" + d.Serial + ")"
+}
+
+// errSignatureMismatch is returned by installAPK when the device has the
+// package installed with a different signing key.
+var errSignatureMismatch = errors.New("the installed app is signed with a different key")
+
+// existingPackageRegexp finds the conflicting package in the failure message,
+// "Existing package X signatures do not match" before Android 9 and
+// "Package X signatures do not match" since.
+var existingPackageRegexp = regexp.MustCompile(`(?:Existing package|Package) (\S+) signatures`)
+
+var pulledDir = "apps/pulled"
+
+var versionNameRegexp = regexp.MustCompile(`versionName=(\S+)`)
+
+const gmsCorePatch = "GmsCore support"
+const defaultGmsCoreVendor = "app.revanced"
+
+// adbPath is the adb executable, configurable so a stub can stand in for it.
+func adbPath() string {
+	return readSetting("adbPath", "adb")
+}
+
+func adb(args ...string) (string, error) {
+	out, err := exec.Command(adbPath(), args...).CombinedOutput()
+	if err != nil {
+		return string(out), fmt.Errorf("adb %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+func listDevices() ([]Device, error) {
+	out, err := adb("devices", "-l")
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []Device
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] == "List" || strings.HasPrefix(fields[0], "*") {
+			continue
+		}
+		device := Device{Serial: fields[0], State: fields[1]}
+		for _, field := range fields[2:] {
+			if model, ok := strings.CutPrefix(field, "model:"); ok {
+				device.Model = strings.ReplaceAll(model, "_", " ")
+			}
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+func isPackageInstalled(serial, pkg string) (bool, error) {
+	out, err := adb("-s", serial, "shell", "pm", "list", "packages", pkg)
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.TrimSpace(line) == "package:"+pkg {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// installAPK installs apk on the device, replacing the installed app. On a
+// signature mismatch it returns the package that conflicts, the one of the
+// APK when adb doesn't say.
+func installAPK(serial, apk string) (string, error) {
+	out, err := adb("-s", serial, "install", "-r", apk)
+	if strings.Contains(out, "INSTALL_FAILED_UPDATE_INCOMPATIBLE") {
+		pkg := ""
+		if match := existingPackageRegexp.FindStringSubmatch(out); match != nil {
+			pkg = match[1]
+		} else if info, err := readApkInfo(apk); err == nil {
+			pkg = info.Package
+		}
+		return pkg, errSignatureMismatch
+	}
+	if err != nil {
+		return "", err
+	}
+	if !strings.Contains(out, "Success") {
+		return "", fmt.Errorf("adb install failed: %s", strings.TrimSpace(out))
+	}
+	return "", nil
+}
+
+// installedPackages lists the packages installed on the device.
+func installedPackages(serial string) ([]string, error) {
+	out, err := adb("-s", serial, "shell", "pm", "list", "packages")
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []string
+	for _, line := range strings.Split(out, "\n") {
+		if pkg, ok := strings.CutPrefix(strings.TrimSpace(line), "package:"); ok {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	return pkgs, nil
+}
+
+// patchableApps returns the names of the apps installed on the device that
+// the loaded patch catalog supports.
+func patchableApps(serial string) ([]string, error) {
+	pkgs, err := installedPackages(serial)
+	if err != nil {
+		return nil, err
+	}
+	installed := make(map[string]bool)
+	for _, pkg := range pkgs {
+		installed[pkg] = true
+	}
+
+	var apps []string
+	for _, app := range supportedApp {
+		if installed[getPackageNamesByAppName(app)] {
+			apps = append(apps, app)
+		}
+	}
+	sort.Strings(apps)
+	return apps, nil
+}
+
+func installedVersion(serial, pkg string) (string, error) {
+	out, err := adb("-s", serial, "shell", "dumpsys", "package", pkg)
+	if err != nil {
+		return "", err
+	}
+	match := versionNameRegexp.FindStringSubmatch(out)
+	if match == nil {
+		return "", fmt.Errorf("no version found for %s", pkg)
+	}
+	return match[1], nil
+}
+
+// apkPaths returns the device paths of the base and split APKs of pkg.
+func apkPaths(serial, pkg string) ([]string, error) {
+	out, err := adb("-s", serial, "shell", "pm", "path", pkg)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, line := range strings.Split(out, "\n") {
+		if p, ok := strings.CutPrefix(strings.TrimSpace(line), "package:"); ok {
+			paths = append(paths, p)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%s is not installed", pkg)
+	}
+	return paths, nil
+}
+
+// apkEditorPath is the APKEditor jar used to merge split APKs, which the
+// CLI can't patch directly.
+func apkEditorPath() string {
+	return readSetting("apkEditorPath", "patches/APKEditor.jar")
+}
+
+// pullPackage copies the APKs of pkg from the device and returns a single APK
+// ready to patch, merging splits when there are any, and its version.
+func pullPackage(serial, pkg string) (string, string, error) {
+	version, err := installedVersion(serial, pkg)
+	if err != nil {
+		return "", "", err
+	}
+	paths, err := apkPaths(serial, pkg)
+	if err != nil {
+		return "", "", err
+	}
+
+	dir := filepath.Join(pulledDir, sanitizeFileName(pkg+"-"+version))
+	splitsDir := filepath.Join(dir, "splits")
+	if err := os.MkdirAll(splitsDir, 0755); err != nil {
+		return "", "", err
+	}
+	for _, p := range paths {
+		if _, err := adb("-s", serial, "pull", p, filepath.Join(splitsDir, path.Base(p))); err != nil {
+			return "", "", err
+		}
+	}
+
+	apk := filepath.Join(dir, sanitizeFileName(pkg+"-"+version)+".apk")
+	if len(paths) == 1 {
+		if err := os.Rename(filepath.Join(splitsDir, path.Base(paths[0])), apk); err != nil {
+			return "", "", err
+		}
+		os.RemoveAll(splitsDir)
+		return apk, version, nil
+	}
+
+	if _, err := os.Stat(apkEditorPath()); err != nil {
+		return "", "", fmt.Errorf("%s is installed as %d split APKs (pulled to %s); merging them needs APKEditor at %s", pkg, len(paths), splitsDir, apkEditorPath())
+	}
+	if err := mergeSplits(splitsDir, apk); err != nil {
+		return "", "", err
+	}
+	return apk, version, nil
+}
+
+// mergeSplits merges the split APKs of input, a folder of them or an
+// .apkm/.xapk bundle, into the single APK apk with APKEditor.
+func mergeSplits(input, apk string) error {
+	if _, err := os.Stat(apkEditorPath()); err != nil {
+		return fmt.Errorf("merging split APKs needs APKEditor at %s", apkEditorPath())
+	}
+	out, err := exec.Command("java", "-jar", apkEditorPath(), "m", "-i", input, "-o", apk).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error merging split APKs: %v: %s", err, out)
+	}
+	return nil
+}
+
+// showPullDialog lets the user pick a device and one of its patchable apps,
+// pulls the app and passes it to onPulled.
+func showPullDialog(w fyne.Window, onPulled func(app, apk, version string)) {
+	devices, err := listDevices()
+	if err != nil {
+		dialog.ShowError(err, w)
+		return
+	}
+	var serials []string
+	for _, device := range devices {
+		if device.State == "device" {
+			serials = append(serials, device.Serial)
+		}
+	}
+	if len(serials) == 0 {
+		dialog.ShowInformation("Pull from device", "No device connected", w)
+		return
+	}
+
+	appSelect := widget.NewSelect(nil, nil)
+	deviceSelect := widget.NewSelect(serials, func(serial string) {
+		appSelect.ClearSelected()
+		appSelect.Options = nil
+		appSelect.Refresh()
+		progress := dialog.NewCustomWithoutButtons("Pull from device", widget.NewProgressBarInfinite(), w)
+		progress.Show()
+		go func() {
+			apps, err := patchableApps(serial)
+			fyne.Do(func() {
+				progress.Hide()
+				if err != nil {
+					dialog.ShowError(err, w)
+					return
+				}
+				appSelect.Options = apps
+				appSelect.Refresh()
+			})
+		}()
+	})
+
+	dialog.ShowForm("Pull from device", "Pull", "Cancel", []*widget.FormItem{
+		widget.NewFormItem("Device", deviceSelect),
+		widget.NewFormItem("App", appSelect),
+	}, func(ok bool) {
+		if !ok || appSelect.Selected == "" {
+			return
+		}
+		app := appSelect.Selected
+		serial := deviceSelect.Selected
+
+		progress := dialog.NewCustomWithoutButtons("Pull from device", widget.NewProgressBarInfinite(), w)
+		progress.Show()
+		go func() {
+			apk, version, err := pullPackage(serial, getPackageNamesByAppName(app))
+			if err == nil {
+				if entry, err := addToLibrary(apk, "device"); err != nil {
+					logger.Warn("adding apk to library", "path", apk, "err", err)
+				} else {
+					apk = entry.Path
+				}
+			}
+			fyne.Do(func() {
+				progress.Hide()
+				if err != nil {
+					dialog.ShowError(err, w)
+					return
+				}
+				onPulled(app, apk, version)
+			})
+		}()
+	}, w)
+	deviceSelect.SetSelectedIndex(0)
+}
+
+func uninstallPackage(serial, pkg string) error {
+	_, err := adb("-s", serial, "uninstall", pkg)
+	return err
+}
+
+// gmsCoreVendorPackage returns the GmsCore package a build needs on the
+// device, or "" when it was built without the GmsCore support patch.
+func gmsCoreVendorPackage(m *BuildManifest) string {
+	if m == nil {
+		return ""
+	}
+	found := false
+	for _, patch := range m.Patches {
+		if patch == gmsCorePatch {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return ""
+	}
+
+	vendor := defaultGmsCoreVendor
+	for _, patch := range m.Options {
+		if patch.PatchName != gmsCorePatch {
+			continue
+		}
+		for _, option := range patch.Options {
+			if value, ok := option.Value.(string); ok && option.Key == "gmsCoreVendorGroupId" && value != "" {
+				vendor = value
+			}
+		}
+	}
+	return vendor + ".android.gms"
+}
+
+// showInstallDialog lets the user pick a device and installs apk on it. m is
+// the build manifest of apk, if there is one.
+func showInstallDialog(apk string, m *BuildManifest, w fyne.Window) {
+	devices, err := listDevices()
+	if err != nil {
+		dialog.ShowError(err, w)
+		return
+	}
+	var names []string
+	for _, device := range devices {
+		if device.State == "device" {
+			names = append(names, device.String())
+		}
+	}
+	if len(names) == 0 {
+		dialog.ShowInformation("Install", "No device connected", w)
+		return
+	}
+
+	deviceSelect := widget.NewSelect(names, nil)
+	deviceSelect.SetSelectedIndex(0)
+	dialog.ShowForm("Install on device", "Install", "Cancel", []*widget.FormItem{
+		widget.NewFormItem("Device", deviceSelect),
+	}, func(ok bool) {
+		if !ok {
+			return
+		}
+		serial := ""
+		for _, device := range devices {
+			if device.String() == deviceSelect.Selected {
+				serial = device.Serial
+			}
+		}
+
+		install := func() {
+			go installWithRetry(serial, apk, w)
+		}
+
+		gms := gmsCoreVendorPackage(m)
+		if gms == "" {
+			install()
+			return
+		}
+		installed, err := isPackageInstalled(serial, gms)
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		if installed {
+			install()
+			return
+		}
+		dialog.ShowConfirm("GmsCore missing",
+			"This build needs "+gms+" (GmsCore/MicroG), which is not installed on the device.\nInstall anyway?",
+			func(ok bool) {
+				if ok {
+					install()
+				}
+			}, w)
+	}, w)
+}
+
+// installWithRetry installs apk and, on a signature mismatch, offers to
+// uninstall the installed app first.
+func installWithRetry(serial, apk string, w fyne.Window) {
+	pkg, err := installAPK(serial, apk)
+	fyne.Do(func() {
+		if err == nil {
+			dialog.ShowInformation("Install", "APK installed", w)
+			return
+		}
+		if !errors.Is(err, errSignatureMismatch) || pkg == "" {
+			dialog.ShowError(err, w)
+			return
+		}
+		dialog.ShowConfirm("Signature mismatch",
+			pkg+" is installed with a different signing key.\nUninstall it first? Its data will be lost.",
+			func(ok bool) {
+				if !ok {
+					return
+				}
+				go func() {
+					err := uninstallPackage(serial, pkg)
+					if err == nil {
+						_, err = installAPK(serial, apk)
+					}
+					fyne.Do(func() {
+						if err != nil {
+							dialog.ShowError(err, w)
+							return
+						}
+						dialog.ShowInformation("Install", "APK installed", w)
+					})
+				}()
+			}, w)
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeADB points adbPath at a shell script that prints out for any command
+// and records its arguments. It returns the file of the arguments.
+func fakeADB(t *testing.T, out string, exitCode int) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the adb stub is a shell script")
+	}
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	script := "#!/bin/sh\necho \"$@\" >> " + argsFile + "\ncat <<'EOF'\n" + out + "\nEOF\nexit " + string(rune('0'+exitCode)) + "\n"
+	stub := filepath.Join(dir, "adb")
+	if err := os.WriteFile(stub, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	oldSettings := settingsPath
+	settingsPath = filepath.Join(dir, "settings.txt")
+	t.Cleanup(func() { settingsPath = oldSettings })
+	if err := writeSetting("adbPath", stub); err != nil {
+		t.Fatal(err)
+	}
+	return argsFile
+}
+
+func TestListDevices(t *testing.T) {
+	fakeADB(t, `List of devices attached
+* daemon started successfully
+emulator-5554          device product:sdk_gphone64 model:sdk_gphone64_x86_64 device:emu64x
+R58M123ABC             unauthorized usb:1-1 transport_id:2`, 0)
+
+	devices, err := listDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("got %d devices, want 2: %v", len(devices), devices)
+	}
+	if devices[0].Serial != "emulator-5554" || devices[0].State != "device" || devices[0].Model != "sdk gphone64 x86 64" {
+		t.Errorf("first device = %+v", devices[0])
+	}
+	if devices[1].Serial != "R58M123ABC" || devices[1].State != "unauthorized" {
+		t.Errorf("second device = %+v", devices[1])
+	}
+}
+
+func TestInstallAPK(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		code    int
+		wantPkg string
+		wantErr error
+	}{
+		{"success", "Performing Streamed Install\nSuccess", 0, "", nil},
+		{"mismatch before Android 9", "Failure [INSTALL_FAILED_UPDATE_INCOMPATIBLE: Existing package com.google.android.youtube signatures do not match the previously installed version; ignoring!]", 1,
+			"com.google.android.youtube", errSignatureMismatch},
+		{"mismatch since Android 9", "Failure [INSTALL_FAILED_UPDATE_INCOMPATIBLE: Package com.google.android.youtube signatures do not match previously installed version; ignoring!]", 1,
+			"com.google.android.youtube", errSignatureMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			argsFile := fakeADB(t, tt.out, tt.code)
+			pkg, err := installAPK("emulator-5554", "app.apk")
+			if !errors.Is(err, tt.wantErr) || tt.wantErr == nil && err != nil {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if pkg != tt.wantPkg {
+				t.Errorf("pkg = %q, want %q", pkg, tt.wantPkg)
+			}
+			args, _ := os.ReadFile(argsFile)
+			if strings.TrimSpace(string(args)) != "-s emulator-5554 install -r app.apk" {
+				t.Errorf("adb called with %q", args)
+			}
+		})
+	}
+}
+
+func TestInstallAPKFailure(t *testing.T) {
+	fakeADB(t, "Failure [INSTALL_FAILED_INSUFFICIENT_STORAGE]", 1)
+	if _, err := installAPK("emulator-5554", "app.apk"); err == nil || errors.Is(err, errSignatureMismatch) {
+		t.Fatalf("err = %v, want an install error", err)
+	}
+}
+
+func TestIsPackageInstalled(t *testing.T) {
+	fakeADB(t, "package:com.google.android.youtube\npackage:com.google.android.youtube.music", 0)
+	for pkg, want := range map[string]bool{
+		"com.google.android.youtube":       true,
+		"com.google.android.youtube.music": true,
+		"com.google.android.apps":          false,
+	} {
+		got, err := isPackageInstalled("emulator-5554", pkg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("isPackageInstalled(%s) = %v, want %v", pkg, got, want)
+		}
+	}
+}
+
+func TestUninstallPackage(t *testing.T) {
+	argsFile := fakeADB(t, "Success", 0)
+	if err := uninstallPackage("emulator-5554", "com.google.android.youtube"); err != nil {
+		t.Fatal(err)
+	}
+	args, _ := os.ReadFile(argsFile)
+	if strings.TrimSpace(string(args)) != "-s emulator-5554 uninstall com.google.android.youtube" {
+		t.Errorf("adb called with %q", args)
+	}
+}
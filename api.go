@@ -0,0 +1,646 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultAPIAddr = "127.0.0.1:8642"
+
+var uploadsDir = "apps/uploads"
+
+// maxUploadSize bounds APK uploads, well above the size of any app the
+// bundles support.
+const maxUploadSize = 1 << 30
+
+func apiAddr() string {
+	return readSetting("apiAddr", defaultAPIAddr)
+}
+
+// apiToken returns the token clients must send, generating it on first use.
+func apiToken() (string, error) {
+	if token := readSetting("apiToken", ""); token != "" {
+		return token, nil
+	}
+	token, err := randomPassword()
+	if err != nil {
+		return "", err
+	}
+	return token, writeSetting("apiToken", token)
+}
+
+// Catalog is what a patch bundle offers, loaded once per bundle.
+type Catalog struct {
+	Source  string
+	Bundle  string
+	Apps    []string
+	Patches []PatchInfo
+	Options []PatchOptionsJSON
+}
+
+var catalogs = make(map[string]*Catalog)
+var catalogsMu sync.Mutex
+
+// loadCatalog loads the catalog of the latest bundle of source. It is read
+// from the lists kept next to the bundle, so the state and the files of the
+// GUI are left alone.
+func loadCatalog(source string) (*Catalog, error) {
+	found := false
+	for _, org := range orgNames {
+		found = found || org == source
+	}
+	if !found {
+		return nil, fmt.Errorf("unknown patch source %q", source)
+	}
+	bundle, err := getLatestPatchFile(source)
+	if err != nil {
+		return nil, err
+	}
+
+	catalogsMu.Lock()
+	defer catalogsMu.Unlock()
+	if catalog, ok := catalogs[bundle]; ok {
+		return catalog, nil
+	}
+	catalog := &Catalog{Source: source, Bundle: bundle}
+	if catalog.Patches, err = loadBundlePatches(bundle); err != nil {
+		return nil, err
+	}
+	if catalog.Options, err = loadBundleOptions(bundle); err != nil {
+		return nil, err
+	}
+	supported := make(map[string]bool)
+	for _, patch := range catalog.Patches {
+		for _, compatible := range patch.CompatiblePackages {
+			if name, ok := dict[compatible.Name]; ok && !supported[name] {
+				supported[name] = true
+				catalog.Apps = append(catalog.Apps, name)
+			}
+		}
+	}
+	sort.Strings(catalog.Apps)
+	if len(catalog.Patches) == 0 {
+		return nil, fmt.Errorf("no patches found in %s", bundle)
+	}
+	catalogs[bundle] = catalog
+	return catalog, nil
+}
+
+func (c *Catalog) patchesFor(pkg string) []PatchInfo {
+	var found []PatchInfo
+	for _, patch := range c.Patches {
+		for _, compatible := range patch.CompatiblePackages {
+			if compatible.Name == pkg {
+				found = append(found, patch)
+				break
+			}
+		}
+	}
+	return found
+}
+
+// appPatches returns the names of the patches of pkg in the order of the
+// patch table.
+func (c *Catalog) appPatches(pkg string) []string {
+	var names []string
+	for _, patch := range c.Patches {
+		if len(patch.CompatiblePackages) > 0 && patch.CompatiblePackages[0].Name == pkg {
+			names = append(names, patch.Name)
+		}
+	}
+	return names
+}
+
+// recommended returns the patches of pkg the bundle marks as use=true, like
+// recommendedPatches.
+func (c *Catalog) recommended(pkg string) []string {
+	var names []string
+	for _, patch := range c.Patches {
+		if len(patch.CompatiblePackages) > 0 && patch.CompatiblePackages[0].Name == pkg && patch.Use {
+			names = append(names, patch.Name)
+		}
+	}
+	return names
+}
+
+// universal returns the patches for any app the bundle marks as use=true,
+// like universalPatches.
+func (c *Catalog) universal() []string {
+	var names []string
+	for _, patch := range c.Patches {
+		if len(patch.CompatiblePackages) == 0 && patch.Use {
+			names = append(names, patch.Name)
+		}
+	}
+	return names
+}
+
+// options returns a copy of the default options of the bundle.
+func (c *Catalog) options() []PatchOptionsJSON {
+	return copyOptions(c.Options)
+}
+
+func (c *Catalog) versionsFor(pkg string) []string {
+	seen := make(map[string]bool)
+	var versions []string
+	for _, patch := range c.patchesFor(pkg) {
+		for _, compatible := range patch.CompatiblePackages {
+			if compatible.Name != pkg {
+				continue
+			}
+			for _, version := range compatible.Versions {
+				if !seen[version] {
+					seen[version] = true
+					versions = append(versions, version)
+				}
+			}
+		}
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// apiJob is the JSON form of a BatchJob.
+type apiJob struct {
+	ID         int       `json:"id"`
+	Status     JobStatus `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	App        string    `json:"app"`
+	Package    string    `json:"package"`
+	Version    string    `json:"version"`
+	Source     string    `json:"source"`
+	Profile    string    `json:"profile"`
+	Output     string    `json:"output"`
+	StartedAt  time.Time `json:"startedAt,omitzero"`
+	FinishedAt time.Time `json:"finishedAt,omitzero"`
+}
+
+func newAPIJob(job BatchJob) apiJob {
+	j := apiJob{
+		ID:         job.ID,
+		Status:     job.Status,
+		App:        job.Plan.App,
+		Package:    job.Plan.Package,
+		Version:    job.Plan.AppVersion,
+		Source:     job.Plan.Source,
+		Profile:    job.Plan.Profile,
+		Output:     job.Plan.OutputPath,
+		StartedAt:  job.StartedAt,
+		FinishedAt: job.FinishedAt,
+	}
+	if job.Err != nil {
+		j.Error = job.Err.Error()
+	}
+	return j
+}
+
+// Job returns a copy of the job id.
+func (q *JobQueue) Job(id int) (BatchJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if job := q.find(id); job != nil {
+		return *job, true
+	}
+	return BatchJob{}, false
+}
+
+// APIServer serves the local API. Jobs go to queue, the same one the GUI
+// shows when started from it.
+type APIServer struct {
+	token  string
+	queue  *JobQueue
+	server *http.Server
+}
+
+// startAPI listens on addr, which must be a loopback address.
+func startAPI(addr string, queue *JobQueue) (*APIServer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("the API only listens on localhost, not %s", host)
+	}
+	token, err := apiToken()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &APIServer{token: token, queue: queue}
+	s.server = &http.Server{Handler: s.routes(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("API server stopped", "err", err)
+		}
+	}()
+	logger.Info("API listening", "addr", listener.Addr().String())
+	return s, nil
+}
+
+func (s *APIServer) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+func (s *APIServer) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/sources", s.handleSources)
+	mux.HandleFunc("GET /api/sources/{source}/apps", s.handleApps)
+	mux.HandleFunc("GET /api/sources/{source}/apps/{app}/versions", s.handleVersions)
+	mux.HandleFunc("GET /api/sources/{source}/apps/{app}/patches", s.handlePatches)
+	mux.HandleFunc("GET /api/apps/{app}/profiles", s.handleProfiles)
+	mux.HandleFunc("PUT /api/apps/{app}/profiles/{name}", s.handlePutProfile)
+	mux.HandleFunc("DELETE /api/apps/{app}/profiles/{name}", s.handleDeleteProfile)
+	mux.HandleFunc("GET /api/apps/{app}/options", s.handleOptions)
+	mux.HandleFunc("PUT /api/apps/{app}/options", s.handlePutOptions)
+	mux.HandleFunc("POST /api/uploads", s.handleUpload)
+	mux.HandleFunc("GET /api/jobs", s.handleJobs)
+	mux.HandleFunc("POST /api/jobs", s.handleStartJob)
+	mux.HandleFunc("GET /api/jobs/{id}", s.handleJob)
+	mux.HandleFunc("POST /api/jobs/{id}/retry", s.handleRetryJob)
+	mux.HandleFunc("GET /api/jobs/{id}/log", s.handleJobLog)
+	mux.HandleFunc("GET /api/jobs/{id}/result", s.handleJobResult)
+	mux.HandleFunc("GET /api/jobs/{id}/manifest", s.handleJobManifest)
+	return s.authorize(mux)
+}
+
+// authorize checks the token, sent as a bearer token or, for EventSource
+// clients that can't set headers, as the token query parameter.
+func (s *APIServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			token = r.URL.Query().Get("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			writeAPIError(w, http.StatusUnauthorized, fmt.Errorf("invalid token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Error("writing API response", "err", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func readJSON(r *http.Request, v any) error {
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(v); err != nil {
+		return fmt.Errorf("error decoding request: %v", err)
+	}
+	return nil
+}
+
+// appPackage resolves the {app} of the path, an app name or a package.
+func appPackage(r *http.Request) (string, string, error) {
+	app := r.PathValue("app")
+	if pkg := getPackageNamesByAppName(app); pkg != "nil" {
+		return app, pkg, nil
+	}
+	if name, ok := dict[app]; ok {
+		return name, app, nil
+	}
+	return "", "", fmt.Errorf("unknown app %q", app)
+}
+
+func (s *APIServer) handleSources(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, orgNames)
+}
+
+func (s *APIServer) handleApps(w http.ResponseWriter, r *http.Request) {
+	catalog, err := loadCatalog(r.PathValue("source"))
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, catalog.Apps)
+}
+
+func (s *APIServer) handleVersions(w http.ResponseWriter, r *http.Request) {
+	catalog, err := loadCatalog(r.PathValue("source"))
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	_, pkg, err := appPackage(r)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, catalog.versionsFor(pkg))
+}
+
+func (s *APIServer) handlePatches(w http.ResponseWriter, r *http.Request) {
+	catalog, err := loadCatalog(r.PathValue("source"))
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	_, pkg, err := appPackage(r)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, catalog.patchesFor(pkg))
+}
+
+// handleProfiles lists the saved presets and the previous run of an app;
+// the built-in presets are resolved against a catalog when a job starts.
+func (s *APIServer) handleProfiles(w http.ResponseWriter, r *http.Request) {
+	_, pkg, err := appPackage(r)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	presets := loadPresets()
+	profiles := make(map[string][]string)
+	for name, patches := range presets.Saved[pkg] {
+		profiles[name] = patches
+	}
+	if previous, ok := presets.PreviousRun[pkg]; ok {
+		profiles[presetPreviousRun] = previous
+	}
+	writeJSON(w, http.StatusOK, profiles)
+}
+
+func (s *APIServer) handlePutProfile(w http.ResponseWriter, r *http.Request) {
+	_, pkg, err := appPackage(r)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	var patches []string
+	if err := readJSON(r, &patches); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := saveUserPreset(pkg, r.PathValue("name"), patches); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *APIServer) handleDeleteProfile(w http.ResponseWriter, r *http.Request) {
+	_, pkg, err := appPackage(r)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	if err := deleteUserPreset(pkg, r.PathValue("name")); err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *APIServer) handleOptions(w http.ResponseWriter, r *http.Request) {
+	_, pkg, err := appPackage(r)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	options, err := loadSavedOptions(pkg)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if options == nil {
+		options = []PatchOptionsJSON{}
+	}
+	writeJSON(w, http.StatusOK, options)
+}
+
+func (s *APIServer) handlePutOptions(w http.ResponseWriter, r *http.Request) {
+	_, pkg, err := appPackage(r)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	var options []PatchOptionsJSON
+	if err := readJSON(r, &options); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := saveOptions(pkg, options); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleUpload stores the APK in the request body in uploadsDir, named by
+// its package and version, and returns its path to use in a job.
+func (s *APIServer) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if err := os.MkdirAll(uploadsDir, 0755); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	tmp, err := os.CreateTemp(uploadsDir, "upload-*.apk")
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, http.MaxBytesReader(w, r.Body, maxUploadSize))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("error receiving APK: %v", err))
+		return
+	}
+
+	info, err := readApkInfo(tmp.Name())
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	version := info.VersionName
+	if version == "" {
+		version = strconv.FormatInt(info.VersionCode, 10)
+	}
+	path := filepath.Join(uploadsDir, sanitizeFileName(info.Package+"-"+version)+".apk")
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]any{"path": path, "apk": info})
+}
+
+func (s *APIServer) handleJobs(w http.ResponseWriter, r *http.Request) {
+	jobs, _ := s.queue.Jobs()
+	list := make([]apiJob, 0, len(jobs))
+	for _, job := range jobs {
+		list = append(list, newAPIJob(job))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleStartJob queues a JobSpec. The version defaults to the one of the
+// APK.
+func (s *APIServer) handleStartJob(w http.ResponseWriter, r *http.Request) {
+	var spec JobSpec
+	if err := readJSON(r, &spec); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	if spec.Version == "" {
+		if info, err := readApkInfo(spec.APK); err == nil {
+			spec.Version = info.VersionName
+		}
+	}
+	plan, err := planForJob(spec)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	job, err := s.queue.Add(plan)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	created, _ := s.queue.Job(job.ID)
+	writeJSON(w, http.StatusCreated, newAPIJob(created))
+}
+
+func (s *APIServer) job(w http.ResponseWriter, r *http.Request) (BatchJob, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err == nil {
+		if job, ok := s.queue.Job(id); ok {
+			return job, true
+		}
+	}
+	writeAPIError(w, http.StatusNotFound, fmt.Errorf("job %s not found", r.PathValue("id")))
+	return BatchJob{}, false
+}
+
+func (s *APIServer) handleJob(w http.ResponseWriter, r *http.Request) {
+	if job, ok := s.job(w, r); ok {
+		writeJSON(w, http.StatusOK, newAPIJob(job))
+	}
+}
+
+func (s *APIServer) handleRetryJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.job(w, r)
+	if !ok {
+		return
+	}
+	if err := s.queue.Retry(job.ID); err != nil {
+		writeAPIError(w, http.StatusConflict, err)
+		return
+	}
+	job, _ = s.queue.Job(job.ID)
+	writeJSON(w, http.StatusOK, newAPIJob(job))
+}
+
+// handleJobLog streams the console of a job as server-sent events, one
+// "line" event per line, then an "end" event with the job once it finished.
+func (s *APIServer) handleJobLog(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.job(w, r)
+	if !ok {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError, fmt.Errorf("streaming not supported"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	event := func(name string, v any) {
+		data, _ := json.Marshal(v)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+	}
+
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	seen := 0
+	for {
+		current, _ := s.queue.Job(job.ID)
+		finished := current.Status == jobDone || current.Status == jobFailed
+		if finished {
+			job.Console.Flush()
+		}
+		var lines []ConsoleLine
+		lines, seen = job.Console.Since(seen)
+		for _, line := range lines {
+			event("line", map[string]any{
+				"time":     line.Time,
+				"stream":   line.Stream,
+				"severity": line.Severity.String(),
+				"text":     line.Text,
+			})
+		}
+		if finished {
+			event("end", newAPIJob(current))
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *APIServer) handleJobResult(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.job(w, r)
+	if !ok {
+		return
+	}
+	if job.Status != jobDone {
+		writeAPIError(w, http.StatusConflict, fmt.Errorf("job %d is %s", job.ID, strings.ToLower(string(job.Status))))
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.android.package-archive")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(job.Plan.OutputPath)))
+	http.ServeFile(w, r, job.Plan.OutputPath)
+}
+
+func (s *APIServer) handleJobManifest(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.job(w, r)
+	if !ok {
+		return
+	}
+	if job.Status != jobDone {
+		writeAPIError(w, http.StatusConflict, fmt.Errorf("job %d is %s", job.ID, strings.ToLower(string(job.Status))))
+		return
+	}
+	m, err := loadBuildManifest(manifestPath(job.Plan.OutputPath))
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
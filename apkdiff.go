@@ -0,0 +1,473 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// classPrefixDepth is how many parts of a class's package its changes are
+// grouped by, such as app.revanced.extension.
+const classPrefixDepth = 3
+
+// ApkDiff is what a patch run changed in an APK, comparing the original
+// with the patched output.
+type ApkDiff struct {
+	Original   string `json:"original"`
+	Patched    string `json:"patched"`
+	OldPackage string `json:"oldPackage"`
+	NewPackage string `json:"newPackage"`
+	Version    string `json:"version"`
+
+	AddedPermissions   []string `json:"addedPermissions,omitempty"`
+	RemovedPermissions []string `json:"removedPermissions,omitempty"`
+	AddedProviders     []string `json:"addedProviders,omitempty"`
+	RemovedProviders   []string `json:"removedProviders,omitempty"`
+	AddedQueries       []string `json:"addedQueries,omitempty"`
+	RemovedQueries     []string `json:"removedQueries,omitempty"`
+
+	Classes       []ClassChange        `json:"classes,omitempty"`
+	Resources     []ResourceChange     `json:"resources,omitempty"`
+	ResourceTypes []ResourceTypeChange `json:"resourceTypes,omitempty"`
+	Sizes         []SizeDelta          `json:"sizes"`
+}
+
+// ClassChange counts the dex classes added and removed under a package
+// prefix.
+type ClassChange struct {
+	Prefix  string `json:"prefix"`
+	Added   int    `json:"added,omitempty"`
+	Removed int    `json:"removed,omitempty"`
+}
+
+// ResourceChange is a resource whose default value changed. Files that
+// kept their path but not their content are ContentChanged.
+type ResourceChange struct {
+	Name           string `json:"name"`
+	Old            string `json:"old"`
+	New            string `json:"new"`
+	ContentChanged bool   `json:"contentChanged,omitempty"`
+}
+
+// ResourceTypeChange counts the resources of a type that were added or
+// removed.
+type ResourceTypeChange struct {
+	Type    string `json:"type"`
+	Added   int    `json:"added,omitempty"`
+	Removed int    `json:"removed,omitempty"`
+}
+
+// SizeDelta is the compressed size of a group of entries before and after,
+// or of the whole APK for "Total".
+type SizeDelta struct {
+	Name string `json:"name"`
+	Old  int64  `json:"old"`
+	New  int64  `json:"new"`
+}
+
+// apkContents is what diffAPKs reads from each side.
+type apkContents struct {
+	inspection *ApkInspection
+	classes    map[string]bool
+	resources  map[string]string
+	crcs       map[string]uint32
+}
+
+func readApkContents(apk string) (*apkContents, error) {
+	inspection, err := inspectAPK(apk)
+	if err != nil {
+		return nil, err
+	}
+	r, err := zip.OpenReader(apk)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	contents := &apkContents{
+		inspection: inspection,
+		classes:    make(map[string]bool),
+		resources:  make(map[string]string),
+		crcs:       make(map[string]uint32),
+	}
+	for _, f := range r.File {
+		contents.crcs[f.Name] = f.CRC32
+		if path.Dir(f.Name) != "." || !strings.HasPrefix(f.Name, "classes") || path.Ext(f.Name) != ".dex" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		classes, err := dexClasses(data)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s of %s: %v", f.Name, apk, err)
+		}
+		for _, class := range classes {
+			contents.classes[class] = true
+		}
+	}
+	table, err := readResourceTable(&r.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("error reading resources of %s: %v", apk, err)
+	}
+	if table != nil {
+		contents.resources = table.Defaults()
+	}
+	return contents, nil
+}
+
+// dexClasses returns the descriptors of the classes defined in a dex file,
+// such as Lapp/revanced/Foo;.
+func dexClasses(data []byte) ([]string, error) {
+	if len(data) < 0x70 || string(data[:4]) != "dex\n" {
+		return nil, fmt.Errorf("not a dex file")
+	}
+	u32 := func(off int) (int, error) {
+		if off < 0 || off+4 > len(data) {
+			return 0, fmt.Errorf("offset %d out of range", off)
+		}
+		return int(binary.LittleEndian.Uint32(data[off:])), nil
+	}
+	stringIDs, _ := u32(0x3c)
+	typeIDs, _ := u32(0x44)
+	count, _ := u32(0x60)
+	classDefs, _ := u32(0x64)
+	// Each class def takes 32 bytes, so the count can't be more than fit.
+	if classDefs > len(data) || count > (len(data)-classDefs)/32 {
+		return nil, fmt.Errorf("class defs out of range")
+	}
+
+	classes := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		typeIndex, err := u32(classDefs + 32*i)
+		if err != nil {
+			return nil, err
+		}
+		stringIndex, err := u32(typeIDs + 4*typeIndex)
+		if err != nil {
+			return nil, err
+		}
+		off, err := u32(stringIDs + 4*stringIndex)
+		if err != nil {
+			return nil, err
+		}
+		// Skip the ULEB128 length in UTF-16 units, then read up to the NUL.
+		for off < len(data) && data[off]&0x80 != 0 {
+			off++
+		}
+		off++
+		end := off
+		for end < len(data) && data[end] != 0 {
+			end++
+		}
+		if off > len(data) || end >= len(data) {
+			return nil, fmt.Errorf("class name out of range")
+		}
+		classes = append(classes, string(data[off:end]))
+	}
+	return classes, nil
+}
+
+// classPrefix returns the package prefix a class descriptor is grouped by.
+func classPrefix(descriptor string) string {
+	name := strings.TrimSuffix(strings.TrimPrefix(descriptor, "L"), ";")
+	parts := strings.Split(name, "/")
+	parts = parts[:len(parts)-1]
+	if len(parts) == 0 {
+		return "(default package)"
+	}
+	if len(parts) > classPrefixDepth {
+		parts = parts[:classPrefixDepth]
+	}
+	return strings.Join(parts, ".")
+}
+
+// diffStrings returns the items only in b and the ones only in a.
+func diffStrings(a, b []string) (added, removed []string) {
+	return missingFrom(b, a), missingFrom(a, b)
+}
+
+// diffAPKs compares the patched APK with the original it was built from.
+func diffAPKs(original, patched string) (*ApkDiff, error) {
+	before, err := readApkContents(original)
+	if err != nil {
+		return nil, err
+	}
+	after, err := readApkContents(patched)
+	if err != nil {
+		return nil, err
+	}
+	a, b := before.inspection, after.inspection
+	diff := &ApkDiff{
+		Original:   original,
+		Patched:    patched,
+		OldPackage: a.Package,
+		NewPackage: b.Package,
+		Version:    b.VersionName,
+	}
+
+	diff.AddedPermissions, diff.RemovedPermissions = diffStrings(a.Permissions, b.Permissions)
+	providers := func(i *ApkInspection) []string {
+		var list []string
+		for _, p := range i.Providers {
+			list = append(list, fmt.Sprintf("%s (%s)", p.Name, p.Authorities))
+		}
+		return list
+	}
+	diff.AddedProviders, diff.RemovedProviders = diffStrings(providers(a), providers(b))
+	diff.AddedQueries, diff.RemovedQueries = diffStrings(a.Queries, b.Queries)
+
+	classes := make(map[string]*ClassChange)
+	count := func(class string, added bool) {
+		prefix := classPrefix(class)
+		c, ok := classes[prefix]
+		if !ok {
+			c = &ClassChange{Prefix: prefix}
+			classes[prefix] = c
+		}
+		if added {
+			c.Added++
+		} else {
+			c.Removed++
+		}
+	}
+	for class := range after.classes {
+		if !before.classes[class] {
+			count(class, true)
+		}
+	}
+	for class := range before.classes {
+		if !after.classes[class] {
+			count(class, false)
+		}
+	}
+	for _, c := range classes {
+		diff.Classes = append(diff.Classes, *c)
+	}
+	sort.Slice(diff.Classes, func(i, j int) bool { return diff.Classes[i].Prefix < diff.Classes[j].Prefix })
+
+	diff.Resources = diffResources(a, b, before, after)
+	diff.ResourceTypes = diffResourceTypes(before.resources, after.resources)
+	diff.Sizes = diffSizes(a, b)
+	return diff, nil
+}
+
+// diffResources lists the app name and icon, then every resource whose
+// default value or file changed.
+func diffResources(a, b *ApkInspection, before, after *apkContents) []ResourceChange {
+	var changes []ResourceChange
+	fileChanged := func(oldValue, newValue string) bool {
+		if oldValue != newValue || !strings.HasPrefix(newValue, "res/") {
+			return false
+		}
+		oldCRC, ok := before.crcs[oldValue]
+		newCRC, ok2 := after.crcs[newValue]
+		return ok && ok2 && oldCRC != newCRC
+	}
+	if a.Label != b.Label {
+		changes = append(changes, ResourceChange{Name: "App name", Old: a.Label, New: b.Label})
+	}
+	if a.Icon != b.Icon || fileChanged(a.Icon, b.Icon) {
+		changes = append(changes, ResourceChange{Name: "Icon", Old: a.Icon, New: b.Icon, ContentChanged: a.Icon == b.Icon})
+	}
+
+	var names []string
+	for name := range after.resources {
+		if _, ok := before.resources[name]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		oldValue, newValue := before.resources[name], after.resources[name]
+		switch {
+		case oldValue != newValue:
+			changes = append(changes, ResourceChange{Name: name, Old: oldValue, New: newValue})
+		case fileChanged(oldValue, newValue):
+			changes = append(changes, ResourceChange{Name: name, Old: oldValue, New: newValue, ContentChanged: true})
+		}
+	}
+	return changes
+}
+
+// diffResourceTypes counts the resources added and removed by type.
+func diffResourceTypes(before, after map[string]string) []ResourceTypeChange {
+	types := make(map[string]*ResourceTypeChange)
+	count := func(name string, added bool) {
+		typeName, _, _ := strings.Cut(name, "/")
+		c, ok := types[typeName]
+		if !ok {
+			c = &ResourceTypeChange{Type: typeName}
+			types[typeName] = c
+		}
+		if added {
+			c.Added++
+		} else {
+			c.Removed++
+		}
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			count(name, true)
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			count(name, false)
+		}
+	}
+	var changes []ResourceTypeChange
+	for _, c := range types {
+		changes = append(changes, *c)
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Type < changes[j].Type })
+	return changes
+}
+
+func diffSizes(a, b *ApkInspection) []SizeDelta {
+	sizes := []SizeDelta{{Name: "Total", Old: a.Size, New: b.Size}}
+	compressed := func(groups []SizeGroup, name string) int64 {
+		for _, g := range groups {
+			if g.Name == name {
+				return g.Compressed
+			}
+		}
+		return 0
+	}
+	for _, name := range sizeGroupOrder {
+		oldSize, newSize := compressed(a.Sizes, name), compressed(b.Sizes, name)
+		if oldSize != 0 || newSize != 0 {
+			sizes = append(sizes, SizeDelta{Name: name, Old: oldSize, New: newSize})
+		}
+	}
+	return sizes
+}
+
+// formatSizeDelta formats a size change with its sign.
+func formatSizeDelta(delta int64) string {
+	if delta < 0 {
+		return "-" + formatSize(-delta)
+	}
+	return "+" + formatSize(delta)
+}
+
+// Markdown formats the diff for the GUI and the CLI.
+func (d *ApkDiff) Markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "## %s %s: original → patched\n\n", d.NewPackage, d.Version)
+	fmt.Fprintf(&b, "- Original: %s\n- Patched: %s\n\n", d.Original, d.Patched)
+
+	b.WriteString("### Manifest\n\n")
+	if d.OldPackage != d.NewPackage {
+		fmt.Fprintf(&b, "- Package: %s → %s\n", d.OldPackage, d.NewPackage)
+	}
+	list := func(what string, items []string) {
+		for _, item := range items {
+			fmt.Fprintf(&b, "- %s: %s\n", what, item)
+		}
+	}
+	list("Added permission", d.AddedPermissions)
+	list("Removed permission", d.RemovedPermissions)
+	list("Added provider", d.AddedProviders)
+	list("Removed provider", d.RemovedProviders)
+	list("Added query", d.AddedQueries)
+	list("Removed query", d.RemovedQueries)
+	if d.OldPackage == d.NewPackage && len(d.AddedPermissions)+len(d.RemovedPermissions)+len(d.AddedProviders)+
+		len(d.RemovedProviders)+len(d.AddedQueries)+len(d.RemovedQueries) == 0 {
+		b.WriteString("No changes.\n")
+	}
+
+	b.WriteString("\n### Dex classes\n\n")
+	if len(d.Classes) == 0 {
+		b.WriteString("No classes added or removed.\n")
+	}
+	for _, c := range d.Classes {
+		fmt.Fprintf(&b, "- %s: +%d -%d\n", c.Prefix, c.Added, c.Removed)
+	}
+
+	b.WriteString("\n### Resources\n\n")
+	if len(d.Resources) == 0 && len(d.ResourceTypes) == 0 {
+		b.WriteString("No changes.\n")
+	}
+	for _, r := range d.Resources {
+		if r.ContentChanged {
+			fmt.Fprintf(&b, "- %s: `%s` (new content)\n", r.Name, r.New)
+		} else {
+			fmt.Fprintf(&b, "- %s: `%s` → `%s`\n", r.Name, r.Old, r.New)
+		}
+	}
+	for _, t := range d.ResourceTypes {
+		fmt.Fprintf(&b, "- %s resources: +%d -%d\n", t.Type, t.Added, t.Removed)
+	}
+
+	b.WriteString("\n### Sizes\n\n")
+	for _, s := range d.Sizes {
+		fmt.Fprintf(&b, "- %s: %s → %s (%s)\n", s.Name, formatSize(s.Old), formatSize(s.New), formatSizeDelta(s.New-s.Old))
+	}
+	return b.String()
+}
+
+// showApkDiff compares patched with original in the background and shows
+// the report, which can be exported as Markdown or JSON.
+func showApkDiff(w fyne.Window, original, patched string) {
+	progress := dialog.NewCustomWithoutButtons("Patch changes", widget.NewProgressBarInfinite(), w)
+	progress.Show()
+	go func() {
+		diff, err := diffAPKs(original, patched)
+		fyne.Do(func() {
+			progress.Hide()
+			if err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
+
+			report := diff.Markdown()
+			text := widget.NewRichTextFromMarkdown(report)
+			text.Wrapping = fyne.TextWrapWord
+			scroll := container.NewVScroll(text)
+			scroll.SetMinSize(fyne.NewSize(700, 500))
+
+			export := func(ext string, data []byte) {
+				fd := dialog.NewFileSave(func(file fyne.URIWriteCloser, err error) {
+					if err != nil || file == nil {
+						return
+					}
+					defer file.Close()
+					if _, err := file.Write(data); err != nil {
+						dialog.ShowError(err, w)
+					}
+				}, w)
+				fd.SetFileName(strings.TrimSuffix(filepath.Base(patched), ".apk") + ".changes" + ext)
+				fd.Resize(fyne.NewSize(800, 700))
+				fd.Show()
+			}
+			d := dialog.NewCustomWithoutButtons("Patch changes", scroll, w)
+			d.SetButtons([]fyne.CanvasObject{
+				widget.NewButton("Export Markdown...", func() { export(".md", []byte(report)) }),
+				widget.NewButton("Export JSON...", func() {
+					data, _ := json.MarshalIndent(diff, "", "  ")
+					export(".json", data)
+				}),
+				widget.NewButton("Close", d.Hide),
+			})
+			d.Show()
+		})
+	}()
+}
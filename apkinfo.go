@@ -0,0 +1,349 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode/utf16"
+)
+
+// Chunk types of Android binary XML.
+const (
+	axmlStringPool   = 0x0001
+	axmlFile         = 0x0003
+	axmlStartElement = 0x0102
+	axmlEndElement   = 0x0103
+	axmlResourceMap  = 0x0180
+)
+
+// Value types of binary XML attributes.
+const (
+	axmlTypeReference = 0x01
+	axmlTypeString    = 0x03
+	axmlTypeFloat     = 0x04
+	axmlTypeIntDec    = 0x10
+	axmlTypeIntHex    = 0x11
+	axmlTypeBoolean   = 0x12
+)
+
+// androidAttrNames names the android: attributes by resource ID, for APKs
+// whose string pool has the attribute names stripped.
+var androidAttrNames = map[uint32]string{
+	0x01010001: "label",
+	0x01010002: "icon",
+	0x01010003: "name",
+	0x01010010: "exported",
+	0x01010018: "authorities",
+	0x01010199: "drawable",
+	0x0101020c: "minSdkVersion",
+	0x0101021b: "versionCode",
+	0x0101021c: "versionName",
+	0x01010270: "targetSdkVersion",
+	0x01010271: "maxSdkVersion",
+	0x01010572: "compileSdkVersion",
+}
+
+// XMLElement is an element of a decoded binary XML document.
+type XMLElement struct {
+	Name     string
+	Attrs    []XMLAttr
+	Children []*XMLElement
+}
+
+// XMLAttr is an attribute with its value formatted as aapt2 dump prints it.
+// Type and Data keep the raw value for references.
+type XMLAttr struct {
+	Name  string
+	Value string
+	Type  uint8
+	Data  uint32
+}
+
+// Attr returns the value of the attribute name, or "".
+func (e *XMLElement) Attr(name string) string {
+	for _, attr := range e.Attrs {
+		if attr.Name == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// AttrRef returns the resource ID the attribute name refers to, or 0 when
+// it isn't a reference.
+func (e *XMLElement) AttrRef(name string) uint32 {
+	for _, attr := range e.Attrs {
+		if attr.Name == name && attr.Type == axmlTypeReference {
+			return attr.Data
+		}
+	}
+	return 0
+}
+
+// Children named name.
+func (e *XMLElement) Find(name string) []*XMLElement {
+	var found []*XMLElement
+	for _, child := range e.Children {
+		if child.Name == name {
+			found = append(found, child)
+		}
+	}
+	return found
+}
+
+// parseAXML decodes an Android binary XML document such as the
+// AndroidManifest.xml of an APK.
+func parseAXML(data []byte) (*XMLElement, error) {
+	if len(data) < 8 || binary.LittleEndian.Uint16(data) != axmlFile {
+		return nil, fmt.Errorf("not a binary XML file")
+	}
+
+	var pool []string
+	var resourceIDs []uint32
+	var root *XMLElement
+	var stack []*XMLElement
+
+	str := func(i uint32) string {
+		if int(i) < len(pool) {
+			return pool[i]
+		}
+		return ""
+	}
+
+	offset := int(binary.LittleEndian.Uint16(data[2:]))
+	for offset+8 <= len(data) {
+		chunkType := binary.LittleEndian.Uint16(data[offset:])
+		headerSize := int(binary.LittleEndian.Uint16(data[offset+2:]))
+		size := int(binary.LittleEndian.Uint32(data[offset+4:]))
+		if size < 8 || offset+size > len(data) {
+			return nil, fmt.Errorf("corrupt chunk at offset %d", offset)
+		}
+		chunk := data[offset : offset+size]
+
+		switch chunkType {
+		case axmlStringPool:
+			var err error
+			if pool, err = parseStringPool(chunk); err != nil {
+				return nil, err
+			}
+		case axmlResourceMap:
+			for i := headerSize; i+4 <= size; i += 4 {
+				resourceIDs = append(resourceIDs, binary.LittleEndian.Uint32(chunk[i:]))
+			}
+		case axmlStartElement:
+			if headerSize+20 > size {
+				return nil, fmt.Errorf("corrupt element at offset %d", offset)
+			}
+			ext := chunk[headerSize:]
+			element := &XMLElement{Name: str(binary.LittleEndian.Uint32(ext[4:]))}
+			attrStart := int(binary.LittleEndian.Uint16(ext[8:]))
+			attrSize := int(binary.LittleEndian.Uint16(ext[10:]))
+			attrCount := int(binary.LittleEndian.Uint16(ext[12:]))
+			for i := 0; i < attrCount; i++ {
+				a := attrStart + i*attrSize
+				if a+20 > len(ext) {
+					return nil, fmt.Errorf("corrupt attribute at offset %d", offset)
+				}
+				nameIndex := binary.LittleEndian.Uint32(ext[a+4:])
+				attr := XMLAttr{
+					Name: str(nameIndex),
+					Type: ext[a+15],
+					Data: binary.LittleEndian.Uint32(ext[a+16:]),
+				}
+				if int(nameIndex) < len(resourceIDs) {
+					if name, ok := androidAttrNames[resourceIDs[nameIndex]]; ok {
+						attr.Name = name
+					}
+				}
+				raw := binary.LittleEndian.Uint32(ext[a+8:])
+				attr.Value = formatAXMLValue(attr.Type, attr.Data, str(raw), str(attr.Data))
+				element.Attrs = append(element.Attrs, attr)
+			}
+			if len(stack) == 0 {
+				if root == nil {
+					root = element
+				}
+			} else {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, element)
+			}
+			stack = append(stack, element)
+		case axmlEndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+		offset += size
+	}
+
+	if root == nil {
+		return nil, fmt.Errorf("no root element")
+	}
+	return root, nil
+}
+
+func formatAXMLValue(valueType uint8, data uint32, raw, dataString string) string {
+	switch valueType {
+	case axmlTypeString:
+		return dataString
+	case axmlTypeReference:
+		return fmt.Sprintf("@0x%08x", data)
+	case axmlTypeIntDec:
+		return strconv.FormatInt(int64(int32(data)), 10)
+	case axmlTypeIntHex:
+		return fmt.Sprintf("0x%x", data)
+	case axmlTypeBoolean:
+		return strconv.FormatBool(data != 0)
+	}
+	if raw != "" {
+		return raw
+	}
+	return fmt.Sprintf("0x%08x", data)
+}
+
+// parseStringPool decodes a ResStringPool chunk, UTF-8 or UTF-16.
+func parseStringPool(chunk []byte) ([]string, error) {
+	if len(chunk) < 28 {
+		return nil, fmt.Errorf("corrupt string pool")
+	}
+	count := int(binary.LittleEndian.Uint32(chunk[8:]))
+	flags := binary.LittleEndian.Uint32(chunk[16:])
+	stringsStart := int(binary.LittleEndian.Uint32(chunk[20:]))
+	headerSize := int(binary.LittleEndian.Uint16(chunk[2:]))
+	utf8 := flags&0x100 != 0
+
+	if headerSize+count*4 > len(chunk) {
+		return nil, fmt.Errorf("corrupt string pool")
+	}
+	pool := make([]string, count)
+	for i := range pool {
+		pos := stringsStart + int(binary.LittleEndian.Uint32(chunk[headerSize+i*4:]))
+		if pos >= len(chunk) {
+			return nil, fmt.Errorf("corrupt string pool")
+		}
+		var err error
+		if utf8 {
+			pool[i], err = decodeUTF8PoolString(chunk[pos:])
+		} else {
+			pool[i], err = decodeUTF16PoolString(chunk[pos:])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pool, nil
+}
+
+func decodeUTF8PoolString(b []byte) (string, error) {
+	// The UTF-16 length comes first and is skipped, then the UTF-8 length,
+	// each one or two bytes long.
+	pos := 0
+	length := func() int {
+		if pos >= len(b) {
+			return -1
+		}
+		n := int(b[pos])
+		pos++
+		if n&0x80 != 0 {
+			if pos >= len(b) {
+				return -1
+			}
+			n = (n&0x7f)<<8 | int(b[pos])
+			pos++
+		}
+		return n
+	}
+	length()
+	n := length()
+	if n < 0 || pos+n > len(b) {
+		return "", fmt.Errorf("corrupt string pool")
+	}
+	return string(b[pos : pos+n]), nil
+}
+
+func decodeUTF16PoolString(b []byte) (string, error) {
+	if len(b) < 2 {
+		return "", fmt.Errorf("corrupt string pool")
+	}
+	n := int(binary.LittleEndian.Uint16(b))
+	pos := 2
+	if n&0x8000 != 0 {
+		if len(b) < 4 {
+			return "", fmt.Errorf("corrupt string pool")
+		}
+		n = (n&0x7fff)<<16 | int(binary.LittleEndian.Uint16(b[2:]))
+		pos = 4
+	}
+	if pos+n*2 > len(b) {
+		return "", fmt.Errorf("corrupt string pool")
+	}
+	chars := make([]uint16, n)
+	for i := range chars {
+		chars[i] = binary.LittleEndian.Uint16(b[pos+i*2:])
+	}
+	return string(utf16.Decode(chars)), nil
+}
+
+// readZipEntry returns the content of name in the zip archive at path.
+func readZipEntry(path, name string) ([]byte, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+	return nil, fmt.Errorf("%s not found in %s", name, path)
+}
+
+func readApkManifest(path string) (*XMLElement, error) {
+	data, err := readZipEntry(path, "AndroidManifest.xml")
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := parseAXML(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing manifest of %s: %v", path, err)
+	}
+	return manifest, nil
+}
+
+// ApkInfo is what the manifest of an APK says about it.
+type ApkInfo struct {
+	Package     string `json:"package"`
+	VersionName string `json:"versionName"`
+	VersionCode int64  `json:"versionCode"`
+	MinSDK      int    `json:"minSdk,omitempty"`
+	TargetSDK   int    `json:"targetSdk,omitempty"`
+}
+
+func readApkInfo(path string) (*ApkInfo, error) {
+	manifest, err := readApkManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	info := &ApkInfo{
+		Package:     manifest.Attr("package"),
+		VersionName: manifest.Attr("versionName"),
+	}
+	info.VersionCode, _ = strconv.ParseInt(manifest.Attr("versionCode"), 0, 64)
+	for _, sdk := range manifest.Find("uses-sdk") {
+		info.MinSDK, _ = strconv.Atoi(sdk.Attr("minSdkVersion"))
+		info.TargetSDK, _ = strconv.Atoi(sdk.Attr("targetSdkVersion"))
+	}
+	if info.Package == "" {
+		return nil, fmt.Errorf("no package name in the manifest of %s", path)
+	}
+	return info, nil
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"github.com/PuerkitoBio/goquery"
+)
+
+const defaultApkMirrorURL = "https://www.apkmirror.com"
+
+// apkCacheDir is where downloaded APKs are kept, so that each variant of a
+// version is only downloaded once.
+var apkCacheDir = "apps/cache"
+
+// Download sites refuse requests without a browser user agent.
+const browserUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0 Safari/537.36"
+
+// apkMirrorURL is the ApkMirror site, or a mirror of it set with the
+// apkMirrorUrl setting.
+func apkMirrorURL() string {
+	return strings.TrimRight(readSetting("apkMirrorUrl", defaultApkMirrorURL), "/")
+}
+
+// apkMirrorSearchURL is the search the browser opens when the in-app
+// download can't be used.
+func apkMirrorSearchURL(app, version string) string {
+	query := url.QueryEscape(strings.TrimSpace(app + " " + version))
+	return apkMirrorURL() + "/?post_type=app_release&searchtype=apk&bundles%5B%5D=apkm_bundles&bundles%5B%5D=apk_files&s=" + query
+}
+
+// ApkVariant is a row of the variants table of an ApkMirror release.
+type ApkVariant struct {
+	Name       string
+	Bundle     bool
+	Arch       string
+	MinAndroid string
+	DPI        string
+	URL        string
+}
+
+func (v ApkVariant) String() string {
+	kind := "APK"
+	if v.Bundle {
+		kind = "Bundle"
+	}
+	return fmt.Sprintf("%s %s, %s, %s, %s", kind, v.Name, v.Arch, v.MinAndroid, v.DPI)
+}
+
+// key names the variant in cache file names.
+func (v ApkVariant) key() string {
+	kind := "apk"
+	if v.Bundle {
+		kind = "bundle"
+	}
+	arch := strings.Join(strings.Fields(strings.ReplaceAll(v.Arch, "+", " ")), "_")
+	return strings.Join([]string{kind, arch, v.DPI}, "-")
+}
+
+// VariantPrefs are what pickVariant looks for. Android is the Android
+// version of the device, 0 for any.
+type VariantPrefs struct {
+	Bundle  bool
+	Arch    string
+	DPI     string
+	Android float64
+}
+
+// apkMirrorPrefs reads the variant preferences from the apkMirrorType,
+// apkMirrorArch, apkMirrorDpi and apkMirrorAndroid settings.
+func apkMirrorPrefs() VariantPrefs {
+	prefs := VariantPrefs{
+		Bundle: readSetting("apkMirrorType", "apk") == "bundle",
+		Arch:   readSetting("apkMirrorArch", "arm64-v8a"),
+		DPI:    readSetting("apkMirrorDpi", "nodpi"),
+	}
+	prefs.Android, _ = strconv.ParseFloat(readSetting("apkMirrorAndroid", "0"), 64)
+	return prefs
+}
+
+var androidVersionRegexp = regexp.MustCompile(`(\d+(\.\d+)?)`)
+
+// minAndroid returns the Android version of "Android 8.0+", or 0.
+func (v ApkVariant) minAndroid() float64 {
+	match := androidVersionRegexp.FindString(v.MinAndroid)
+	f, _ := strconv.ParseFloat(match, 64)
+	return f
+}
+
+func (v ApkVariant) universal() bool {
+	arch := strings.ToLower(v.Arch)
+	return arch == "" || strings.Contains(arch, "universal") || strings.Contains(arch, "noarch")
+}
+
+// pickVariant returns the index of the variant that best matches prefs,
+// or -1 when none runs on the device. Type, architecture and DPI are
+// preferences; a variant that needs a newer Android is never picked.
+func pickVariant(variants []ApkVariant, prefs VariantPrefs) int {
+	best, bestScore := -1, -1
+	for i, v := range variants {
+		if prefs.Android > 0 && v.minAndroid() > prefs.Android {
+			continue
+		}
+		score := 0
+		switch {
+		case prefs.Arch != "" && strings.Contains(strings.ToLower(v.Arch), strings.ToLower(prefs.Arch)):
+			score += 4
+		case v.universal():
+			score += 3
+		case prefs.Arch != "":
+			// Built for another architecture, it won't install.
+			continue
+		}
+		if v.Bundle == prefs.Bundle {
+			score += 8
+		}
+		if strings.EqualFold(v.DPI, prefs.DPI) {
+			score += 2
+		}
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// scraper fetches the pages of a download site like a browser does.
+type scraper struct {
+	base   *url.URL
+	client *http.Client
+}
+
+func newScraper(base string) (*scraper, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing URL %s: %v", base, err)
+	}
+	jar, _ := cookiejar.New(nil)
+	return &scraper{base: u, client: &http.Client{Jar: jar}}, nil
+}
+
+// ApkMirror downloads APKs from an ApkMirror site.
+type ApkMirror struct {
+	*scraper
+
+	mu    sync.Mutex
+	paths map[string]string
+}
+
+func newApkMirror(base string) (*ApkMirror, error) {
+	s, err := newScraper(base)
+	if err != nil {
+		return nil, err
+	}
+	return &ApkMirror{scraper: s, paths: make(map[string]string)}, nil
+}
+
+// setAppPath sets the path of the ApkMirror page of pkg, for apps the
+// search doesn't find.
+func (m *ApkMirror) setAppPath(pkg, path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.paths[pkg] = path
+}
+
+var apkMirror struct {
+	sync.Mutex
+	m *ApkMirror
+}
+
+// defaultApkMirror returns the ApkMirror of the apkMirrorUrl setting,
+// keeping what it resolved while the setting stays the same.
+func defaultApkMirror() (*ApkMirror, error) {
+	apkMirror.Lock()
+	defer apkMirror.Unlock()
+	if apkMirror.m != nil && apkMirror.m.base.String() == apkMirrorURL() {
+		return apkMirror.m, nil
+	}
+	m, err := newApkMirror(apkMirrorURL())
+	if err != nil {
+		return nil, err
+	}
+	apkMirror.m = m
+	return m, nil
+}
+
+func (s *scraper) request(ref, referer string) (*http.Request, error) {
+	u, err := s.base.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", browserUserAgent)
+	if referer != "" {
+		req.Header.Set("Referer", referer)
+	}
+	return req, nil
+}
+
+// page fetches and parses the page at ref, relative to the site.
+func (s *scraper) page(ref, referer string) (*goquery.Document, error) {
+	req, err := s.request(ref, referer)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug("scraping", "url", req.URL.String())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s not found: %w", req.URL, os.ErrNotExist)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error requesting %s: %s", req.URL, resp.Status)
+	}
+	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", req.URL, err)
+	}
+	doc.Url = req.URL
+	return doc, nil
+}
+
+var appPathRegexp = regexp.MustCompile(`^/apk/[^/]+/[^/]+/$`)
+
+// appPath returns the path of the ApkMirror page of pkg, such as
+// "/apk/google-inc/youtube/", found by searching for the package name.
+func (m *ApkMirror) appPath(pkg string) (string, error) {
+	m.mu.Lock()
+	path, ok := m.paths[pkg]
+	m.mu.Unlock()
+	if ok {
+		return path, nil
+	}
+
+	doc, err := m.page("/?post_type=app_release&searchtype=app&s="+url.QueryEscape(pkg), "")
+	if err != nil {
+		return "", fmt.Errorf("error searching ApkMirror for %s: %v", pkg, err)
+	}
+	doc.Find(".appRow .appRowTitle a").EachWithBreak(func(_ int, a *goquery.Selection) bool {
+		href, _ := a.Attr("href")
+		if u, err := doc.Url.Parse(href); err == nil && appPathRegexp.MatchString(u.Path) {
+			path = u.Path
+			return false
+		}
+		return true
+	})
+	if path == "" {
+		return "", fmt.Errorf("%s not found on ApkMirror", pkg)
+	}
+	m.mu.Lock()
+	m.paths[pkg] = path
+	m.mu.Unlock()
+	return path, nil
+}
+
+// releasePage returns the release page of version of pkg. Release pages
+// are named after the app and the version with dashes, and found through
+// the search when they aren't.
+func (m *ApkMirror) releasePage(pkg, version string) (*goquery.Document, error) {
+	appPath, err := m.appPath(pkg)
+	if err != nil {
+		return nil, err
+	}
+	slug := filepath.Base(strings.TrimSuffix(appPath, "/"))
+	release := slug + "-" + strings.ReplaceAll(version, ".", "-") + "-release/"
+	doc, err := m.page(appPath+release, "")
+	if err == nil {
+		return doc, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	search, err := m.page("/?post_type=app_release&searchtype=apk&s="+url.QueryEscape(pkg+" "+version), "")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("version %s of %s not found on ApkMirror", version, pkg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var found string
+	search.Find(".appRow .appRowTitle a").EachWithBreak(func(_ int, a *goquery.Selection) bool {
+		href, _ := a.Attr("href")
+		u, err := search.Url.Parse(href)
+		if err == nil && strings.HasPrefix(u.Path, appPath) && strings.Contains(u.Path, "-"+strings.ReplaceAll(version, ".", "-")+"-") {
+			found = u.Path
+			return false
+		}
+		return true
+	})
+	if found == "" {
+		return nil, fmt.Errorf("version %s of %s not found on ApkMirror", version, pkg)
+	}
+	return m.page(found, "")
+}
+
+// Variants lists the variants of version of pkg.
+func (m *ApkMirror) Variants(pkg, version string) ([]ApkVariant, error) {
+	doc, err := m.releasePage(pkg, version)
+	if err != nil {
+		return nil, err
+	}
+	variants := parseVariants(doc)
+	if len(variants) == 0 {
+		// Releases with a single variant have no table and are downloaded
+		// from the release page itself.
+		if _, ok := doc.Find("a.downloadButton").Attr("href"); ok {
+			variants = append(variants, ApkVariant{
+				Name:   version,
+				Bundle: strings.Contains(strings.ToLower(doc.Find("a.downloadButton").Text()), "bundle"),
+				URL:    doc.Url.String(),
+			})
+		}
+	}
+	if len(variants) == 0 {
+		return nil, fmt.Errorf("no downloads found for %s %s", pkg, version)
+	}
+	return variants, nil
+}
+
+// parseVariants reads the variants table of a release page. Its first row
+// is a header, without a link.
+func parseVariants(doc *goquery.Document) []ApkVariant {
+	var variants []ApkVariant
+	doc.Find(".variants-table .table-row").Each(func(_ int, row *goquery.Selection) {
+		cells := row.Find(".table-cell")
+		link := cells.First().Find("a.accent_color")
+		href, ok := link.Attr("href")
+		if !ok || cells.Length() < 4 {
+			return
+		}
+		u, err := doc.Url.Parse(href)
+		if err != nil {
+			return
+		}
+		text := func(i int) string {
+			return strings.Join(strings.Fields(cells.Eq(i).Text()), " ")
+		}
+		badge := strings.ToUpper(strings.TrimSpace(cells.First().Find(".apkm-badge").Text()))
+		variants = append(variants, ApkVariant{
+			Name:       strings.Join(strings.Fields(link.Text()), " "),
+			Bundle:     badge == "BUNDLE",
+			Arch:       text(1),
+			MinAndroid: text(2),
+			DPI:        text(3),
+			URL:        u.String(),
+		})
+	})
+	return variants
+}
+
+// fileURL follows the variant page to its download page and returns the
+// link to the file, and the page it is on for the referer.
+func (m *ApkMirror) fileURL(v ApkVariant) (string, string, error) {
+	variant, err := m.page(v.URL, "")
+	if err != nil {
+		return "", "", err
+	}
+	href, ok := variant.Find("a.downloadButton").Attr("href")
+	if !ok {
+		return "", "", fmt.Errorf("no download button on %s", v.URL)
+	}
+	download, err := m.page(href, variant.Url.String())
+	if err != nil {
+		return "", "", err
+	}
+	href, ok = download.Find("a#download-link").Attr("href")
+	if !ok {
+		href, ok = download.Find(`a[href*="download.php"]`).Attr("href")
+	}
+	if !ok {
+		return "", "", fmt.Errorf("no download link on %s", download.Url)
+	}
+	u, err := download.Url.Parse(href)
+	if err != nil {
+		return "", "", err
+	}
+	return u.String(), download.Url.String(), nil
+}
+
+// apkCachePath is where the variant v of version of pkg is cached.
+func apkCachePath(pkg, version string, v ApkVariant) string {
+	return filepath.Join(apkCacheDirFor(pkg, version), "apkmirror-"+sanitizeFileName(v.key())+".apk")
+}
+
+// Download saves the variant v of version of pkg in the cache unless it is
+// already there, and returns its path.
+func (m *ApkMirror) Download(pkg, version string, v ApkVariant, progress func(done, total int64)) (string, error) {
+	dest := apkCachePath(pkg, version, v)
+	if _, err := os.Stat(dest); err == nil {
+		logger.Info("apk in cache", "path", dest)
+		return dest, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+	part := dest + ".part"
+	if err := m.downloadVariant(v, part, progress); err != nil {
+		os.Remove(part)
+		return "", fmt.Errorf("error downloading %s %s: %v", pkg, version, err)
+	}
+	return storeDownloadedAPK(part, dest, pkg, version, "apkmirror")
+}
+
+// downloadVariant saves the file of v, an APK or a bundle, in dest.
+func (m *ApkMirror) downloadVariant(v ApkVariant, dest string, progress func(done, total int64)) error {
+	link, referer, err := m.fileURL(v)
+	if err != nil {
+		return err
+	}
+	req, err := m.request(link, referer)
+	if err != nil {
+		return err
+	}
+	logger.Info("downloading apk", "variant", v.String(), "url", link)
+	return downloadRequest(m.client, req, dest, progress)
+}
+
+// showApkMirrorDialog looks version of app up on ApkMirror, lets the user
+// pick a variant, preselecting the one that fits the preferences, downloads
+// it and passes its path to onDownloaded.
+func showApkMirrorDialog(w fyne.Window, app, version string, onDownloaded func(apk string)) {
+	pkg := getPackageNamesByAppName(app)
+	m, err := defaultApkMirror()
+	if err != nil {
+		dialog.ShowError(err, w)
+		return
+	}
+
+	lookup := dialog.NewCustomWithoutButtons("ApkMirror", container.NewVBox(
+		widget.NewLabel("Looking up "+app+" "+version+"..."),
+		widget.NewProgressBarInfinite(),
+	), w)
+	lookup.Show()
+	go func() {
+		variants, err := m.Variants(pkg, version)
+		fyne.Do(func() {
+			lookup.Hide()
+			if err != nil {
+				logger.Error("looking up apk", "package", pkg, "version", version, "err", err)
+				dialog.ShowConfirm("ApkMirror", err.Error()+"\n\nOpen the search in the browser?", func(ok bool) {
+					if ok {
+						openBrowser(apkMirrorSearchURL(app, version))
+					}
+				}, w)
+				return
+			}
+
+			var options []string
+			for _, v := range variants {
+				options = append(options, v.String())
+			}
+			choice := widget.NewRadioGroup(options, nil)
+			if i := pickVariant(variants, apkMirrorPrefs()); i >= 0 {
+				choice.SetSelected(options[i])
+			}
+			scroll := container.NewVScroll(choice)
+			scroll.SetMinSize(fyne.NewSize(550, 250))
+			dialog.ShowCustomConfirm(app+" "+version, "Download", "Cancel", scroll, func(ok bool) {
+				if !ok || choice.Selected == "" {
+					return
+				}
+				var v ApkVariant
+				for i, option := range options {
+					if option == choice.Selected {
+						v = variants[i]
+					}
+				}
+				downloadVariant(w, m, pkg, version, v, onDownloaded)
+			}, w)
+		})
+	}()
+}
+
+func downloadVariant(w fyne.Window, m *ApkMirror, pkg, version string, v ApkVariant, onDownloaded func(apk string)) {
+	bar := widget.NewProgressBar()
+	status := widget.NewLabel("Downloading " + v.String())
+	progress := dialog.NewCustomWithoutButtons("ApkMirror", container.NewVBox(status, bar), w)
+	progress.Resize(fyne.NewSize(450, 150))
+	progress.Show()
+	go func() {
+		var shown int64
+		apk, err := m.Download(pkg, version, v, func(done, total int64) {
+			// Refreshing on every write would flood the GUI.
+			if done-shown < 256<<10 && done != total {
+				return
+			}
+			shown = done
+			fyne.Do(func() {
+				if total > 0 {
+					bar.SetValue(float64(done) / float64(total))
+				}
+				status.SetText(fmt.Sprintf("Downloading %s\n%.1f MB", v.String(), float64(done)/(1<<20)))
+			})
+		})
+		fyne.Do(func() {
+			progress.Hide()
+			if err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
+			onDownloaded(apk)
+		})
+	}()
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeApkMirror serves the saved ApkMirror pages in testdata/apkmirror and
+// records the requests it gets.
+type fakeApkMirror struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+// apkMirrorPages are the fixture of each page path. The searches are told
+// apart by their query.
+var apkMirrorPages = map[string]string{
+	"/apk/google-inc/youtube/youtube-19-16-39-release/":                                                          "release.html",
+	"/apk/google-inc/youtube/youtube-19-09-37-beta-release/":                                                     "release-single.html",
+	"/apk/google-inc/youtube/youtube-19-16-39-release/youtube-19-16-39-android-apk-download/":                    "variant.html",
+	"/apk/google-inc/youtube/youtube-19-16-39-release/youtube-19-16-39-android-apk-download/download/":           "download.html",
+	"/apk/google-inc/youtube/youtube-19-09-37-beta-release/youtube-19-09-37-beta-android-apk-download/download/": "download-fallback.html",
+}
+
+func newFakeApkMirror(t *testing.T) *fakeApkMirror {
+	t.Helper()
+	f := &fakeApkMirror{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.requests = append(f.requests, r)
+		f.mu.Unlock()
+
+		page, ok := apkMirrorPages[r.URL.Path]
+		if r.URL.Path == "/" {
+			switch r.URL.Query().Get("s") {
+			case "com.google.android.youtube":
+				page, ok = "search-app.html", true
+			case "com.google.android.youtube 19.09.37":
+				page, ok = "search-release.html", true
+			default:
+				page, ok = "search-empty.html", true
+			}
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join("testdata", "apkmirror", page))
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeApkMirror) paths() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var paths []string
+	for _, r := range f.requests {
+		paths = append(paths, r.URL.Path)
+	}
+	return paths
+}
+
+func (f *fakeApkMirror) mirror(t *testing.T) *ApkMirror {
+	t.Helper()
+	m, err := newApkMirror(f.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestApkMirrorAppPath(t *testing.T) {
+	site := newFakeApkMirror(t)
+	m := site.mirror(t)
+
+	// The first result is a release of another app, the second one the app
+	// page, linked with the address of the real site.
+	path, err := m.appPath("com.google.android.youtube")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/apk/google-inc/youtube/" {
+		t.Errorf("appPath = %q, want /apk/google-inc/youtube/", path)
+	}
+	if _, err := m.appPath("com.google.android.youtube"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(site.paths()); n != 1 {
+		t.Errorf("got %d requests, want the path to be searched once", n)
+	}
+
+	if _, err := m.appPath("com.example.missing"); err == nil || !strings.Contains(err.Error(), "not found on ApkMirror") {
+		t.Errorf("appPath of a missing app: err = %v", err)
+	}
+}
+
+func TestApkMirrorReleasePage(t *testing.T) {
+	site := newFakeApkMirror(t)
+	m := site.mirror(t)
+
+	doc, err := m.releasePage("com.google.android.youtube", "19.16.39")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/apk/google-inc/youtube/youtube-19-16-39-release/"; doc.Url.Path != want {
+		t.Errorf("release page = %s, want %s", doc.Url.Path, want)
+	}
+
+	// Not at the usual address, so found through the search, skipping the
+	// release of another app with the same version.
+	doc, err = m.releasePage("com.google.android.youtube", "19.09.37")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/apk/google-inc/youtube/youtube-19-09-37-beta-release/"; doc.Url.Path != want {
+		t.Errorf("release page = %s, want %s", doc.Url.Path, want)
+	}
+
+	if _, err := m.releasePage("com.google.android.youtube", "1.0.0"); err == nil || !strings.Contains(err.Error(), "version 1.0.0") {
+		t.Errorf("releasePage of a missing version: err = %v", err)
+	}
+}
+
+func TestParseVariants(t *testing.T) {
+	site := newFakeApkMirror(t)
+	doc, err := site.mirror(t).page("/apk/google-inc/youtube/youtube-19-16-39-release/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := site.URL + "/apk/google-inc/youtube/youtube-19-16-39-release/"
+	want := []ApkVariant{
+		{Name: "19.16.39", Arch: "arm64-v8a", MinAndroid: "Android 8.0+", DPI: "nodpi", URL: release + "youtube-19-16-39-android-apk-download/"},
+		{Name: "19.16.39", Bundle: true, Arch: "arm64-v8a + armeabi-v7a + x86 + x86_64", MinAndroid: "Android 8.0+", DPI: "120-640dpi", URL: release + "youtube-19-16-39-2-android-apk-download/"},
+		{Name: "19.16.39", Arch: "universal", MinAndroid: "Android 10+", DPI: "nodpi", URL: release + "youtube-19-16-39-3-android-apk-download/"},
+		{Name: "19.16.39", Arch: "x86_64", MinAndroid: "Android 8.0+", DPI: "nodpi", URL: release + "youtube-19-16-39-4-android-apk-download/"},
+	}
+	if got := parseVariants(doc); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseVariants =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestApkMirrorVariantsSingle(t *testing.T) {
+	site := newFakeApkMirror(t)
+
+	// Without a variants table, the release page is the only variant.
+	variants, err := site.mirror(t).Variants("com.google.android.youtube", "19.09.37")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ApkVariant{{Name: "19.09.37", URL: site.URL + "/apk/google-inc/youtube/youtube-19-09-37-beta-release/"}}
+	if !reflect.DeepEqual(variants, want) {
+		t.Errorf("Variants = %+v, want %+v", variants, want)
+	}
+}
+
+func TestApkMirrorFileURL(t *testing.T) {
+	site := newFakeApkMirror(t)
+	m := site.mirror(t)
+
+	variant := site.URL + "/apk/google-inc/youtube/youtube-19-16-39-release/youtube-19-16-39-android-apk-download/"
+	file, referer, err := m.fileURL(ApkVariant{URL: variant})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := site.URL + "/wp-content/themes/APKMirror/download.php?id=6871234&key=0f3c9a1b&forcebaseapk=true"; file != want {
+		t.Errorf("file = %s, want %s", file, want)
+	}
+	download := variant + "download/?key=8b7f2c&forcebaseapk=true"
+	if referer != download {
+		t.Errorf("referer = %s, want %s", referer, download)
+	}
+	site.mu.Lock()
+	last := site.requests[len(site.requests)-1]
+	site.mu.Unlock()
+	if got := last.Header.Get("Referer"); got != variant {
+		t.Errorf("download page requested with referer %q, want %q", got, variant)
+	}
+
+	// Download pages without the download-link ID link download.php.
+	file, _, err = m.fileURL(ApkVariant{URL: site.URL + "/apk/google-inc/youtube/youtube-19-09-37-beta-release/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := site.URL + "/wp-content/themes/APKMirror/download.php?id=6875555&key=77aa"; file != want {
+		t.Errorf("file = %s, want %s", file, want)
+	}
+
+	if _, _, err := m.fileURL(ApkVariant{URL: site.URL + "/apk/google-inc/youtube/youtube-19-16-39-release/"}); err == nil {
+		t.Error("fileURL of a page without a download button succeeded")
+	}
+}
+
+func TestPickVariant(t *testing.T) {
+	site := newFakeApkMirror(t)
+	doc, err := site.mirror(t).page("/apk/google-inc/youtube/youtube-19-16-39-release/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	variants := parseVariants(doc)
+
+	tests := []struct {
+		name  string
+		prefs VariantPrefs
+		want  int
+	}{
+		{"arm64 APK", VariantPrefs{Arch: "arm64-v8a", DPI: "nodpi"}, 0},
+		{"arm64 bundle", VariantPrefs{Bundle: true, Arch: "arm64-v8a", DPI: "nodpi"}, 1},
+		{"universal for armeabi-v7a APKs", VariantPrefs{Arch: "armeabi-v7a", DPI: "nodpi"}, 2},
+		{"x86_64", VariantPrefs{Arch: "x86_64", DPI: "nodpi"}, 3},
+		{"bundle for an old device", VariantPrefs{Bundle: true, Arch: "armeabi-v7a", DPI: "nodpi", Android: 9}, 1},
+		{"too old for the universal APK", VariantPrefs{Arch: "armeabi-v7a", DPI: "nodpi", Android: 9}, 1},
+		{"none for mips", VariantPrefs{Arch: "mips", DPI: "nodpi", Android: 9}, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pickVariant(variants, tt.prefs); got != tt.want {
+				t.Errorf("pickVariant = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
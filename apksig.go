@@ -0,0 +1,573 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// IDs of the blocks of the APK Signing Block.
+const (
+	apkSigV2BlockID = 0x7109871a
+	apkSigV3BlockID = 0xf05368c0
+)
+
+const apkSigBlockMagic = "APK Sig Block 42"
+
+// SigningCert is a certificate an APK is signed with, and the schemes
+// (v1, v2, v3) that use it.
+type SigningCert struct {
+	SHA256  string            `json:"sha256"`
+	Subject string            `json:"subject"`
+	Schemes []string          `json:"schemes"`
+	Cert    *x509.Certificate `json:"-"`
+}
+
+// apkSigner is a signer of a v2 or v3 block.
+type apkSigner struct {
+	SignedData   []byte
+	Certificates [][]byte
+	Signatures   []apkSignature
+	PublicKey    []byte
+}
+
+type apkSignature struct {
+	Algorithm uint32
+	Signature []byte
+}
+
+// certDigest returns the SHA-256 of a DER certificate, as apksigner prints
+// it.
+func certDigest(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeCertDigest accepts digests with colons or spaces and in any case.
+func normalizeCertDigest(digest string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(digest))
+}
+
+// readSigningCerts returns the certificates of every signing scheme of the
+// APK at path.
+func readSigningCerts(path string) ([]SigningCert, error) {
+	byDigest := make(map[string]*SigningCert)
+	var order []string
+	add := func(scheme string, der []byte) {
+		digest := certDigest(der)
+		c, ok := byDigest[digest]
+		if !ok {
+			c = &SigningCert{SHA256: digest}
+			if cert, err := x509.ParseCertificate(der); err == nil {
+				c.Cert = cert
+				c.Subject = cert.Subject.String()
+			}
+			byDigest[digest] = c
+			order = append(order, digest)
+		}
+		for _, s := range c.Schemes {
+			if s == scheme {
+				return
+			}
+		}
+		c.Schemes = append(c.Schemes, scheme)
+	}
+
+	v1, err := readV1Certs(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, der := range v1 {
+		add("v1", der)
+	}
+	blocks, err := readSigningBlock(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, scheme := range []struct {
+		name string
+		id   uint32
+	}{{"v2", apkSigV2BlockID}, {"v3", apkSigV3BlockID}} {
+		value, ok := blocks[scheme.id]
+		if !ok {
+			continue
+		}
+		signers, err := parseApkSigners(value, scheme.id == apkSigV3BlockID)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s signature: %v", scheme.name, err)
+		}
+		for _, signer := range signers {
+			for _, der := range signer.Certificates {
+				add(scheme.name, der)
+			}
+		}
+	}
+
+	certs := make([]SigningCert, 0, len(order))
+	for _, digest := range order {
+		certs = append(certs, *byDigest[digest])
+	}
+	return certs, nil
+}
+
+// readV1Certs returns the certificates of the JAR signature files of the
+// APK, META-INF/*.RSA, *.DSA and *.EC.
+func readV1Certs(apk string) ([][]byte, error) {
+	r, err := zip.OpenReader(apk)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var certs [][]byte
+	for _, f := range r.File {
+		ext := strings.ToUpper(path.Ext(f.Name))
+		if path.Dir(f.Name) != "META-INF" || (ext != ".RSA" && ext != ".DSA" && ext != ".EC") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		found, err := pkcs7Certificates(data)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", f.Name, err)
+		}
+		certs = append(certs, found...)
+	}
+	return certs, nil
+}
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      asn1.RawValue
+}
+
+// pkcs7Certificates returns the DER certificates of a PKCS#7 SignedData.
+func pkcs7Certificates(data []byte) ([][]byte, error) {
+	var info pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	var signed pkcs7SignedData
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &signed); err != nil {
+		return nil, err
+	}
+	var certs [][]byte
+	rest := signed.Certificates.Bytes
+	for len(rest) > 0 {
+		var cert asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &cert); err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert.FullBytes)
+	}
+	return certs, nil
+}
+
+// findSigningBlock returns the offsets of the APK Signing Block and of the
+// central directory that follows it. start is -1 when the APK has no block.
+func findSigningBlock(f io.ReaderAt, size int64) (start, centralDir int64, err error) {
+	eocd, err := findEOCD(f, size)
+	if err != nil {
+		return 0, 0, err
+	}
+	var buf [4]byte
+	if _, err := f.ReadAt(buf[:], eocd+16); err != nil {
+		return 0, 0, err
+	}
+	centralDir = int64(binary.LittleEndian.Uint32(buf[:]))
+	if centralDir < 32 || centralDir > eocd {
+		return -1, centralDir, nil
+	}
+	footer := make([]byte, 24)
+	if _, err := f.ReadAt(footer, centralDir-24); err != nil {
+		return 0, 0, err
+	}
+	if string(footer[8:]) != apkSigBlockMagic {
+		return -1, centralDir, nil
+	}
+	blockSize := int64(binary.LittleEndian.Uint64(footer))
+	start = centralDir - blockSize - 8
+	if blockSize < 24 || start < 0 {
+		return 0, 0, fmt.Errorf("invalid APK Signing Block size %d", blockSize)
+	}
+	var header [8]byte
+	if _, err := f.ReadAt(header[:], start); err != nil {
+		return 0, 0, err
+	}
+	if int64(binary.LittleEndian.Uint64(header[:])) != blockSize {
+		return 0, 0, fmt.Errorf("APK Signing Block sizes do not match")
+	}
+	return start, centralDir, nil
+}
+
+// findEOCD returns the offset of the End of Central Directory record, which
+// is followed by a comment of up to 64 KiB.
+func findEOCD(f io.ReaderAt, size int64) (int64, error) {
+	const eocdSize = 22
+	if size < eocdSize {
+		return 0, fmt.Errorf("not a zip file")
+	}
+	from := size - eocdSize - 0xffff
+	if from < 0 {
+		from = 0
+	}
+	tail := make([]byte, size-from)
+	if _, err := f.ReadAt(tail, from); err != nil {
+		return 0, err
+	}
+	for i := len(tail) - eocdSize; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(tail[i:]) == 0x06054b50 &&
+			int(binary.LittleEndian.Uint16(tail[i+20:])) == len(tail)-i-eocdSize {
+			return from + int64(i), nil
+		}
+	}
+	return 0, fmt.Errorf("no end of central directory")
+}
+
+// readSigningBlock returns the values of the APK Signing Block of the APK
+// at path by ID, none when it is only v1 signed or not signed.
+func readSigningBlock(path string) (map[uint32][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	start, centralDir, err := findSigningBlock(f, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	if start < 0 {
+		return make(map[uint32][]byte), nil
+	}
+	return signingBlockPairs(f, start, centralDir)
+}
+
+// signingBlockPairs returns the values of the APK Signing Block at start by
+// ID.
+func signingBlockPairs(f io.ReaderAt, start, centralDir int64) (map[uint32][]byte, error) {
+	blocks := make(map[uint32][]byte)
+	pairs := make([]byte, centralDir-24-(start+8))
+	if _, err := f.ReadAt(pairs, start+8); err != nil {
+		return nil, err
+	}
+	for len(pairs) > 0 {
+		if len(pairs) < 12 {
+			return nil, fmt.Errorf("truncated APK Signing Block")
+		}
+		n := binary.LittleEndian.Uint64(pairs)
+		if n < 4 || n > uint64(len(pairs)-8) {
+			return nil, fmt.Errorf("invalid APK Signing Block entry size %d", n)
+		}
+		id := binary.LittleEndian.Uint32(pairs[8:])
+		blocks[id] = pairs[12 : 8+n]
+		pairs = pairs[8+n:]
+	}
+	return blocks, nil
+}
+
+// lengthPrefixed splits b into the value of its uint32 length prefix and
+// what follows it.
+func lengthPrefixed(b []byte) ([]byte, []byte, error) {
+	if len(b) < 4 {
+		return nil, nil, fmt.Errorf("truncated length prefix")
+	}
+	n := binary.LittleEndian.Uint32(b)
+	if uint64(n) > uint64(len(b)-4) {
+		return nil, nil, fmt.Errorf("length %d past the end", n)
+	}
+	return b[4 : 4+n], b[4+n:], nil
+}
+
+// lengthPrefixedList returns the values of a length prefixed sequence of
+// length prefixed values.
+func lengthPrefixedList(b []byte) ([][]byte, error) {
+	var items [][]byte
+	for len(b) > 0 {
+		item, rest, err := lengthPrefixed(b)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		b = rest
+	}
+	return items, nil
+}
+
+// parseApkSigners parses the signers of a v2 block, or of a v3 block which
+// has the SDK range of each signer after its signed data.
+func parseApkSigners(value []byte, v3 bool) ([]apkSigner, error) {
+	list, _, err := lengthPrefixed(value)
+	if err != nil {
+		return nil, err
+	}
+	items, err := lengthPrefixedList(list)
+	if err != nil {
+		return nil, err
+	}
+	var signers []apkSigner
+	for _, item := range items {
+		var signer apkSigner
+		if signer.SignedData, item, err = lengthPrefixed(item); err != nil {
+			return nil, err
+		}
+		if v3 {
+			if len(item) < 8 {
+				return nil, fmt.Errorf("truncated signer")
+			}
+			item = item[8:]
+		}
+		var signatures []byte
+		if signatures, item, err = lengthPrefixed(item); err != nil {
+			return nil, err
+		}
+		if signer.PublicKey, _, err = lengthPrefixed(item); err != nil {
+			return nil, err
+		}
+		sigs, err := lengthPrefixedList(signatures)
+		if err != nil {
+			return nil, err
+		}
+		for _, sig := range sigs {
+			if len(sig) < 4 {
+				return nil, fmt.Errorf("truncated signature")
+			}
+			data, _, err := lengthPrefixed(sig[4:])
+			if err != nil {
+				return nil, err
+			}
+			signer.Signatures = append(signer.Signatures, apkSignature{
+				Algorithm: binary.LittleEndian.Uint32(sig),
+				Signature: data,
+			})
+		}
+
+		// The signed data starts with the digests and the certificates.
+		_, rest, err := lengthPrefixed(signer.SignedData)
+		if err != nil {
+			return nil, err
+		}
+		certs, _, err := lengthPrefixed(rest)
+		if err != nil {
+			return nil, err
+		}
+		if signer.Certificates, err = lengthPrefixedList(certs); err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// CertCheck is the result of comparing the signer of an APK with the
+// certificates the registry knows for its package.
+type CertCheck struct {
+	Package string
+	Found   []SigningCert
+	// Known are the digests of the publisher's certificates, none when the
+	// registry has none for the package.
+	Known []string
+	// Invalid is why the v2 or v3 signature of the APK does not verify, if
+	// it doesn't. Its certificates can't be trusted then.
+	Invalid string
+}
+
+// Unknown reports whether there was nothing to compare against.
+func (c *CertCheck) Unknown() bool {
+	return len(c.Known) == 0
+}
+
+// Matches reports whether the signature of the APK verifies and every
+// certificate it is signed with, in any scheme, is a known one.
+func (c *CertCheck) Matches() bool {
+	if c.Invalid != "" || len(c.Found) == 0 {
+		return false
+	}
+	for _, cert := range c.Found {
+		known := false
+		for _, digest := range c.Known {
+			known = known || cert.SHA256 == digest
+		}
+		if !known {
+			return false
+		}
+	}
+	return true
+}
+
+// Mismatch reports whether the registry knows the publisher and the APK is
+// not signed by it.
+func (c *CertCheck) Mismatch() bool {
+	return !c.Unknown() && !c.Matches()
+}
+
+func (c *CertCheck) String() string {
+	var s strings.Builder
+	if len(c.Found) == 0 {
+		s.WriteString("The APK is not signed.\n")
+	}
+	if c.Invalid != "" {
+		fmt.Fprintf(&s, "The signature can't be trusted: %s.\n", c.Invalid)
+	}
+	for _, cert := range c.Found {
+		fmt.Fprintf(&s, "Signed (%s) by %s\nSHA-256 %s\n", strings.Join(cert.Schemes, ", "), orDefault(cert.Subject, "an unreadable certificate"), cert.SHA256)
+	}
+	if len(c.Known) > 0 {
+		s.WriteString("\nKnown publisher certificates:\n")
+		for _, known := range c.Known {
+			fmt.Fprintf(&s, "SHA-256 %s\n", known)
+		}
+	}
+	return s.String()
+}
+
+// checkSigningCert reads the signers of apk, verifies its v2 or v3
+// signature and reads the known certificates of pkg in the registry.
+func checkSigningCert(pkg, apk string) (*CertCheck, error) {
+	registry, err := loadRegistry()
+	if err != nil {
+		return nil, err
+	}
+	found, err := readSigningCerts(apk)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the signature of %s: %v", apk, err)
+	}
+	check := &CertCheck{Package: pkg, Found: found}
+	f, err := os.Open(apk)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// The certificates are only those of the publisher if the signature
+	// they come with verifies. v1 signatures aren't verified, so an APK
+	// without a v2 or v3 one never matches.
+	if err := verifyApkSignature(f, stat.Size()); err != nil {
+		check.Invalid = err.Error()
+	}
+	for _, digest := range registry.Apps[pkg].Certificates {
+		check.Known = append(check.Known, normalizeCertDigest(digest))
+	}
+	sort.Strings(check.Known)
+	return check, nil
+}
+
+// Values of the certificateCheck setting.
+const (
+	certCheckWarn  = "warn"
+	certCheckBlock = "block"
+	certCheckOff   = "off"
+)
+
+// certificateCheck is what happens when an input APK isn't signed by its
+// publisher: a warning (default), a refusal to patch it, or nothing.
+func certificateCheck() string {
+	return readSetting("certificateCheck", certCheckWarn)
+}
+
+// verifyInputCert checks the signer of the input APK of plan, failing in
+// block mode when it is not the publisher.
+func verifyInputCert(plan *PatchPlan) error {
+	mode := certificateCheck()
+	if mode == certCheckOff {
+		return nil
+	}
+	check, err := checkSigningCert(plan.Package, plan.InputAPK)
+	if err != nil {
+		logger.Warn("checking input certificate", "apk", plan.InputAPK, "err", err)
+		if mode == certCheckBlock {
+			return fmt.Errorf("the signature of %s could not be checked: %v", plan.InputAPK, err)
+		}
+		return nil
+	}
+	if !check.Mismatch() {
+		return nil
+	}
+	logger.Warn("input apk not signed by the publisher", "apk", plan.InputAPK, "package", plan.Package, "certs", check.Found)
+	if mode == certCheckBlock {
+		return fmt.Errorf("%s is not signed by the publisher of %s, it may have been tampered with:\n%s", plan.InputAPK, plan.Package, check)
+	}
+	return nil
+}
+
+// confirmInputCert calls proceed unless apk is not signed by the publisher
+// of pkg, in which case the user is warned first, or told that it is blocked.
+func confirmInputCert(w fyne.Window, pkg, apk string, proceed func()) {
+	mode := certificateCheck()
+	if mode == certCheckOff {
+		proceed()
+		return
+	}
+	check, err := checkSigningCert(pkg, apk)
+	if err != nil {
+		logger.Warn("checking input certificate", "apk", apk, "err", err)
+		if mode == certCheckBlock {
+			dialog.ShowError(fmt.Errorf("the signature of %s could not be checked, patching it is blocked by the certificateCheck setting: %v", filepath.Base(apk), err), w)
+			return
+		}
+		proceed()
+		return
+	}
+	if !check.Mismatch() {
+		proceed()
+		return
+	}
+
+	title := widget.NewRichText(&widget.TextSegment{
+		Text: "This APK is not signed by the publisher of " + pkg,
+		Style: widget.RichTextStyle{
+			ColorName: theme.ColorNameError,
+			SizeName:  theme.SizeNameSubHeadingText,
+			TextStyle: fyne.TextStyle{Bold: true},
+		},
+	})
+	details := widget.NewLabel("It may have been modified by the site it comes from. Patching it installs whatever it contains.\n\n" + check.String())
+	if mode == certCheckBlock {
+		blocked := widget.NewLabel("Patching it is blocked by the certificateCheck setting.")
+		dialog.ShowCustom("Signature check", "Close", container.NewVBox(title, details, blocked), w)
+		return
+	}
+	dialog.ShowCustomConfirm("Signature check", "Patch anyway", "Cancel", container.NewVBox(title, details), func(ok bool) {
+		if ok {
+			proceed()
+		}
+	}, w)
+}
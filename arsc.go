@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path"
+	"strings"
+	"unicode/utf16"
+)
+
+// Chunk types of resources.arsc.
+const (
+	arscTable   = 0x0002
+	arscPackage = 0x0200
+	arscType    = 0x0201
+)
+
+// Flags of ResTable_type and ResTable_entry.
+const (
+	arscTypeSparse   = 0x01
+	arscTypeOffset16 = 0x02
+	arscEntryComplex = 0x0001
+	arscEntryCompact = 0x0008
+)
+
+// Densities of resource configurations with a meaning of their own.
+const (
+	densityAny  = 0xfffe
+	densityNone = 0xffff
+)
+
+// ResourceTable is the decoded resources.arsc of an APK, as far as simple
+// values go. Styles and other complex resources are left out.
+type ResourceTable struct {
+	packages map[uint8]*resourcePackage
+}
+
+type resourcePackage struct {
+	name      string
+	typeNames []string
+	keyNames  []string
+	// entries are the values of each resource by its type and entry ID,
+	// one per configuration.
+	entries map[uint32][]ResourceValue
+	keys    map[uint32]string
+}
+
+// ResourceValue is the value of a resource in one configuration.
+type ResourceValue struct {
+	Language string
+	Density  uint16
+	SDK      uint16
+	Type     uint8
+	Data     uint32
+	// String is the value of string resources, file paths included.
+	String string
+}
+
+// parseResourceTable decodes a resources.arsc file.
+func parseResourceTable(data []byte) (*ResourceTable, error) {
+	if len(data) < 12 || binary.LittleEndian.Uint16(data) != arscTable {
+		return nil, fmt.Errorf("not a resource table")
+	}
+	table := &ResourceTable{packages: make(map[uint8]*resourcePackage)}
+	var pool []string
+	offset := int(binary.LittleEndian.Uint16(data[2:]))
+	for offset+8 <= len(data) {
+		chunkType := binary.LittleEndian.Uint16(data[offset:])
+		size := int(binary.LittleEndian.Uint32(data[offset+4:]))
+		if size < 8 || offset+size > len(data) {
+			return nil, fmt.Errorf("corrupt chunk at offset %d", offset)
+		}
+		chunk := data[offset : offset+size]
+		switch chunkType {
+		case axmlStringPool:
+			var err error
+			if pool, err = parseStringPool(chunk); err != nil {
+				return nil, err
+			}
+		case arscPackage:
+			id, pkg, err := parseResourcePackage(chunk, pool)
+			if err != nil {
+				return nil, err
+			}
+			table.packages[id] = pkg
+		}
+		offset += size
+	}
+	return table, nil
+}
+
+func parseResourcePackage(chunk []byte, pool []string) (uint8, *resourcePackage, error) {
+	headerSize := int(binary.LittleEndian.Uint16(chunk[2:]))
+	if headerSize < 284 || len(chunk) < headerSize {
+		return 0, nil, fmt.Errorf("corrupt resource package")
+	}
+	id := uint8(binary.LittleEndian.Uint32(chunk[8:]))
+	var name []uint16
+	for i := 12; i < 268; i += 2 {
+		c := binary.LittleEndian.Uint16(chunk[i:])
+		if c == 0 {
+			break
+		}
+		name = append(name, c)
+	}
+	pkg := &resourcePackage{
+		name:    string(utf16.Decode(name)),
+		entries: make(map[uint32][]ResourceValue),
+		keys:    make(map[uint32]string),
+	}
+	typeStrings := int(binary.LittleEndian.Uint32(chunk[268:]))
+	keyStrings := int(binary.LittleEndian.Uint32(chunk[276:]))
+
+	offset := headerSize
+	for offset+8 <= len(chunk) {
+		chunkType := binary.LittleEndian.Uint16(chunk[offset:])
+		size := int(binary.LittleEndian.Uint32(chunk[offset+4:]))
+		if size < 8 || offset+size > len(chunk) {
+			return 0, nil, fmt.Errorf("corrupt chunk at offset %d of package %s", offset, pkg.name)
+		}
+		sub := chunk[offset : offset+size]
+		var err error
+		switch {
+		case chunkType == axmlStringPool && offset == typeStrings:
+			pkg.typeNames, err = parseStringPool(sub)
+		case chunkType == axmlStringPool && offset == keyStrings:
+			pkg.keyNames, err = parseStringPool(sub)
+		case chunkType == arscType:
+			err = pkg.parseType(sub, pool)
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		offset += size
+	}
+	return id, pkg, nil
+}
+
+// parseType reads the entries of a ResTable_type chunk, the values of the
+// resources of a type in one configuration.
+func (pkg *resourcePackage) parseType(chunk []byte, pool []string) error {
+	headerSize := int(binary.LittleEndian.Uint16(chunk[2:]))
+	if headerSize < 24 || len(chunk) < headerSize {
+		return fmt.Errorf("corrupt resource type")
+	}
+	typeID := uint32(chunk[8])
+	flags := chunk[9]
+	count := int(binary.LittleEndian.Uint32(chunk[12:]))
+	entriesStart := int(binary.LittleEndian.Uint32(chunk[16:]))
+
+	var config ResourceValue
+	if c := chunk[20:headerSize]; len(c) >= 28 {
+		if c[8] != 0 {
+			config.Language = string(c[8:10])
+		}
+		config.Density = binary.LittleEndian.Uint16(c[14:])
+		config.SDK = binary.LittleEndian.Uint16(c[24:])
+	}
+
+	index := chunk[headerSize:]
+	entry := func(i int) (int, int, bool) {
+		switch {
+		case flags&arscTypeSparse != 0:
+			if 4*i+4 > len(index) {
+				return 0, 0, false
+			}
+			return int(binary.LittleEndian.Uint16(index[4*i:])), int(binary.LittleEndian.Uint16(index[4*i+2:])) * 4, true
+		case flags&arscTypeOffset16 != 0:
+			if 2*i+2 > len(index) {
+				return 0, 0, false
+			}
+			off := binary.LittleEndian.Uint16(index[2*i:])
+			return i, int(off) * 4, off != 0xffff
+		default:
+			if 4*i+4 > len(index) {
+				return 0, 0, false
+			}
+			off := binary.LittleEndian.Uint32(index[4*i:])
+			return i, int(off), off != 0xffffffff
+		}
+	}
+
+	for i := 0; i < count; i++ {
+		entryID, off, ok := entry(i)
+		if !ok {
+			continue
+		}
+		e := entriesStart + off
+		if e+8 > len(chunk) {
+			return fmt.Errorf("corrupt resource entry")
+		}
+		entrySize := int(binary.LittleEndian.Uint16(chunk[e:]))
+		entryFlags := binary.LittleEndian.Uint16(chunk[e+2:])
+		value := config
+		var key uint32
+		switch {
+		case entryFlags&arscEntryCompact != 0:
+			key = uint32(entrySize)
+			value.Type = uint8(entryFlags >> 8)
+			value.Data = binary.LittleEndian.Uint32(chunk[e+4:])
+		case entryFlags&arscEntryComplex != 0:
+			continue
+		default:
+			key = binary.LittleEndian.Uint32(chunk[e+4:])
+			v := e + entrySize
+			if v+8 > len(chunk) {
+				return fmt.Errorf("corrupt resource value")
+			}
+			value.Type = chunk[v+3]
+			value.Data = binary.LittleEndian.Uint32(chunk[v+4:])
+		}
+		if value.Type == axmlTypeString && int(value.Data) < len(pool) {
+			value.String = pool[value.Data]
+		}
+		ref := typeID<<16 | uint32(entryID)
+		pkg.entries[ref] = append(pkg.entries[ref], value)
+		if int(key) < len(pkg.keyNames) {
+			pkg.keys[ref] = pkg.keyNames[key]
+		}
+	}
+	return nil
+}
+
+// Values returns the values of the resource id in every configuration.
+func (t *ResourceTable) Values(id uint32) []ResourceValue {
+	pkg := t.packages[uint8(id>>24)]
+	if pkg == nil {
+		return nil
+	}
+	return pkg.entries[id&0xffffff]
+}
+
+// Name returns the name of the resource id as type/name, or its ID.
+func (t *ResourceTable) Name(id uint32) string {
+	pkg := t.packages[uint8(id>>24)]
+	if pkg != nil {
+		typeIndex := int(id>>16&0xff) - 1
+		if key, ok := pkg.keys[id&0xffffff]; ok && typeIndex >= 0 && typeIndex < len(pkg.typeNames) {
+			return pkg.typeNames[typeIndex] + "/" + key
+		}
+	}
+	return fmt.Sprintf("0x%08x", id)
+}
+
+// Text returns the value of the string resource id in the default
+// configuration, following references.
+func (t *ResourceTable) Text(id uint32) string {
+	for depth := 0; depth < 8; depth++ {
+		values := t.Values(id)
+		if len(values) == 0 {
+			return ""
+		}
+		value := values[0]
+		for _, v := range values {
+			if v.Language == "" {
+				value = v
+				break
+			}
+		}
+		if value.Type != axmlTypeReference {
+			return value.String
+		}
+		id = value.Data
+	}
+	return ""
+}
+
+// Files returns the file paths of the resource id, such as the drawables
+// of an icon per density, following references. Each resource is visited
+// once, so reference cycles end.
+func (t *ResourceTable) Files(id uint32) []ResourceValue {
+	return t.files(id, make(map[uint32]bool))
+}
+
+func (t *ResourceTable) files(id uint32, visited map[uint32]bool) []ResourceValue {
+	if visited[id] {
+		return nil
+	}
+	visited[id] = true
+	var files []ResourceValue
+	for _, v := range t.Values(id) {
+		switch {
+		case v.Type == axmlTypeReference:
+			files = append(files, t.files(v.Data, visited)...)
+		case v.String != "" && strings.HasPrefix(v.String, "res/"):
+			files = append(files, v)
+		}
+	}
+	return files
+}
+
+// bestImage returns the bitmap among files for the highest density, or ""
+// when there are only XML drawables.
+func bestImage(files []ResourceValue) string {
+	var best ResourceValue
+	for _, f := range files {
+		switch strings.ToLower(path.Ext(f.String)) {
+		case ".png", ".webp", ".jpg", ".jpeg":
+		default:
+			continue
+		}
+		density := f.Density
+		if density == densityAny || density == densityNone {
+			density = 0
+		}
+		bestDensity := best.Density
+		if bestDensity == densityAny || bestDensity == densityNone {
+			bestDensity = 0
+		}
+		if best.String == "" || density > bestDensity {
+			best = f
+		}
+	}
+	return best.String
+}
+
+// Defaults returns the value of every simple resource in the default
+// configuration by name, references as @type/name.
+func (t *ResourceTable) Defaults() map[string]string {
+	defaults := make(map[string]string)
+	for id, pkg := range t.packages {
+		for ref, values := range pkg.entries {
+			value := values[0]
+			for _, v := range values {
+				if v.Language == "" && (v.Density == 0 || value.Language != "") {
+					value = v
+				}
+			}
+			full := uint32(id)<<24 | ref
+			if value.Type == axmlTypeReference {
+				defaults[t.Name(full)] = "@" + t.Name(value.Data)
+			} else {
+				defaults[t.Name(full)] = formatAXMLValue(value.Type, value.Data, "", value.String)
+			}
+		}
+	}
+	return defaults
+}
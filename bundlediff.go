@@ -0,0 +1,447 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// bundlePatchesPath is where the patch list of bundle is kept once listed,
+// next to it, so that old bundles can be compared without the CLI.
+func bundlePatchesPath(bundle string) string {
+	return strings.TrimSuffix(bundle, ".rvp") + ".patches.json"
+}
+
+// loadBundlePatches returns the patches of bundle with their options and
+// compatible versions.
+func loadBundlePatches(bundle string) ([]PatchInfo, error) {
+	data, err := loadBundleList(bundle, bundlePatchesPath(bundle), "patches", "patches.json")
+	if err != nil {
+		return nil, err
+	}
+	var list []PatchInfo
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("error unmarshalling patches of %s: %v", bundle, err)
+	}
+	return list, nil
+}
+
+// bundleOptionsPath is where the default options of bundle are kept once
+// listed.
+func bundleOptionsPath(bundle string) string {
+	return strings.TrimSuffix(bundle, ".rvp") + ".options.json"
+}
+
+// loadBundleOptions returns the default values of the options of bundle.
+func loadBundleOptions(bundle string) ([]PatchOptionsJSON, error) {
+	data, err := loadBundleList(bundle, bundleOptionsPath(bundle), "options", "options.json")
+	if err != nil {
+		return nil, err
+	}
+	var options []PatchOptionsJSON
+	if err := json.Unmarshal(data, &options); err != nil {
+		return nil, fmt.Errorf("error unmarshalling options of %s: %v", bundle, err)
+	}
+	return options, nil
+}
+
+// loadBundleList reads the list kept at path, running the CLI command that
+// writes it as file when it's missing.
+func loadBundleList(bundle, path, command, file string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		data, err = listBundle(bundle, command, file)
+		if err == nil {
+			if err := os.WriteFile(path, data, 0666); err != nil {
+				logger.Warn("saving bundle list", "path", path, "err", err)
+			}
+		}
+	}
+	return data, err
+}
+
+// listBundle runs the CLI command for bundle in a folder of its own, so
+// that the patches.json and options.json of the GUI are left alone, and
+// returns the file it writes.
+func listBundle(bundle, command, file string) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "gorevancify-"+command+"-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	cli, err := filepath.Abs(cliSource)
+	if err != nil {
+		return nil, err
+	}
+	abs, err := filepath.Abs(bundle)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("java", "-jar", cli, command, abs)
+	cmd.Dir = dir
+	if err := executePatching(cmd); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s of %s: %v", command, bundle, err)
+	}
+	return data, nil
+}
+
+// BundleDiff is what changed in the patches of a source between two of its
+// bundles.
+type BundleDiff struct {
+	Source   string          `json:"source"`
+	Old      string          `json:"old"`
+	New      string          `json:"new"`
+	Added    []string        `json:"added,omitempty"`
+	Removed  []string        `json:"removed,omitempty"`
+	Changed  []PatchChange   `json:"changed,omitempty"`
+	Versions []VersionChange `json:"versions,omitempty"`
+}
+
+// PatchChange is a patch that is in both bundles but differs.
+type PatchChange struct {
+	Name           string          `json:"name"`
+	OldDescription string          `json:"oldDescription,omitempty"`
+	NewDescription string          `json:"newDescription,omitempty"`
+	AddedOptions   []string        `json:"addedOptions,omitempty"`
+	RemovedOptions []string        `json:"removedOptions,omitempty"`
+	Defaults       []DefaultChange `json:"defaults,omitempty"`
+}
+
+type DefaultChange struct {
+	Key string `json:"key"`
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// VersionChange lists the versions of a package that patches started or
+// stopped supporting. Any means that some patch supports every version.
+type VersionChange struct {
+	Package string   `json:"package"`
+	App     string   `json:"app,omitempty"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	OldAny  bool     `json:"oldAny,omitempty"`
+	NewAny  bool     `json:"newAny,omitempty"`
+}
+
+// Empty reports whether nothing changed.
+func (d *BundleDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0 && len(d.Versions) == 0
+}
+
+// diffBundles compares the patches of two bundles of source.
+func diffBundles(source, oldBundle, newBundle string) (*BundleDiff, error) {
+	oldPatches, err := loadBundlePatches(oldBundle)
+	if err != nil {
+		return nil, err
+	}
+	newPatches, err := loadBundlePatches(newBundle)
+	if err != nil {
+		return nil, err
+	}
+	diff := diffPatches(oldPatches, newPatches)
+	diff.Source, diff.Old, diff.New = source, filepath.Base(oldBundle), filepath.Base(newBundle)
+	return diff, nil
+}
+
+func diffPatches(oldPatches, newPatches []PatchInfo) *BundleDiff {
+	diff := &BundleDiff{}
+	oldByName := make(map[string]PatchInfo)
+	for _, patch := range oldPatches {
+		oldByName[patch.Name] = patch
+	}
+	newByName := make(map[string]PatchInfo)
+	for _, patch := range newPatches {
+		newByName[patch.Name] = patch
+	}
+
+	for _, patch := range newPatches {
+		old, ok := oldByName[patch.Name]
+		if !ok {
+			diff.Added = append(diff.Added, patch.Name)
+			continue
+		}
+		if change, ok := diffPatch(old, patch); ok {
+			diff.Changed = append(diff.Changed, change)
+		}
+	}
+	for _, patch := range oldPatches {
+		if _, ok := newByName[patch.Name]; !ok {
+			diff.Removed = append(diff.Removed, patch.Name)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].Name < diff.Changed[j].Name })
+
+	oldVersions, oldAny := packageVersions(oldPatches)
+	newVersions, newAny := packageVersions(newPatches)
+	packages := make(map[string]bool)
+	for pkg := range oldVersions {
+		packages[pkg] = true
+	}
+	for pkg := range newVersions {
+		packages[pkg] = true
+	}
+	for pkg := range packages {
+		change := VersionChange{
+			Package: pkg,
+			Added:   versionsMissingFrom(newVersions[pkg], oldVersions[pkg]),
+			Removed: versionsMissingFrom(oldVersions[pkg], newVersions[pkg]),
+		}
+		if oldAny[pkg] != newAny[pkg] {
+			change.OldAny, change.NewAny = oldAny[pkg], newAny[pkg]
+		}
+		if len(change.Added) == 0 && len(change.Removed) == 0 && change.OldAny == change.NewAny {
+			continue
+		}
+		if name, ok := dict[pkg]; ok {
+			change.App = name
+		}
+		diff.Versions = append(diff.Versions, change)
+	}
+	sort.Slice(diff.Versions, func(i, j int) bool { return diff.Versions[i].Package < diff.Versions[j].Package })
+	return diff
+}
+
+func diffPatch(before, after PatchInfo) (PatchChange, bool) {
+	change := PatchChange{Name: after.Name}
+	if before.Description != after.Description {
+		change.OldDescription, change.NewDescription = before.Description, after.Description
+	}
+	oldOptions := make(map[string]Options)
+	for _, option := range before.Options {
+		oldOptions[option.Key] = option
+	}
+	newKeys := make(map[string]bool)
+	for _, option := range after.Options {
+		newKeys[option.Key] = true
+		previous, ok := oldOptions[option.Key]
+		if !ok {
+			change.AddedOptions = append(change.AddedOptions, option.Key)
+			continue
+		}
+		if oldDefault, newDefault := formatDefault(previous.Default), formatDefault(option.Default); oldDefault != newDefault {
+			change.Defaults = append(change.Defaults, DefaultChange{Key: option.Key, Old: oldDefault, New: newDefault})
+		}
+	}
+	for _, option := range before.Options {
+		if !newKeys[option.Key] {
+			change.RemovedOptions = append(change.RemovedOptions, option.Key)
+		}
+	}
+	changed := change.OldDescription != change.NewDescription || len(change.AddedOptions) > 0 ||
+		len(change.RemovedOptions) > 0 || len(change.Defaults) > 0
+	return change, changed
+}
+
+func formatDefault(value any) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+// packageVersions returns the versions supported per package by any patch,
+// and the packages that some patch supports in every version.
+func packageVersions(list []PatchInfo) (map[string]map[string]bool, map[string]bool) {
+	versions := make(map[string]map[string]bool)
+	anyVersion := make(map[string]bool)
+	for _, patch := range list {
+		for _, compatible := range patch.CompatiblePackages {
+			if versions[compatible.Name] == nil {
+				versions[compatible.Name] = make(map[string]bool)
+			}
+			if compatible.Versions == nil {
+				anyVersion[compatible.Name] = true
+			}
+			for _, v := range compatible.Versions {
+				versions[compatible.Name][v] = true
+			}
+		}
+	}
+	return versions, anyVersion
+}
+
+// versionsMissingFrom returns the versions of a that aren't in b, newest first.
+func versionsMissingFrom(a, b map[string]bool) []string {
+	var missing []string
+	for v := range a {
+		if !b[v] {
+			missing = append(missing, v)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return compareVersions(missing[i], missing[j]) > 0 })
+	return missing
+}
+
+// Markdown formats the diff for the GUI and the CLI.
+func (d *BundleDiff) Markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "## %s: %s → %s\n\n", d.Source, d.Old, d.New)
+	if d.Empty() {
+		b.WriteString("No changes in patches, options or supported versions.\n")
+		return b.String()
+	}
+	list := func(title string, items []string) {
+		if len(items) == 0 {
+			return
+		}
+		fmt.Fprintf(&b, "### %s\n\n", title)
+		for _, item := range items {
+			fmt.Fprintf(&b, "- %s\n", item)
+		}
+		b.WriteString("\n")
+	}
+	list("Added patches", d.Added)
+	list("Removed patches", d.Removed)
+
+	if len(d.Changed) > 0 {
+		b.WriteString("### Changed patches\n\n")
+		for _, change := range d.Changed {
+			fmt.Fprintf(&b, "- **%s**\n", change.Name)
+			if change.OldDescription != change.NewDescription {
+				fmt.Fprintf(&b, "  - Description: %s\n", change.NewDescription)
+			}
+			if len(change.AddedOptions) > 0 {
+				fmt.Fprintf(&b, "  - New options: %s\n", strings.Join(change.AddedOptions, ", "))
+			}
+			if len(change.RemovedOptions) > 0 {
+				fmt.Fprintf(&b, "  - Removed options: %s\n", strings.Join(change.RemovedOptions, ", "))
+			}
+			for _, def := range change.Defaults {
+				fmt.Fprintf(&b, "  - Default of %s: `%s` → `%s`\n", def.Key, def.Old, def.New)
+			}
+		}
+		b.WriteString("\n")
+	}
+
+	if len(d.Versions) > 0 {
+		b.WriteString("### Supported versions\n\n")
+		for _, change := range d.Versions {
+			name := change.Package
+			if change.App != "" {
+				name = change.App + " (" + change.Package + ")"
+			}
+			fmt.Fprintf(&b, "- **%s**\n", name)
+			if len(change.Added) > 0 {
+				fmt.Fprintf(&b, "  - Added: %s\n", strings.Join(change.Added, ", "))
+			}
+			if len(change.Removed) > 0 {
+				fmt.Fprintf(&b, "  - Removed: %s\n", strings.Join(change.Removed, ", "))
+			}
+			if change.NewAny {
+				b.WriteString("  - Now some patches support any version\n")
+			} else if change.OldAny {
+				b.WriteString("  - No patch supports any version anymore\n")
+			}
+		}
+	}
+	return b.String()
+}
+
+// previousBundle returns the bundle of source downloaded before bundle, or
+// "" when it is the first one.
+func previousBundle(source, bundle string) string {
+	bundles, err := listPatchFiles(source)
+	if err != nil {
+		return ""
+	}
+	for i, b := range bundles {
+		if filepath.Base(b) == filepath.Base(bundle) && i > 0 {
+			return bundles[i-1]
+		}
+	}
+	return ""
+}
+
+// showBundleDiff shows what changed from old to new in a dialog.
+func showBundleDiff(diff *BundleDiff, w fyne.Window) {
+	text := widget.NewRichTextFromMarkdown(diff.Markdown())
+	text.Wrapping = fyne.TextWrapWord
+	scroll := container.NewVScroll(text)
+	scroll.SetMinSize(fyne.NewSize(650, 450))
+	dialog.ShowCustom("Patch changes", "close", scroll, w)
+}
+
+// showUpdatedBundleDiffs compares every bundle just downloaded with the one
+// before it and shows the changes.
+func showUpdatedBundleDiffs(updated map[string]string, w fyne.Window) {
+	for source, bundle := range updated {
+		previous := previousBundle(source, bundle)
+		if previous == "" {
+			continue
+		}
+		diff, err := diffBundles(source, previous, bundle)
+		if err != nil {
+			logger.Error("comparing bundles", "old", previous, "new", bundle, "err", err)
+			continue
+		}
+		fyne.Do(func() { showBundleDiff(diff, w) })
+	}
+}
+
+// showCompareBundlesDialog compares any two downloaded bundles of a source.
+func showCompareBundlesDialog(w fyne.Window) {
+	oldSelect := widget.NewSelect(nil, nil)
+	newSelect := widget.NewSelect(nil, nil)
+	sourceSelect := widget.NewSelect(orgNames, func(source string) {
+		bundles, _ := listPatchFiles(source)
+		var names []string
+		for _, bundle := range bundles {
+			names = append(names, filepath.Base(bundle))
+		}
+		oldSelect.Options, newSelect.Options = names, names
+		oldSelect.ClearSelected()
+		newSelect.ClearSelected()
+		if len(names) > 1 {
+			oldSelect.SetSelected(names[len(names)-2])
+		}
+		if len(names) > 0 {
+			newSelect.SetSelected(names[len(names)-1])
+		}
+		oldSelect.Refresh()
+		newSelect.Refresh()
+	})
+
+	dialog.ShowForm("Compare bundles", "Compare", "Cancel", []*widget.FormItem{
+		widget.NewFormItem("Source", sourceSelect),
+		widget.NewFormItem("Old", oldSelect),
+		widget.NewFormItem("New", newSelect),
+	}, func(ok bool) {
+		if !ok || oldSelect.Selected == "" || newSelect.Selected == "" {
+			return
+		}
+		dir := filepath.Join("patches", sourceSelect.Selected)
+		oldBundle := filepath.Join(dir, oldSelect.Selected)
+		newBundle := filepath.Join(dir, newSelect.Selected)
+
+		progress := dialog.NewCustomWithoutButtons("Compare bundles", widget.NewProgressBarInfinite(), w)
+		progress.Show()
+		go func() {
+			diff, err := diffBundles(sourceSelect.Selected, oldBundle, newBundle)
+			fyne.Do(func() {
+				progress.Hide()
+				if err != nil {
+					dialog.ShowError(err, w)
+					return
+				}
+				showBundleDiff(diff, w)
+			})
+		}()
+	}, w)
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+)
+
+const usage = `Usage: gorevancify [command] [flags]
+
+Without a command the GUI is started.
+
+Commands:
+  plan         build a patch plan and print it as JSON
+  run          execute a saved patch plan
+  rebuild      recreate a patched APK from its build manifest
+  batch        patch every job of a jobs file
+  watch        rebuild profiles when a patch release or input APK appears
+  serve        run the local HTTP API
+  fetch        download the APK of an app version from the APK providers
+  library      list, add to or prune the library of original APKs
+  certs        print the signing certificates of an APK and check them
+  inspect      print the manifest, signature and sizes of an APK
+  changes      show what a patch run changed compared with the original APK
+  verify       check that an APK is complete, aligned and signed
+  diff         show what changed between two bundles of a source
+  self-update  check for a new GoRevancify release and install it
+`
+
+// runCommand runs GoRevancify without the GUI and returns the exit code.
+func runCommand(args []string) int {
+	headless = true
+	prepareDict()
+	orgNames = getOrgNames(loadSourcesFromFile("patches/sources.json"))
+
+	var err error
+	switch args[0] {
+	case "plan":
+		err = planCommand(args[1:])
+	case "run":
+		err = runCommandPlan(args[1:])
+	case "rebuild":
+		err = rebuildCommand(args[1:])
+	case "batch":
+		err = batchCommand(args[1:])
+	case "watch":
+		err = watchCommand(args[1:])
+	case "serve":
+		err = serveCommand(args[1:])
+	case "fetch":
+		err = fetchCommand(args[1:])
+	case "library":
+		err = libraryCommand(args[1:])
+	case "certs":
+		err = certsCommand(args[1:])
+	case "inspect":
+		err = inspectCommand(args[1:])
+	case "changes":
+		err = changesCommand(args[1:])
+	case "verify":
+		err = verifyCommand(args[1:])
+	case "diff":
+		err = diffCommand(args[1:])
+	case "self-update":
+		err = selfUpdateCommand(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", args[0], usage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+func planCommand(args []string) error {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	source := fs.String("source", "", "patch source, as listed in patches/sources.json")
+	app := fs.String("app", "", "app to patch, e.g. Youtube")
+	appVersion := fs.String("version", "", "version of the input APK")
+	apk := fs.String("apk", "", "input APK")
+	name := fs.String("name", "", "output name")
+	mode := fs.String("mode", string(patchMode), "patch mode")
+	preset := fs.String("preset", presetRecommended, "patch preset")
+	template := fs.String("template", outputTemplate(), "output file name template")
+	out := fs.String("o", "", "write the plan to this file instead of stdout")
+	fs.Parse(args)
+
+	plan, err := planFromFlags(*source, *app, *appVersion, *apk, *name, *mode, *preset, *template)
+	if err != nil {
+		return err
+	}
+
+	if *out != "" {
+		return savePlan(plan, *out)
+	}
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// planFromFlags builds a plan from the catalog of source, the way the GUI
+// would with app, the preset and the mode selected, without changing its
+// state or its files.
+func planFromFlags(source, app, appVersion, apk, name, mode, preset, template string) (*PatchPlan, error) {
+	catalog, err := loadCatalog(source)
+	if err != nil {
+		return nil, err
+	}
+	pkg := getPackageNamesByAppName(app)
+	supported := false
+	for _, name := range catalog.Apps {
+		supported = supported || name == app
+	}
+	if pkg == "nil" || !supported {
+		return nil, fmt.Errorf("unknown app %q", app)
+	}
+
+	recommended := catalog.recommended(pkg)
+	names, err := presetPatches(pkg, preset, recommended)
+	if err != nil {
+		return nil, err
+	}
+	// Like applySelection, patches the app doesn't have are ignored.
+	inPreset := make(map[string]bool)
+	for _, name := range names {
+		inPreset[name] = true
+	}
+	var selected []string
+	for _, name := range catalog.appPatches(pkg) {
+		if inPreset[name] {
+			selected = append(selected, name)
+		}
+	}
+	summary, err := resolvePatchSelection(PatchMode(mode), recommended, catalog.universal(), selected)
+	if err != nil {
+		return nil, err
+	}
+
+	return newPatchPlan(planSpec{
+		APK:        apk,
+		Source:     source,
+		Bundle:     catalog.Bundle,
+		App:        app,
+		Package:    pkg,
+		Version:    appVersion,
+		Profile:    preset,
+		OutputName: name,
+		Template:   template,
+		Patches:    summary,
+		Options:    catalog.options(),
+	})
+}
+
+func runCommandPlan(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	planPath := fs.String("plan", "", "patch plan to execute")
+	fs.Parse(args)
+
+	if *planPath == "" {
+		return fmt.Errorf("missing -plan")
+	}
+	plan, err := loadPlan(*planPath)
+	if err != nil {
+		return err
+	}
+	if err := runPlan(plan, nil); err != nil {
+		return err
+	}
+	fmt.Println("APK patched successfully:", plan.OutputPath)
+	return nil
+}
+
+func rebuildCommand(args []string) error {
+	fs := flag.NewFlagSet("rebuild", flag.ExitOnError)
+	manifest := fs.String("manifest", "", "build manifest of the APK to rebuild")
+	fs.Parse(args)
+
+	if *manifest == "" {
+		return fmt.Errorf("missing -manifest")
+	}
+	result, err := rebuildFromManifest(*manifest, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Println(result)
+	return nil
+}
+
+func batchCommand(args []string) error {
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	jobsPath := fs.String("jobs", "", "JSON file with the jobs to run")
+	parallel := fs.Int("parallel", queueParallelism(), "jobs to run at once")
+	jvms := fs.Int("jvms", maxJVMs(), "CLI processes to run at once")
+	fs.Parse(args)
+
+	if *jobsPath == "" {
+		return fmt.Errorf("missing -jobs")
+	}
+	specs, err := loadJobSpecs(*jobsPath)
+	if err != nil {
+		return err
+	}
+
+	jvmSlots.setMax(*jvms)
+	queue := newJobQueue(0)
+	for _, spec := range specs {
+		plan, err := planForJob(spec)
+		if err != nil {
+			return fmt.Errorf("%s: %v", spec.App, err)
+		}
+		if _, err := queue.Add(plan); err != nil {
+			return err
+		}
+	}
+	queue.SetParallelism(*parallel)
+	queue.Wait()
+
+	jobs, _ := queue.Jobs()
+	failed := 0
+	for _, job := range jobs {
+		fmt.Println(job.String())
+		if job.Status == jobFailed {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d jobs failed", failed, len(jobs))
+	}
+	return nil
+}
+
+func watchCommand(args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	configPath := fs.String("config", watchConfigPath, "watch config")
+	once := fs.Bool("once", false, "check once and exit")
+	fs.Parse(args)
+
+	cfg, err := loadWatchConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	jvmSlots.setMax(maxJVMs())
+	if *once {
+		if failed := watchOnce(cfg, loadWatchState(), true); failed > 0 {
+			return fmt.Errorf("%d builds failed", failed)
+		}
+		return nil
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	return watch(ctx, cfg)
+}
+
+func serveCommand(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", apiAddr(), "address to listen on, on localhost")
+	fs.Parse(args)
+
+	jvmSlots.setMax(maxJVMs())
+	jobQueue.SetParallelism(queueParallelism())
+	server, err := startAPI(*addr, jobQueue)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "API listening on http://%s, the token is apiToken in %s\n", *addr, settingsPath)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	<-ctx.Done()
+	return server.Stop()
+}
+
+func fetchCommand(args []string) error {
+	fs := flag.NewFlagSet("fetch", flag.ExitOnError)
+	app := fs.String("app", "", "app name or package name")
+	appVersion := fs.String("version", "", "app version")
+	fs.Parse(args)
+
+	if *app == "" || *appVersion == "" {
+		return fmt.Errorf("-app and -version are required")
+	}
+	pkg := getPackageNamesByAppName(*app)
+	if pkg == "nil" {
+		pkg = *app
+	}
+	apk, err := fetchAPK(pkg, *appVersion, func(provider string, done, total int64) {
+		if done == 0 {
+			fmt.Fprintf(os.Stderr, "Trying %s\n", provider)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(apk)
+	return nil
+}
+
+func libraryCommand(args []string) error {
+	fs := flag.NewFlagSet("library", flag.ExitOnError)
+	add := fs.String("add", "", "add this APK to the library")
+	source := fs.String("source", "file", "where the added APK comes from")
+	prune := fs.Bool("prune", false, "delete the APKs of versions no bundle supports anymore")
+	dryRun := fs.Bool("n", false, "with -prune, only list what would be deleted")
+	fs.Parse(args)
+
+	if *add != "" {
+		entry, err := addToLibrary(*add, *source)
+		if err != nil {
+			return err
+		}
+		fmt.Println(entry.Path)
+		return nil
+	}
+
+	library, err := loadLibrary()
+	if err != nil {
+		return err
+	}
+	entries := library.Entries
+	if *prune {
+		if entries, err = prunableEntries(library); err != nil {
+			return err
+		}
+	}
+	sortLibrary(entries)
+	for _, e := range entries {
+		if *prune && !*dryRun {
+			if err := removeFromLibrary(e); err != nil {
+				return err
+			}
+			fmt.Println("Deleted", e.Path)
+			continue
+		}
+		fmt.Printf("%s\t%s\n", e, e.Path)
+	}
+	return nil
+}
+
+func certsCommand(args []string) error {
+	fs := flag.NewFlagSet("certs", flag.ExitOnError)
+	apk := fs.String("apk", "", "APK to check")
+	fs.Parse(args)
+
+	if *apk == "" {
+		return fmt.Errorf("-apk is required")
+	}
+	info, err := readApkInfo(*apk)
+	if err != nil {
+		return err
+	}
+	check, err := checkSigningCert(info.Package, *apk)
+	if err != nil {
+		return err
+	}
+	fmt.Print(check)
+	switch {
+	case check.Unknown():
+		fmt.Printf("\nNo known certificates for %s in %s.\n", info.Package, registryPath)
+	case check.Mismatch():
+		return fmt.Errorf("%s is not signed by the publisher of %s", *apk, info.Package)
+	default:
+		fmt.Printf("\nSigned by the publisher of %s.\n", info.Package)
+	}
+	return nil
+}
+
+func inspectCommand(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	apk := fs.String("apk", "", "APK to inspect")
+	asJSON := fs.Bool("json", false, "print the inspection as JSON")
+	fs.Parse(args)
+
+	if *apk == "" {
+		return fmt.Errorf("-apk is required")
+	}
+	inspection, err := inspectAPK(*apk)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		data, _ := json.MarshalIndent(inspection, "", "  ")
+		fmt.Println(string(data))
+		return nil
+	}
+	fmt.Print(inspection.Text())
+	return nil
+}
+
+func changesCommand(args []string) error {
+	fs := flag.NewFlagSet("changes", flag.ExitOnError)
+	patched := fs.String("patched", "", "patched APK")
+	original := fs.String("original", "", "original APK, by default the input of the build manifest")
+	asJSON := fs.Bool("json", false, "print the changes as JSON")
+	fs.Parse(args)
+
+	if *patched == "" {
+		return fmt.Errorf("-patched is required")
+	}
+	if *original == "" {
+		m, err := loadBuildManifest(manifestPath(*patched))
+		if err != nil {
+			return fmt.Errorf("-original is required without a build manifest: %v", err)
+		}
+		if *original = buildInputAPK(m); *original == "" {
+			return fmt.Errorf("original APK %s of %s not found", m.Input.Path, *patched)
+		}
+	}
+	diff, err := diffAPKs(*original, *patched)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		data, _ := json.MarshalIndent(diff, "", "  ")
+		fmt.Println(string(data))
+		return nil
+	}
+	fmt.Print(diff.Markdown())
+	return nil
+}
+
+func verifyCommand(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	apk := fs.String("apk", "", "APK to verify")
+	pkg := fs.String("package", "", "expected package name")
+	name := fs.String("name", "", "expected app name")
+	fs.Parse(args)
+
+	if *apk == "" {
+		return fmt.Errorf("-apk is required")
+	}
+	if err := verifyAPK(*apk, *pkg, *name); err != nil {
+		return fmt.Errorf("%s: %v", *apk, err)
+	}
+	fmt.Println("APK verified:", *apk)
+	return nil
+}
+
+func diffCommand(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	source := fs.String("source", "", "patch source (org)")
+	oldBundle := fs.String("old", "", "old bundle, by default the one before the new one")
+	newBundle := fs.String("new", "", "new bundle, by default the latest")
+	asJSON := fs.Bool("json", false, "print the diff as JSON")
+	fs.Parse(args)
+
+	if *source == "" {
+		return fmt.Errorf("-source is required")
+	}
+	// Bundles can be given by file name.
+	for _, bundle := range []*string{oldBundle, newBundle} {
+		if _, err := os.Stat(*bundle); *bundle != "" && err != nil {
+			*bundle = filepath.Join("patches", *source, *bundle)
+		}
+	}
+	if *newBundle == "" {
+		latest, err := getLatestPatchFile(*source)
+		if err != nil {
+			return err
+		}
+		*newBundle = latest
+	}
+	if *oldBundle == "" {
+		*oldBundle = previousBundle(*source, *newBundle)
+		if *oldBundle == "" {
+			return fmt.Errorf("no bundle of %s before %s", *source, *newBundle)
+		}
+	}
+	diff, err := diffBundles(*source, *oldBundle, *newBundle)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		data, _ := json.MarshalIndent(diff, "", "  ")
+		fmt.Println(string(data))
+		return nil
+	}
+	fmt.Print(diff.Markdown())
+	return nil
+}
+
+func selfUpdateCommand(args []string) error {
+	fs := flag.NewFlagSet("self-update", flag.ExitOnError)
+	check := fs.Bool("check", false, "only print the changelog of a newer release")
+	fs.Parse(args)
+
+	release, newer, err := checkSelfUpdate()
+	if err != nil {
+		return err
+	}
+	if !newer {
+		fmt.Printf("GoRevancify %s is the latest version.\n", version)
+		return nil
+	}
+	fmt.Printf("GoRevancify %s is available, you have %s.\n\n%s\n\n", release.TagName, version, release.Body)
+	if *check {
+		return nil
+	}
+	asset, err := selfUpdateAsset(release, runtime.GOOS, runtime.GOARCH)
+	if err != nil {
+		return err
+	}
+	backup, err := applySelfUpdate(release, asset)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Updated to %s, the old version was kept as %s\n", release.TagName, backup)
+	return nil
+}
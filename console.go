@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// consoleMaxLines is how many lines a console keeps before dropping the
+// oldest ones. Run logs keep the full output.
+const consoleMaxLines = 5000
+
+// Console streams. Messages of the app itself use streamApp.
+const (
+	streamStdout = "stdout"
+	streamStderr = "stderr"
+	streamApp    = "app"
+)
+
+var ansiRegexp = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(\x07|\x1b\\)`)
+
+// ConsoleLine is one line of output with ANSI codes removed.
+type ConsoleLine struct {
+	Time     time.Time
+	Stream   string
+	Severity slog.Level
+	Text     string
+}
+
+func (l ConsoleLine) String() string {
+	return fmt.Sprintf("%s [%s] %-5s %s", l.Time.Format("15:04:05.000"), l.Stream, l.Severity, l.Text)
+}
+
+type consoleEntry struct {
+	line ConsoleLine
+	done chan struct{}
+}
+
+// Console is a bounded transcript of output. Writers hand lines to a single
+// goroutine that owns the ring buffer, so lines of one stream stay in order
+// and concurrent streams never overwrite each other.
+type Console struct {
+	entries chan consoleEntry
+
+	mu      sync.Mutex
+	lines   []ConsoleLine
+	start   int
+	count   int
+	total   int
+	version int
+}
+
+func newConsole(capacity int) *Console {
+	c := &Console{
+		entries: make(chan consoleEntry, 256),
+		lines:   make([]ConsoleLine, capacity),
+	}
+	go c.run()
+	return c
+}
+
+func (c *Console) run() {
+	for entry := range c.entries {
+		if entry.done != nil {
+			close(entry.done)
+			continue
+		}
+		c.mu.Lock()
+		if c.count < len(c.lines) {
+			c.lines[(c.start+c.count)%len(c.lines)] = entry.line
+			c.count++
+		} else {
+			c.lines[c.start] = entry.line
+			c.start = (c.start + 1) % len(c.lines)
+		}
+		c.total++
+		c.version++
+		c.mu.Unlock()
+	}
+}
+
+// Write adds text to the console, one line per line of text.
+func (c *Console) Write(stream, text string) {
+	now := time.Now()
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		line = strings.TrimRight(ansiRegexp.ReplaceAllString(line, ""), "\r")
+		c.entries <- consoleEntry{line: ConsoleLine{
+			Time:     now,
+			Stream:   stream,
+			Severity: lineSeverity(line),
+			Text:     line,
+		}}
+	}
+}
+
+// Flush waits until every line written so far is in the buffer.
+func (c *Console) Flush() {
+	done := make(chan struct{})
+	c.entries <- consoleEntry{done: done}
+	<-done
+}
+
+func (c *Console) Clear() {
+	c.Flush()
+	c.mu.Lock()
+	c.start, c.count = 0, 0
+	c.version++
+	c.mu.Unlock()
+}
+
+// Lines returns a copy of the buffered lines, oldest first, and the version
+// of the buffer they were read at.
+func (c *Console) Lines() ([]ConsoleLine, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lines := make([]ConsoleLine, c.count)
+	for i := range lines {
+		lines[i] = c.lines[(c.start+i)%len(c.lines)]
+	}
+	return lines, c.version
+}
+
+// Since returns the buffered lines written after the first n lines and the
+// number of lines written so far, to pass as n on the next call.
+func (c *Console) Since(n int) ([]ConsoleLine, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	first := c.total - c.count
+	if n < first {
+		n = first
+	}
+	var lines []ConsoleLine
+	for i := n - first; i < c.count; i++ {
+		lines = append(lines, c.lines[(c.start+i)%len(c.lines)])
+	}
+	return lines, c.total
+}
+
+func (c *Console) Transcript() string {
+	c.Flush()
+	lines, _ := c.Lines()
+	var s strings.Builder
+	for _, line := range lines {
+		s.WriteString(line.String())
+		s.WriteString("\n")
+	}
+	return s.String()
+}
+
+// lineSeverity reads the level of a line from the java.util.logging prefix
+// the CLI uses, falling back to info.
+func lineSeverity(text string) slog.Level {
+	prefix, _, _ := strings.Cut(strings.TrimSpace(text), ":")
+	switch strings.ToUpper(prefix) {
+	case "SEVERE", "ERROR", "EXCEPTION":
+		return slog.LevelError
+	case "WARNING", "WARN":
+		return slog.LevelWarn
+	case "FINE", "FINER", "FINEST", "DEBUG":
+		return slog.LevelDebug
+	}
+	if strings.HasPrefix(text, "\tat ") || strings.Contains(prefix, "Exception") {
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+func severityColor(level slog.Level) color.Color {
+	switch {
+	case level >= slog.LevelError:
+		return theme.Color(theme.ColorNameError)
+	case level >= slog.LevelWarn:
+		return theme.Color(theme.ColorNameWarning)
+	case level < slog.LevelInfo:
+		return theme.Color(theme.ColorNameDisabled)
+	}
+	return theme.Color(theme.ColorNameForeground)
+}
+
+// newConsoleView shows c colored by severity, polling c until done is
+// closed so that the list is refreshed at most once per tick however many
+// streams write to c.
+func newConsoleView(c *Console, w fyne.Window, done <-chan struct{}) fyne.CanvasObject {
+	var lines []ConsoleLine
+	var mu sync.Mutex
+
+	list := widget.NewList(
+		func() int {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(lines)
+		},
+		func() fyne.CanvasObject {
+			text := canvas.NewText("", theme.Color(theme.ColorNameForeground))
+			text.TextStyle = fyne.TextStyle{Monospace: true}
+			return text
+		},
+		func(id widget.ListItemID, item fyne.CanvasObject) {
+			mu.Lock()
+			line := lines[id]
+			mu.Unlock()
+			text := item.(*canvas.Text)
+			text.Text = line.Time.Format("15:04:05") + " " + line.Text
+			text.Color = severityColor(line.Severity)
+			text.Refresh()
+		},
+	)
+
+	go func() {
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+		seen := -1
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			snapshot, version := c.Lines()
+			if version == seen {
+				continue
+			}
+			seen = version
+			fyne.Do(func() {
+				mu.Lock()
+				lines = snapshot
+				mu.Unlock()
+				list.Refresh()
+				list.ScrollToBottom()
+			})
+		}
+	}()
+
+	copyButton := widget.NewButton("Copy", func() {
+		w.Clipboard().SetContent(c.Transcript())
+	})
+
+	saveButton := widget.NewButton("Save...", func() {
+		fd := dialog.NewFileSave(func(file fyne.URIWriteCloser, err error) {
+			if err != nil || file == nil {
+				return
+			}
+			defer file.Close()
+			if _, err := file.Write([]byte(c.Transcript())); err != nil {
+				dialog.ShowError(err, w)
+			}
+		}, w)
+		fd.SetFileName("console-" + time.Now().Format("2006-01-02T15-04-05") + ".txt")
+		fd.Resize(fyne.NewSize(800, 700))
+		fd.Show()
+	})
+
+	clearButton := widget.NewButton("Clear", c.Clear)
+
+	return container.NewBorder(
+		container.New(&horizontalCustomLayout{
+			widths:  []float32{260, 130, 130, 130},
+			heights: []float32{40, 40, 40, 40},
+			tabbing: []float32{5, 5, 5, 0},
+		}, widget.NewLabel("Console Log"), copyButton, saveButton, clearButton),
+		nil, nil, nil, list)
+}
+
+// consoleWriter returns where headless runs print lines of stream.
+func consoleWriter(stream string) *os.File {
+	if stream == streamStderr {
+		return os.Stderr
+	}
+	return os.Stdout
+}
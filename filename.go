@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+)
+
+// defaultOutputTemplate follows the historical "<name>-patched-<source>-<version>"
+// file names, except that the version is the one of the app rather than of
+// GoRevancify.
+const defaultOutputTemplate = "{name}-patched-{source}-{version}"
+
+// outputTemplateVars documents the variables outputTemplate can use.
+var outputTemplateVars = []string{"{name}", "{app}", "{package}", "{version}", "{source}", "{tag}", "{date}", "{profile}"}
+
+func outputTemplate() string {
+	return readSetting("outputTemplate", defaultOutputTemplate)
+}
+
+// renderOutputName expands the variables of template and returns a file
+// name, without extension, that is valid on every platform.
+func renderOutputName(template string, vars map[string]string) string {
+	var pairs []string
+	for key, value := range vars {
+		if value == "" {
+			value = "unknown"
+		}
+		pairs = append(pairs, "{"+key+"}", value)
+	}
+	name := sanitizeFileName(strings.NewReplacer(pairs...).Replace(template))
+	if name == "" {
+		return "patched"
+	}
+	return name
+}
+
+// sanitizeFileName replaces characters that are illegal in Windows, macOS
+// or Linux file names and trims what Windows does not allow at the end.
+func sanitizeFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 32 || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	return strings.TrimRight(strings.TrimSpace(name), ". ")
+}
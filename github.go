@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultGitHubAPI = "https://api.github.com"
+
+// GitHubRelease is the part of a GitHub release that is used.
+type GitHubRelease struct {
+	TagName     string        `json:"tag_name"`
+	Name        string        `json:"name"`
+	Body        string        `json:"body"`
+	HTMLURL     string        `json:"html_url"`
+	Prerelease  bool          `json:"prerelease"`
+	PublishedAt time.Time     `json:"published_at"`
+	Assets      []GitHubAsset `json:"assets"`
+}
+
+type GitHubAsset struct {
+	Name               string `json:"name"`
+	Size               int64  `json:"size"`
+	BrowserDownloadURL string `json:"browser_download_url"`
+}
+
+// Asset returns the asset called name, or nil.
+func (r *GitHubRelease) Asset(name string) *GitHubAsset {
+	for i := range r.Assets {
+		if r.Assets[i].Name == name {
+			return &r.Assets[i]
+		}
+	}
+	return nil
+}
+
+// githubAPI is the base URL of the GitHub API, which can be set to a mirror
+// or proxy of it with the githubApiUrl setting.
+func githubAPI() string {
+	return strings.TrimRight(readSetting("githubApiUrl", defaultGitHubAPI), "/")
+}
+
+// githubToken is sent to the API to raise its rate limit. It is read from
+// the githubToken setting, or from GITHUB_TOKEN.
+func githubToken() string {
+	if token := readSetting("githubToken", ""); token != "" {
+		return token
+	}
+	return os.Getenv("GITHUB_TOKEN")
+}
+
+// mirrorURL returns the URL to download a release asset from. When the
+// githubMirror setting is set, it is put in front of the GitHub URL as
+// download proxies expect.
+func mirrorURL(link string) string {
+	mirror := readSetting("githubMirror", "")
+	if mirror == "" {
+		return link
+	}
+	return strings.TrimRight(mirror, "/") + "/" + link
+}
+
+// githubGet sends a GET request to path of the GitHub API.
+func githubGet(path string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", githubAPI()+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("User-Agent", "GoRevancify/"+version)
+	if token := githubToken(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if (resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests) &&
+			resp.Header.Get("X-RateLimit-Remaining") == "0" {
+			return nil, fmt.Errorf("GitHub API rate limit exceeded, set githubToken in %s to raise it", settingsPath)
+		}
+		return nil, fmt.Errorf("error requesting %s: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+// getLatestRelease returns the latest release of org/repo, prereleases and
+// drafts excluded.
+func getLatestRelease(org, repo string) (*GitHubRelease, error) {
+	return getRelease(fmt.Sprintf("/repos/%s/%s/releases/latest", org, repo))
+}
+
+// getReleaseByTag returns the release of org/repo tagged tag.
+func getReleaseByTag(org, repo, tag string) (*GitHubRelease, error) {
+	return getRelease(fmt.Sprintf("/repos/%s/%s/releases/tags/%s", org, repo, url.PathEscape(tag)))
+}
+
+func getRelease(path string) (*GitHubRelease, error) {
+	resp, err := githubGet(path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var release GitHubRelease
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return nil, fmt.Errorf("error decoding release: %v", err)
+	}
+	return &release, nil
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// HistoryEntry is a previous build found in the output directory. Manifest
+// and ManifestPath are empty for APKs built before manifests existed.
+type HistoryEntry struct {
+	APK          string
+	ManifestPath string
+	Manifest     *BuildManifest
+	Size         int64
+	Date         time.Time
+}
+
+func (e HistoryEntry) String() string {
+	size := fmt.Sprintf("%.1f MB", float64(e.Size)/(1024*1024))
+	date := e.Date.Format("2006-01-02 15:04")
+	if e.Manifest == nil {
+		return fmt.Sprintf("%s  |  %s  |  %s", filepath.Base(e.APK), date, size)
+	}
+	m := e.Manifest
+	return fmt.Sprintf("%s %s  |  %s %s  |  %d patches  |  %s  |  %s",
+		m.Plan.App, m.Input.Version, m.Bundle.Source, m.Bundle.Tag, len(m.Patches), date, size)
+}
+
+// loadHistory lists the builds in dir, newest first.
+func loadHistory(dir string) ([]HistoryEntry, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var history []HistoryEntry
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || filepath.Ext(entry.Name()) != ".apk" {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		h := HistoryEntry{
+			APK:  filepath.Join(dir, entry.Name()),
+			Size: info.Size(),
+			Date: info.ModTime(),
+		}
+		if m, err := loadBuildManifest(manifestPath(h.APK)); err == nil {
+			h.Manifest = m
+			h.ManifestPath = manifestPath(h.APK)
+			h.Date = m.FinishedAt
+		}
+		history = append(history, h)
+	}
+
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].Date.After(history[j].Date)
+	})
+	return history, nil
+}
+
+func deleteHistoryEntry(e HistoryEntry) error {
+	if err := os.Remove(e.APK); err != nil {
+		return err
+	}
+	if e.ManifestPath != "" {
+		return os.Remove(e.ManifestPath)
+	}
+	return nil
+}
+
+// compareManifests describes what differs between two builds.
+func compareManifests(a, b *BuildManifest) string {
+	var s strings.Builder
+	line := func(what, x, y string) {
+		if x != y {
+			fmt.Fprintf(&s, "%s: %s -> %s\n", what, x, y)
+		}
+	}
+	line("App", a.Plan.App, b.Plan.App)
+	line("Input version", a.Input.Version, b.Input.Version)
+	line("Input SHA-256", a.Input.SHA256, b.Input.SHA256)
+	line("Patch source", a.Bundle.Source, b.Bundle.Source)
+	line("Patch bundle", a.Bundle.Tag, b.Bundle.Tag)
+	line("CLI", a.CLI.Version, b.CLI.Version)
+	line("Keystore", a.Signing.Keystore, b.Signing.Keystore)
+	line("Output size", fmt.Sprint(a.Output.Size), fmt.Sprint(b.Output.Size))
+
+	for _, patch := range missingFrom(b.Patches, a.Patches) {
+		fmt.Fprintf(&s, "Patch added: %s\n", patch)
+	}
+	for _, patch := range missingFrom(a.Patches, b.Patches) {
+		fmt.Fprintf(&s, "Patch removed: %s\n", patch)
+	}
+
+	optionsA, optionsB := flattenOptions(a.Options), flattenOptions(b.Options)
+	var keys []string
+	for key := range optionsA {
+		keys = append(keys, key)
+	}
+	for key := range optionsB {
+		if _, ok := optionsA[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		line("Option "+key, optionsA[key], optionsB[key])
+	}
+
+	if s.Len() == 0 {
+		return "The builds have the same inputs."
+	}
+	return s.String()
+}
+
+// flattenOptions maps "patch / key" to the JSON of its value.
+func flattenOptions(options []PatchOptionsJSON) map[string]string {
+	flat := make(map[string]string)
+	for _, patch := range options {
+		for _, option := range patch.Options {
+			value, _ := json.Marshal(option.Value)
+			flat[patch.PatchName+" / "+option.Key] = string(value)
+		}
+	}
+	return flat
+}
+
+// revealFile opens the file manager with path selected where the platform
+// supports it.
+func revealFile(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("explorer", "/select,", abs)
+	case "darwin":
+		cmd = exec.Command("open", "-R", abs)
+	case "linux":
+		cmd = exec.Command("xdg-open", filepath.Dir(abs))
+	default:
+		return fmt.Errorf("unsupported platform: %s", runtime.GOOS)
+	}
+	return cmd.Start()
+}
+
+func newHistoryTab(w fyne.Window) fyne.CanvasObject {
+	var history []HistoryEntry
+	selected := -1
+
+	dirLabel := widget.NewLabel("")
+	templateEntry := widget.NewEntry()
+	templateEntry.SetText(outputTemplate())
+	templateEntry.SetPlaceHolder(defaultOutputTemplate)
+	list := widget.NewList(
+		func() int {
+			return len(history)
+		},
+		func() fyne.CanvasObject {
+			return widget.NewLabel("")
+		},
+		func(id widget.ListItemID, item fyne.CanvasObject) {
+			item.(*widget.Label).SetText(history[id].String())
+		},
+	)
+	list.OnSelected = func(id widget.ListItemID) {
+		selected = id
+	}
+
+	refresh := func() {
+		dirLabel.SetText("Output directory: " + outputDir())
+		var err error
+		history, err = loadHistory(outputDir())
+		if err != nil && !os.IsNotExist(err) {
+			dialog.ShowError(err, w)
+		}
+		selected = -1
+		list.UnselectAll()
+		list.Refresh()
+	}
+
+	current := func() (HistoryEntry, bool) {
+		if selected < 0 || selected >= len(history) {
+			dialog.ShowInformation("Error", "No build selected", w)
+			return HistoryEntry{}, false
+		}
+		return history[selected], true
+	}
+
+	changeDirButton := widget.NewButton("Change...", func() {
+		fd := dialog.NewFolderOpen(func(dir fyne.ListableURI, err error) {
+			if err != nil || dir == nil {
+				return
+			}
+			if err := writeSetting("outputDir", dir.Path()); err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
+			refresh()
+		}, w)
+		fd.Resize(fyne.NewSize(800, 700))
+		fd.Show()
+	})
+
+	revealButton := widget.NewButton("Reveal", func() {
+		if e, ok := current(); ok {
+			if err := revealFile(e.APK); err != nil {
+				dialog.ShowError(err, w)
+			}
+		}
+	})
+
+	inspectButton := widget.NewButton("Inspect", func() {
+		if e, ok := current(); ok {
+			showApkInspector(w, e.APK)
+		}
+	})
+
+	installButton := widget.NewButton("Install...", func() {
+		if e, ok := current(); ok {
+			showInstallDialog(e.APK, e.Manifest, w)
+		}
+	})
+
+	deleteButton := widget.NewButton("Delete", func() {
+		e, ok := current()
+		if !ok {
+			return
+		}
+		dialog.ShowConfirm("Delete build", "Delete "+filepath.Base(e.APK)+"?", func(ok bool) {
+			if !ok {
+				return
+			}
+			if err := deleteHistoryEntry(e); err != nil {
+				dialog.ShowError(err, w)
+			}
+			refresh()
+		}, w)
+	})
+
+	rerunButton := widget.NewButton("Re-run", func() {
+		e, ok := current()
+		if !ok {
+			return
+		}
+		if e.Manifest == nil {
+			dialog.ShowInformation("Error", "This build has no manifest", w)
+			return
+		}
+		// The rebuild goes to a new file, the selected build is only compared
+		// with it.
+		dialog.ShowConfirm("Re-run build", "Rebuild "+filepath.Base(e.APK)+" from its manifest\nand compare it with this build?\n"+
+			"The build is kept, a rebuild that differs is saved next to it.", func(ok bool) {
+			if !ok {
+				return
+			}
+			go func() {
+				result, err := rebuildFromManifest(e.ManifestPath, console)
+				fyne.Do(func() {
+					if err != nil {
+						dialog.ShowError(err, w)
+						return
+					}
+					dialog.ShowInformation("Rebuild", result, w)
+					refresh()
+				})
+			}()
+		}, w)
+	})
+
+	compareButton := widget.NewButton("Compare...", func() {
+		e, ok := current()
+		if !ok {
+			return
+		}
+		// The original APK comes first, then the other builds.
+		var others []string
+		var manifests []*BuildManifest
+		original := ""
+		if e.Manifest != nil {
+			original = buildInputAPK(e.Manifest)
+		}
+		if original != "" {
+			others = append(others, "Original APK: "+filepath.Base(original))
+			manifests = append(manifests, nil)
+		}
+		for _, other := range history {
+			if other.Manifest != nil && other.APK != e.APK {
+				others = append(others, other.String())
+				manifests = append(manifests, other.Manifest)
+			}
+		}
+		if e.Manifest == nil || len(manifests) == 0 {
+			dialog.ShowInformation("Error", "Comparing needs a build with a manifest and its original APK or another build", w)
+			return
+		}
+		with := widget.NewSelect(others, nil)
+		dialog.ShowForm("Compare with", "Compare", "Cancel", []*widget.FormItem{
+			widget.NewFormItem("Build", with),
+		}, func(ok bool) {
+			if !ok || with.SelectedIndex() < 0 {
+				return
+			}
+			other := manifests[with.SelectedIndex()]
+			if other == nil {
+				showApkDiff(w, original, e.APK)
+				return
+			}
+			diff := container.NewVScroll(widget.NewLabel(compareManifests(other, e.Manifest)))
+			diff.SetMinSize(fyne.NewSize(600, 400))
+			dialog.ShowCustom("Comparison", "close", diff, w)
+		}, w)
+	})
+
+	saveTemplateButton := widget.NewButton("Save template", func() {
+		template := templateEntry.Text
+		if template == "" {
+			template = defaultOutputTemplate
+		}
+		if err := writeSetting("outputTemplate", template); err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		dialog.ShowInformation("Information", "Template saved", w)
+	})
+
+	refreshButton := widget.NewButton("Refresh", refresh)
+
+	refresh()
+
+	listScroller := container.NewVScroll(list)
+	listScroller.SetMinSize(fyne.NewSize(100, 450))
+
+	return container.NewVBox(
+		container.New(&horizontalCustomLayout{
+			widths:  []float32{640, 150},
+			heights: []float32{40, 40},
+			tabbing: []float32{5, 0},
+		}, dirLabel, changeDirButton),
+		container.New(&horizontalCustomLayout{
+			widths:  []float32{640, 150},
+			heights: []float32{40, 40},
+			tabbing: []float32{5, 0},
+		}, templateEntry, saveTemplateButton),
+		widget.NewLabel("File name variables: "+strings.Join(outputTemplateVars, " ")),
+		listScroller,
+		container.New(&horizontalCustomLayout{
+			widths:  []float32{110, 110, 110, 110, 110, 110, 110},
+			heights: []float32{50, 50, 50, 50, 50, 50, 50},
+			tabbing: []float32{5, 5, 5, 5, 5, 5, 0},
+		}, revealButton, inspectButton, installButton, deleteButton, rerunButton, compareButton, refreshButton),
+	)
+}
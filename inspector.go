@@ -0,0 +1,376 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	_ "golang.org/x/image/webp"
+)
+
+// ApkInspection is what GoRevancify can tell about an APK without
+// installing it.
+type ApkInspection struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	ApkInfo
+	Label string `json:"label"`
+	// Icon is the path of the launcher icon in the APK, the bitmap of the
+	// highest density.
+	Icon        string            `json:"icon,omitempty"`
+	ABIs        []string          `json:"abis,omitempty"`
+	Permissions []string          `json:"permissions,omitempty"`
+	Activities  []string          `json:"activities,omitempty"`
+	Providers   []ApkProviderInfo `json:"providers,omitempty"`
+	// Queries are the packages, intents and providers the app declares it
+	// looks for on Android 11 and later.
+	Queries      []string      `json:"queries,omitempty"`
+	Certificates []SigningCert `json:"certificates,omitempty"`
+	Sizes        []SizeGroup   `json:"sizes"`
+}
+
+// ApkProviderInfo is a content provider declared in a manifest.
+type ApkProviderInfo struct {
+	Name        string `json:"name"`
+	Authorities string `json:"authorities"`
+}
+
+// SizeGroup is the size of a kind of files of an APK.
+type SizeGroup struct {
+	Name         string `json:"name"`
+	Files        int    `json:"files"`
+	Compressed   int64  `json:"compressed"`
+	Uncompressed int64  `json:"uncompressed"`
+}
+
+// sizeGroupOf returns the group an APK entry is counted in.
+func sizeGroupOf(name string) string {
+	switch {
+	case path.Dir(name) == "." && strings.HasPrefix(name, "classes") && path.Ext(name) == ".dex":
+		return "Dex"
+	case name == "resources.arsc" || strings.HasPrefix(name, "res/"):
+		return "Resources"
+	case strings.HasPrefix(name, "lib/"):
+		return "Native libraries"
+	case strings.HasPrefix(name, "assets/"):
+		return "Assets"
+	case strings.HasPrefix(name, "META-INF/"):
+		return "Signature and metadata"
+	}
+	return "Other"
+}
+
+var sizeGroupOrder = []string{"Dex", "Resources", "Native libraries", "Assets", "Signature and metadata", "Other"}
+
+// apkSizes sums the entries of an APK by group.
+func apkSizes(files []*zip.File) []SizeGroup {
+	groups := make(map[string]*SizeGroup)
+	for _, f := range files {
+		name := sizeGroupOf(f.Name)
+		g, ok := groups[name]
+		if !ok {
+			g = &SizeGroup{Name: name}
+			groups[name] = g
+		}
+		g.Files++
+		g.Compressed += int64(f.CompressedSize64)
+		g.Uncompressed += int64(f.UncompressedSize64)
+	}
+	var sizes []SizeGroup
+	for _, name := range sizeGroupOrder {
+		if g, ok := groups[name]; ok {
+			sizes = append(sizes, *g)
+		}
+	}
+	return sizes
+}
+
+// readResourceTable returns the resource table of an APK, or nil when it
+// has none.
+func readResourceTable(r *zip.Reader) (*ResourceTable, error) {
+	data, err := readZipFile(r, "resources.arsc")
+	if err != nil || data == nil {
+		return nil, err
+	}
+	return parseResourceTable(data)
+}
+
+// readZipFile returns the content of name in r, or nil if it isn't there.
+func readZipFile(r *zip.Reader, name string) ([]byte, error) {
+	f, err := r.Open(name)
+	if err != nil {
+		return nil, nil
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// resolveLabel returns the text of a label attribute, looked up in table
+// when it is a reference.
+func resolveLabel(e *XMLElement, table *ResourceTable) string {
+	if ref := e.AttrRef("label"); ref != 0 {
+		if table != nil {
+			return table.Text(ref)
+		}
+		return ""
+	}
+	return e.Attr("label")
+}
+
+// resolveIcon returns the path of the bitmap of an icon attribute, taking
+// the foreground of adaptive icons.
+func resolveIcon(r *zip.Reader, e *XMLElement, table *ResourceTable) string {
+	ref := e.AttrRef("icon")
+	if ref == 0 || table == nil {
+		return ""
+	}
+	files := table.Files(ref)
+	if icon := bestImage(files); icon != "" {
+		return icon
+	}
+	for _, f := range files {
+		if path.Ext(f.String) != ".xml" {
+			continue
+		}
+		data, err := readZipFile(r, f.String)
+		if err != nil || data == nil {
+			continue
+		}
+		adaptive, err := parseAXML(data)
+		if err != nil || adaptive.Name != "adaptive-icon" {
+			continue
+		}
+		for _, foreground := range adaptive.Find("foreground") {
+			if icon := bestImage(table.Files(foreground.AttrRef("drawable"))); icon != "" {
+				return icon
+			}
+		}
+	}
+	return ""
+}
+
+// inspectAPK reads the manifest, resources, signature and entries of the
+// APK at apk.
+func inspectAPK(apk string) (*ApkInspection, error) {
+	info, err := readApkInfo(apk)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(apk)
+	if err != nil {
+		return nil, err
+	}
+	r, err := zip.OpenReader(apk)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	manifest, err := readApkManifest(apk)
+	if err != nil {
+		return nil, err
+	}
+	table, err := readResourceTable(&r.Reader)
+	if err != nil {
+		logger.Warn("reading resource table", "apk", apk, "err", err)
+	}
+
+	inspection := &ApkInspection{
+		Path:    apk,
+		Size:    stat.Size(),
+		ApkInfo: *info,
+		Sizes:   apkSizes(r.File),
+	}
+	for _, permission := range append(manifest.Find("uses-permission"), manifest.Find("uses-permission-sdk-23")...) {
+		inspection.Permissions = append(inspection.Permissions, permission.Attr("name"))
+	}
+	sort.Strings(inspection.Permissions)
+	for _, queries := range manifest.Find("queries") {
+		inspection.Queries = append(inspection.Queries, manifestQueries(queries)...)
+	}
+	for _, application := range manifest.Find("application") {
+		inspection.Label = resolveLabel(application, table)
+		inspection.Icon = resolveIcon(&r.Reader, application, table)
+		for _, activity := range append(application.Find("activity"), application.Find("activity-alias")...) {
+			inspection.Activities = append(inspection.Activities, activity.Attr("name"))
+		}
+		for _, provider := range application.Find("provider") {
+			inspection.Providers = append(inspection.Providers, ApkProviderInfo{
+				Name:        provider.Attr("name"),
+				Authorities: provider.Attr("authorities"),
+			})
+		}
+	}
+	if inspection.ABIs, err = apkABIs(apk); err != nil {
+		return nil, err
+	}
+	if inspection.Certificates, err = readSigningCerts(apk); err != nil {
+		logger.Warn("reading signature", "apk", apk, "err", err)
+	}
+	return inspection, nil
+}
+
+// manifestQueries formats the children of a queries element.
+func manifestQueries(queries *XMLElement) []string {
+	var list []string
+	for _, q := range queries.Children {
+		switch q.Name {
+		case "package":
+			list = append(list, "package "+q.Attr("name"))
+		case "provider":
+			list = append(list, "provider "+q.Attr("authorities"))
+		case "intent":
+			var parts []string
+			for _, child := range q.Children {
+				if value := orDefault(child.Attr("name"), child.Attr("scheme")+child.Attr("mimeType")); value != "" {
+					parts = append(parts, child.Name+"="+value)
+				}
+			}
+			list = append(list, "intent "+strings.Join(parts, " "))
+		}
+	}
+	return list
+}
+
+// readApkImage decodes the image name of an APK.
+func readApkImage(apk, name string) (image.Image, error) {
+	data, err := readZipEntry(apk, name)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %s: %v", name, err)
+	}
+	return img, nil
+}
+
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", size)
+}
+
+// listText shows items one per line, or none.
+func listText(items []string) string {
+	if len(items) == 0 {
+		return "None"
+	}
+	return strings.Join(items, "\n")
+}
+
+// Overview is the summary of the inspection shown first.
+func (i *ApkInspection) Overview() string {
+	var s strings.Builder
+	fmt.Fprintf(&s, "Package: %s\n", i.Package)
+	fmt.Fprintf(&s, "Version: %s (%d)\n", i.VersionName, i.VersionCode)
+	fmt.Fprintf(&s, "Min SDK: %d\nTarget SDK: %d\n", i.MinSDK, i.TargetSDK)
+	abis := "universal (no native code)"
+	if len(i.ABIs) > 0 {
+		abis = strings.Join(i.ABIs, ", ")
+	}
+	fmt.Fprintf(&s, "ABIs: %s\n", abis)
+	fmt.Fprintf(&s, "Size: %s\n", formatSize(i.Size))
+	fmt.Fprintf(&s, "Permissions: %d\nActivities: %d\nProviders: %d\nQueries: %d\n", len(i.Permissions), len(i.Activities), len(i.Providers), len(i.Queries))
+	fmt.Fprintf(&s, "File: %s", i.Path)
+	return s.String()
+}
+
+func (i *ApkInspection) componentsText() string {
+	var providers []string
+	for _, p := range i.Providers {
+		providers = append(providers, fmt.Sprintf("%s (%s)", p.Name, p.Authorities))
+	}
+	return fmt.Sprintf("Activities\n%s\n\nProviders\n%s\n\nQueries\n%s",
+		listText(i.Activities), listText(providers), listText(i.Queries))
+}
+
+func (i *ApkInspection) certificatesText() string {
+	if len(i.Certificates) == 0 {
+		return "Not signed"
+	}
+	var s strings.Builder
+	for _, cert := range i.Certificates {
+		fmt.Fprintf(&s, "%s\nSchemes: %s\nSHA-256: %s\n", orDefault(cert.Subject, "Unreadable certificate"), strings.Join(cert.Schemes, ", "), cert.SHA256)
+		if cert.Cert != nil {
+			fmt.Fprintf(&s, "Valid: %s to %s\n", cert.Cert.NotBefore.Format("2006-01-02"), cert.Cert.NotAfter.Format("2006-01-02"))
+		}
+		s.WriteString("\n")
+	}
+	return s.String()
+}
+
+func (i *ApkInspection) sizesText() string {
+	var s strings.Builder
+	for _, g := range i.Sizes {
+		fmt.Fprintf(&s, "%s: %s compressed, %s uncompressed, %d files\n", g.Name, formatSize(g.Compressed), formatSize(g.Uncompressed), g.Files)
+	}
+	return s.String()
+}
+
+// Text is the whole inspection as plain text.
+func (i *ApkInspection) Text() string {
+	return fmt.Sprintf("%s\n%s\n\nPermissions\n%s\n\n%s\n\nSigning\n%s\nSizes\n%s",
+		orDefault(i.Label, i.Package), i.Overview(), listText(i.Permissions), i.componentsText(), i.certificatesText(), i.sizesText())
+}
+
+// showApkInspector inspects apk in the background and shows what it found.
+func showApkInspector(w fyne.Window, apk string) {
+	progress := dialog.NewCustomWithoutButtons("Inspect APK", widget.NewProgressBarInfinite(), w)
+	progress.Show()
+	go func() {
+		inspection, err := inspectAPK(apk)
+		fyne.Do(func() {
+			progress.Hide()
+			if err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
+
+			title := widget.NewLabelWithStyle(orDefault(inspection.Label, inspection.Package), fyne.TextAlignLeading, fyne.TextStyle{Bold: true})
+			header := container.NewHBox(title)
+			if inspection.Icon != "" {
+				if img, err := readApkImage(apk, inspection.Icon); err == nil {
+					icon := canvas.NewImageFromImage(img)
+					icon.FillMode = canvas.ImageFillContain
+					icon.SetMinSize(fyne.NewSize(64, 64))
+					header = container.NewHBox(icon, title)
+				} else {
+					logger.Warn("reading icon", "apk", apk, "icon", inspection.Icon, "err", err)
+				}
+			}
+
+			page := func(text string) fyne.CanvasObject {
+				label := widget.NewLabel(text)
+				label.Wrapping = fyne.TextWrapBreak
+				return container.NewVScroll(label)
+			}
+			tabs := container.NewAppTabs(
+				container.NewTabItem("Overview", page(inspection.Overview())),
+				container.NewTabItem("Permissions", page(listText(inspection.Permissions))),
+				container.NewTabItem("Components", page(inspection.componentsText())),
+				container.NewTabItem("Signing", page(inspection.certificatesText())),
+				container.NewTabItem("Sizes", page(inspection.sizesText())),
+			)
+			d := dialog.NewCustom("Inspect APK", "Close", container.NewBorder(header, nil, nil, nil, tabs), w)
+			d.Resize(fyne.NewSize(700, 550))
+			d.Show()
+		})
+	}()
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// The CLI reads BKS keystores through BouncyCastle, which its jar bundles,
+// so keytool is pointed at the same provider.
+const bouncyCastleProvider = "org.bouncycastle.jce.provider.BouncyCastleProvider"
+
+var keystoreDir = "keystore"
+var keystoreConfigPath = "keystore/keystore.json"
+
+// SigningIdentity is the keystore every patched APK is signed with, so that
+// new builds install as updates over the previous ones. Password is only
+// kept in memory: the config file holds it encrypted with the key at
+// keystoreKeyPath.
+type SigningIdentity struct {
+	Keystore  string    `json:"keystore"`
+	Alias     string    `json:"alias"`
+	Password  string    `json:"-"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// signingConfig is keystore.json and its backups. PlainPassword is only read,
+// from configs written before passwords were encrypted. Salt is set in
+// backups, whose password is encrypted with a passphrase instead of the key.
+type signingConfig struct {
+	SigningIdentity
+	EncryptedPassword string `json:"encryptedPassword"`
+	Salt              string `json:"salt,omitempty"`
+	PlainPassword     string `json:"password,omitempty"`
+}
+
+// keystoreKeyPath returns the file of the key that encrypts the keystore
+// password. It lives in the user config directory rather than next to the
+// app, so that copies of the app folder don't carry it.
+func keystoreKeyPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "GoRevancify", "keystore.key"), nil
+}
+
+// keystoreKey returns the key of keystoreKeyPath, creating it if create is
+// set and there is none.
+func keystoreKey(create bool) ([]byte, error) {
+	path, err := keystoreKeyPath()
+	if err != nil {
+		return nil, err
+	}
+	key, err := os.ReadFile(path)
+	if err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if err == nil {
+		// Replacing it would lose the passwords it encrypts.
+		return nil, fmt.Errorf("keystore password key %s is not valid", path)
+	}
+	if !create || !os.IsNotExist(err) {
+		return nil, fmt.Errorf("keystore password key %s not readable: %v", path, err)
+	}
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	return key, os.WriteFile(path, key, 0600)
+}
+
+// sealPassword encrypts password with AES-GCM under key.
+func sealPassword(key []byte, password string) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(password), nil)), nil
+}
+
+func openPassword(key []byte, sealed string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", fmt.Errorf("encrypted password too short")
+	}
+	password, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("error decrypting keystore password: %v", err)
+	}
+	return string(password), nil
+}
+
+// passphraseKey derives the key of a backup from its passphrase.
+func passphraseKey(passphrase string, salt []byte) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, passphrase, salt, 600000, 32)
+}
+
+// loadSigningIdentity returns the configured identity, or nil when there is
+// none and the CLI should generate a key per run. A config that can't be
+// read, or whose password can't be decrypted, is an error rather than no
+// identity, so that builds aren't silently signed with a throwaway key. A
+// plaintext password left by an older version is encrypted on the way.
+func loadSigningIdentity() (*SigningIdentity, error) {
+	data, err := os.ReadFile(keystoreConfigPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading keystore config %s: %v", keystoreConfigPath, err)
+	}
+	var config signingConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("error unmarshalling keystore config %s: %v", keystoreConfigPath, err)
+	}
+	identity := config.SigningIdentity
+	if config.PlainPassword != "" {
+		identity.Password = config.PlainPassword
+		if err := saveSigningIdentity(&identity); err != nil {
+			logger.Error("encrypting keystore password", "path", keystoreConfigPath, "err", err)
+		}
+		return &identity, nil
+	}
+	key, err := keystoreKey(false)
+	if err != nil {
+		return nil, fmt.Errorf("the keystore password in %s can't be decrypted without its key, restore the key or a backup: %v", keystoreConfigPath, err)
+	}
+	if identity.Password, err = openPassword(key, config.EncryptedPassword); err != nil {
+		return nil, fmt.Errorf("the keystore password in %s can't be decrypted, the key is not the one it was encrypted with: %v", keystoreConfigPath, err)
+	}
+	return &identity, nil
+}
+
+func saveSigningIdentity(identity *SigningIdentity) error {
+	if err := os.MkdirAll(keystoreDir, 0700); err != nil {
+		return err
+	}
+	key, err := keystoreKey(true)
+	if err != nil {
+		return fmt.Errorf("error creating keystore password key: %v", err)
+	}
+	config := signingConfig{SigningIdentity: *identity}
+	if config.EncryptedPassword, err = sealPassword(key, identity.Password); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(keystoreConfigPath, data, 0600)
+}
+
+// secretFlags are the CLI and keytool flags whose value is a password.
+var secretFlags = []string{"--keystore-password", "--keystore-entry-password", "-storepass", "-keypass"}
+
+// redactArgs returns a copy of args to log, with the values of secretFlags
+// masked.
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	copy(redacted, args)
+	for i, arg := range redacted {
+		for _, flag := range secretFlags {
+			switch {
+			case arg == flag && i+1 < len(redacted):
+				redacted[i+1] = "***"
+			case strings.HasPrefix(arg, flag+"="):
+				redacted[i] = flag + "=***"
+			}
+		}
+	}
+	return redacted
+}
+
+func keytoolArgs(args ...string) []string {
+	return append(args, "-storetype", "BKS", "-providerpath", cliSource, "-providerclass", bouncyCastleProvider)
+}
+
+func randomPassword() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// createSigningIdentity generates a new keystore with a random password.
+func createSigningIdentity(alias string) (*SigningIdentity, error) {
+	if alias == "" {
+		return nil, fmt.Errorf("alias not valid")
+	}
+	password, err := randomPassword()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(keystoreDir, 0700); err != nil {
+		return nil, err
+	}
+	identity := &SigningIdentity{
+		Keystore:  filepath.Join(keystoreDir, "gorevancify.keystore"),
+		Alias:     alias,
+		Password:  password,
+		CreatedAt: time.Now(),
+	}
+	if _, err := os.Stat(identity.Keystore); err == nil {
+		return nil, fmt.Errorf("keystore %s already exists", identity.Keystore)
+	}
+
+	cmd := exec.Command("keytool", keytoolArgs(
+		"-genkeypair",
+		"-keystore", identity.Keystore,
+		"-alias", alias,
+		"-keyalg", "RSA",
+		"-keysize", "4096",
+		"-validity", "10000",
+		"-dname", "CN=GoRevancify",
+		"-storepass", password,
+		"-keypass", password,
+	)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("error creating keystore: %v: %s", err, out)
+	}
+	return identity, saveSigningIdentity(identity)
+}
+
+// importSigningIdentity copies an existing keystore into keystoreDir after
+// checking that alias and password open it.
+func importSigningIdentity(path, alias, password string) (*SigningIdentity, error) {
+	if _, err := keystoreFingerprint(path, alias, password); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(keystoreDir, 0700); err != nil {
+		return nil, err
+	}
+	identity := &SigningIdentity{
+		Keystore:  filepath.Join(keystoreDir, "imported-"+time.Now().Format("20060102-150405")+".keystore"),
+		Alias:     alias,
+		Password:  password,
+		CreatedAt: time.Now(),
+	}
+	if err := copyFile(path, identity.Keystore, 0600); err != nil {
+		return nil, err
+	}
+	return identity, saveSigningIdentity(identity)
+}
+
+// keystoreFingerprint returns the SHA-256 fingerprint of the certificate
+// stored under alias.
+func keystoreFingerprint(path, alias, password string) (string, error) {
+	cmd := exec.Command("keytool", keytoolArgs(
+		"-list", "-v",
+		"-keystore", path,
+		"-alias", alias,
+		"-storepass", password,
+	)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("error reading keystore: %v: %s", err, out)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "SHA256:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "SHA256:")), nil
+		}
+	}
+	return "", fmt.Errorf("no SHA-256 fingerprint in keytool output")
+}
+
+// backupSigningIdentity copies the keystore and its config into dir, with
+// the password encrypted by passphrase rather than the local key.
+func backupSigningIdentity(identity *SigningIdentity, dir, passphrase string) (string, error) {
+	if passphrase == "" {
+		return "", fmt.Errorf("passphrase not valid")
+	}
+	name := "gorevancify-keystore-" + time.Now().Format("20060102-150405")
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := passphraseKey(passphrase, salt)
+	if err != nil {
+		return "", err
+	}
+	config := signingConfig{SigningIdentity: *identity, Salt: base64.StdEncoding.EncodeToString(salt)}
+	config.Keystore = name + ".keystore"
+	if config.EncryptedPassword, err = sealPassword(key, identity.Password); err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := copyFile(identity.Keystore, filepath.Join(dir, name+".keystore"), 0600); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".json"), data, 0600); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name+".keystore"), nil
+}
+
+// restoreSigningIdentity imports the keystore of the backup config at path,
+// decrypting its password with passphrase.
+func restoreSigningIdentity(path, passphrase string) (*SigningIdentity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config signingConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("error unmarshalling backup: %v", err)
+	}
+	password := config.PlainPassword
+	if password == "" {
+		salt, err := base64.StdEncoding.DecodeString(config.Salt)
+		if err != nil || len(salt) == 0 {
+			return nil, fmt.Errorf("%s is not a keystore backup", path)
+		}
+		key, err := passphraseKey(passphrase, salt)
+		if err != nil {
+			return nil, err
+		}
+		if password, err = openPassword(key, config.EncryptedPassword); err != nil {
+			return nil, fmt.Errorf("wrong passphrase")
+		}
+	}
+	return importSigningIdentity(filepath.Join(filepath.Dir(path), filepath.Base(config.Keystore)), config.Alias, password)
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// signingArgs returns the CLI arguments to sign with the keystore of plan.
+// The CLI only takes the password as an argument, so it must never be logged
+// without redactArgs.
+func signingArgs(plan *PatchPlan) ([]string, error) {
+	if plan.KeystoreAlias == "" {
+		return nil, nil
+	}
+	identity, err := loadSigningIdentity()
+	if err != nil {
+		return nil, err
+	}
+	if identity == nil || identity.Keystore != plan.Keystore {
+		return nil, fmt.Errorf("signing identity for %s is not configured", plan.Keystore)
+	}
+	return []string{
+		"--keystore", identity.Keystore,
+		"--keystore-password", identity.Password,
+		"--keystore-entry-alias", identity.Alias,
+		"--keystore-entry-password", identity.Password,
+	}, nil
+}
+
+func newSigningTab(w fyne.Window) fyne.CanvasObject {
+	status := widget.NewLabel("")
+	status.Wrapping = fyne.TextWrapWord
+
+	refresh := func() {
+		identity, err := loadSigningIdentity()
+		if err != nil {
+			status.SetText("The keystore can't be used, builds fail until this is fixed:\n" + err.Error())
+			return
+		}
+		if identity == nil {
+			status.SetText("No keystore configured. Every build is signed with a new key and can't be installed over the previous one.")
+			return
+		}
+		fingerprint, err := keystoreFingerprint(identity.Keystore, identity.Alias, identity.Password)
+		if err != nil {
+			fingerprint = err.Error()
+		}
+		status.SetText(fmt.Sprintf("Keystore: %s\nAlias: %s\nCreated: %s\nSHA-256: %s",
+			identity.Keystore, identity.Alias, identity.CreatedAt.Format(time.RFC1123), fingerprint))
+	}
+
+	createButton := widget.NewButton("Create keystore", func() {
+		if identity, err := loadSigningIdentity(); identity != nil || err != nil {
+			dialog.ShowInformation("Error", "A keystore is already configured, back it up before replacing it", w)
+			return
+		}
+		alias := widget.NewEntry()
+		alias.SetText("gorevancify")
+		dialog.ShowForm("Create keystore", "Create", "Cancel", []*widget.FormItem{
+			widget.NewFormItem("Alias", alias),
+		}, func(ok bool) {
+			if !ok {
+				return
+			}
+			if _, err := createSigningIdentity(alias.Text); err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
+			refresh()
+		}, w)
+	})
+
+	importButton := widget.NewButton("Import keystore...", func() {
+		fd := dialog.NewFileOpen(func(file fyne.URIReadCloser, err error) {
+			if err != nil || file == nil {
+				return
+			}
+			file.Close()
+			// A backup config brings its keystore, alias and encrypted
+			// password.
+			if filepath.Ext(file.URI().Path()) == ".json" {
+				passphrase := widget.NewPasswordEntry()
+				dialog.ShowForm("Restore backup", "Restore", "Cancel", []*widget.FormItem{
+					widget.NewFormItem("Passphrase", passphrase),
+				}, func(ok bool) {
+					if !ok {
+						return
+					}
+					if _, err := restoreSigningIdentity(file.URI().Path(), passphrase.Text); err != nil {
+						dialog.ShowError(err, w)
+						return
+					}
+					refresh()
+				}, w)
+				return
+			}
+			alias := widget.NewEntry()
+			password := widget.NewPasswordEntry()
+			dialog.ShowForm("Import keystore", "Import", "Cancel", []*widget.FormItem{
+				widget.NewFormItem("Alias", alias),
+				widget.NewFormItem("Password", password),
+			}, func(ok bool) {
+				if !ok {
+					return
+				}
+				if _, err := importSigningIdentity(file.URI().Path(), alias.Text, password.Text); err != nil {
+					dialog.ShowError(err, w)
+					return
+				}
+				refresh()
+			}, w)
+		}, w)
+		fd.Resize(fyne.NewSize(800, 700))
+		fd.Show()
+	})
+
+	backupButton := widget.NewButton("Back up...", func() {
+		identity, err := loadSigningIdentity()
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		if identity == nil {
+			dialog.ShowInformation("Error", "No keystore configured", w)
+			return
+		}
+		passphrase := widget.NewPasswordEntry()
+		confirm := widget.NewPasswordEntry()
+		dialog.ShowForm("Back up keystore", "Choose folder", "Cancel", []*widget.FormItem{
+			widget.NewFormItem("Passphrase", passphrase),
+			widget.NewFormItem("Repeat", confirm),
+		}, func(ok bool) {
+			if !ok {
+				return
+			}
+			if passphrase.Text == "" || passphrase.Text != confirm.Text {
+				dialog.ShowInformation("Error", "The passphrases are empty or don't match", w)
+				return
+			}
+			fd := dialog.NewFolderOpen(func(dir fyne.ListableURI, err error) {
+				if err != nil || dir == nil {
+					return
+				}
+				path, err := backupSigningIdentity(identity, dir.Path(), passphrase.Text)
+				if err != nil {
+					dialog.ShowError(err, w)
+					return
+				}
+				dialog.ShowInformation("Backup", "Keystore and encrypted password saved to\n"+path+
+					"\nRestore them with Import keystore... and the .json file.\n"+
+					"keystore/keystore.json can't be used without the key in the user config folder, this backup can.", w)
+			}, w)
+			fd.Resize(fyne.NewSize(800, 700))
+			fd.Show()
+		}, w)
+	})
+
+	refresh()
+
+	return container.NewVBox(
+		widget.NewLabelWithStyle("Signing", fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
+		status,
+		container.New(&horizontalCustomLayout{
+			widths:  []float32{260, 260, 260},
+			heights: []float32{50, 50, 50},
+			tabbing: []float32{5, 5, 0},
+		}, createButton, importButton, backupButton),
+	)
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// libraryDir keeps the original APKs imported from elsewhere, and the index
+// of every original APK GoRevancify has, including downloads and pulls
+// which stay where they were saved.
+var libraryDir = "apps/library"
+
+func libraryIndexPath() string {
+	return filepath.Join(libraryDir, "library.json")
+}
+
+// LibraryEntry is an original APK of the library.
+type LibraryEntry struct {
+	Package     string `json:"package"`
+	VersionName string `json:"versionName"`
+	VersionCode int64  `json:"versionCode"`
+	// ABIs are the native library folders of the APK, none when it has no
+	// native code and runs anywhere.
+	ABIs    []string  `json:"abis,omitempty"`
+	Source  string    `json:"source"`
+	SHA256  string    `json:"sha256"`
+	Size    int64     `json:"size"`
+	Path    string    `json:"path"`
+	AddedAt time.Time `json:"addedAt"`
+}
+
+func (e LibraryEntry) String() string {
+	abis := "universal"
+	if len(e.ABIs) > 0 {
+		abis = strings.Join(e.ABIs, ", ")
+	}
+	name := e.Package
+	if app, ok := dict[e.Package]; ok {
+		name = app
+	}
+	sum := e.SHA256
+	if len(sum) > 12 {
+		sum = sum[:12]
+	}
+	return fmt.Sprintf("%s %s (%d)  |  %s  |  %s  |  %.1f MB  |  %s",
+		name, e.VersionName, e.VersionCode, abis, e.Source, float64(e.Size)/(1024*1024), sum)
+}
+
+// fits reports whether the APK runs on a device of arch.
+func (e LibraryEntry) fits(arch string) bool {
+	if len(e.ABIs) == 0 || arch == "" {
+		return true
+	}
+	for _, abi := range e.ABIs {
+		if abi == arch {
+			return true
+		}
+	}
+	return false
+}
+
+// Library is the index of the original APKs, kept in libraryIndexPath.
+type Library struct {
+	Entries []LibraryEntry `json:"entries"`
+}
+
+// libraryMu serializes changes to the index, which downloads make from
+// their own goroutines.
+var libraryMu sync.Mutex
+
+// loadLibrary reads the index, leaving out the APKs deleted since.
+func loadLibrary() (*Library, error) {
+	library := &Library{}
+	data, err := os.ReadFile(libraryIndexPath())
+	if os.IsNotExist(err) {
+		return library, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, library); err != nil {
+		return nil, fmt.Errorf("error unmarshalling library: %v", err)
+	}
+	entries := library.Entries[:0]
+	for _, e := range library.Entries {
+		if _, err := os.Stat(e.Path); err == nil {
+			entries = append(entries, e)
+		}
+	}
+	library.Entries = entries
+	return library, nil
+}
+
+func (l *Library) save() error {
+	if err := os.MkdirAll(libraryDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(libraryIndexPath(), data, 0666)
+}
+
+// byHash returns the entry of the APK with sha256, or nil.
+func (l *Library) byHash(sha256 string) *LibraryEntry {
+	for i := range l.Entries {
+		if l.Entries[i].SHA256 == sha256 {
+			return &l.Entries[i]
+		}
+	}
+	return nil
+}
+
+// find returns the entry of version of pkg that best fits the device:
+// one for its architecture if there is one, the most recently added first.
+func (l *Library) find(pkg, version string) *LibraryEntry {
+	arch := apkMirrorPrefs().Arch
+	var found *LibraryEntry
+	for i := range l.Entries {
+		e := &l.Entries[i]
+		if e.Package != pkg || e.VersionName != version {
+			continue
+		}
+		if found == nil || (e.fits(arch) && !found.fits(arch)) ||
+			(e.fits(arch) == found.fits(arch) && e.AddedAt.After(found.AddedAt)) {
+			found = e
+		}
+	}
+	return found
+}
+
+// apkABIs returns the ABIs an APK has native libraries for.
+func apkABIs(path string) ([]string, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	seen := make(map[string]bool)
+	var abis []string
+	for _, f := range r.File {
+		parts := strings.Split(f.Name, "/")
+		if len(parts) >= 3 && parts[0] == "lib" && !seen[parts[1]] {
+			seen[parts[1]] = true
+			abis = append(abis, parts[1])
+		}
+	}
+	sort.Strings(abis)
+	return abis, nil
+}
+
+// isManagedPath reports whether path is in one of the folders GoRevancify
+// saves original APKs to, whose files are indexed where they are.
+func isManagedPath(path string) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	for _, dir := range []string{libraryDir, apkCacheDir, pulledDir} {
+		if d, err := filepath.Abs(dir); err == nil && strings.HasPrefix(abs, d+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isOutputPath reports whether path is in the output directory, where
+// patched APKs are written, and not in one of the managed folders.
+func isOutputPath(path string) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil || isManagedPath(path) {
+		return false
+	}
+	dir, err := filepath.Abs(outputDir())
+	return err == nil && strings.HasPrefix(abs, dir+string(filepath.Separator))
+}
+
+// checkOriginal refuses the APK at path as an original when it is an output
+// or looks patched.
+func checkOriginal(path string) error {
+	if isOutputPath(path) {
+		return fmt.Errorf("%s is in the output folder, only original APKs go in the library", filepath.Base(path))
+	}
+	check, err := detectPatched(path, "")
+	if err != nil {
+		return err
+	}
+	if check.Patched() {
+		return fmt.Errorf("%s looks patched, only original APKs go in the library:\n%s", filepath.Base(path), check)
+	}
+	return nil
+}
+
+// addToLibrary indexes the APK at path, got from source, and returns its
+// entry. APKs from other folders are copied into libraryDir. An APK that is
+// already in the library is not stored twice: its entry is returned, and a
+// managed copy of it at path is removed. Outputs and patched APKs are
+// refused.
+func addToLibrary(path, source string) (*LibraryEntry, error) {
+	if err := checkOriginal(path); err != nil {
+		return nil, err
+	}
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := readApkInfo(path)
+	if err != nil {
+		return nil, err
+	}
+	abis, err := apkABIs(path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	libraryMu.Lock()
+	defer libraryMu.Unlock()
+	library, err := loadLibrary()
+	if err != nil {
+		return nil, err
+	}
+	if existing := library.byHash(sum); existing != nil {
+		if same, _ := sameFile(existing.Path, path); !same && isManagedPath(path) {
+			if err := os.Remove(path); err == nil {
+				logger.Info("removed duplicate apk", "path", path, "of", existing.Path)
+			}
+		}
+		entry := *existing
+		return &entry, nil
+	}
+
+	dest := path
+	if !isManagedPath(path) {
+		dest = filepath.Join(libraryDir, sanitizeFileName(info.Package),
+			sanitizeFileName(fmt.Sprintf("%s-%s-%s.apk", info.Package, info.VersionName, sum[:12])))
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return nil, err
+		}
+		if err := copyFile(path, dest, 0644); err != nil {
+			return nil, fmt.Errorf("error copying %s to the library: %v", path, err)
+		}
+	}
+
+	entry := LibraryEntry{
+		Package:     info.Package,
+		VersionName: info.VersionName,
+		VersionCode: info.VersionCode,
+		ABIs:        abis,
+		Source:      source,
+		SHA256:      sum,
+		Size:        stat.Size(),
+		Path:        dest,
+		AddedAt:     time.Now(),
+	}
+	// A download replacing an earlier one at the same path replaces its entry.
+	entries := library.Entries[:0]
+	for _, e := range library.Entries {
+		if same, _ := sameFile(e.Path, dest); !same {
+			entries = append(entries, e)
+		}
+	}
+	library.Entries = append(entries, entry)
+	if err := library.save(); err != nil {
+		return nil, err
+	}
+	logger.Info("added apk to library", "package", entry.Package, "version", entry.VersionName, "path", dest)
+	return &entry, nil
+}
+
+func sameFile(a, b string) (bool, error) {
+	absA, err := filepath.Abs(a)
+	if err != nil {
+		return false, err
+	}
+	absB, err := filepath.Abs(b)
+	if err != nil {
+		return false, err
+	}
+	return absA == absB, nil
+}
+
+// libraryAPK returns the library APK of version of pkg, or "".
+func libraryAPK(pkg, version string) string {
+	if pkg == "" || version == "" {
+		return ""
+	}
+	library, err := loadLibrary()
+	if err != nil {
+		logger.Warn("loading library", "err", err)
+		return ""
+	}
+	if e := library.find(pkg, version); e != nil {
+		return e.Path
+	}
+	return ""
+}
+
+// removeFromLibrary deletes the APK of e and its entry.
+func removeFromLibrary(e LibraryEntry) error {
+	libraryMu.Lock()
+	defer libraryMu.Unlock()
+	if err := os.Remove(e.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// The version folders of the cache are left empty.
+	os.Remove(filepath.Dir(e.Path))
+	library, err := loadLibrary()
+	if err != nil {
+		return err
+	}
+	return library.save()
+}
+
+// bundleSupportedVersions returns the versions supported per package by the
+// latest bundle of any source, and the packages supported in any version.
+func bundleSupportedVersions() (map[string]map[string]bool, map[string]bool, error) {
+	versions := make(map[string]map[string]bool)
+	anyVersion := make(map[string]bool)
+	for _, source := range orgNames {
+		bundle, err := getLatestPatchFile(source)
+		if err != nil {
+			continue
+		}
+		list, err := loadBundlePatches(bundle)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error listing patches of %s: %v", bundle, err)
+		}
+		v, anyV := packageVersions(list)
+		for pkg, set := range v {
+			if versions[pkg] == nil {
+				versions[pkg] = make(map[string]bool)
+			}
+			for version := range set {
+				versions[pkg][version] = true
+			}
+		}
+		for pkg := range anyV {
+			anyVersion[pkg] = true
+		}
+	}
+	return versions, anyVersion, nil
+}
+
+// prunableEntries returns the APKs of versions that no bundle supports
+// anymore and that are older than the newest supported one. APKs of apps no
+// bundle knows and of newer versions, which may be supported later, stay.
+func prunableEntries(library *Library) ([]LibraryEntry, error) {
+	versions, anyVersion, err := bundleSupportedVersions()
+	if err != nil {
+		return nil, err
+	}
+	var prunable []LibraryEntry
+	for _, e := range library.Entries {
+		supported := versions[e.Package]
+		if len(supported) == 0 || anyVersion[e.Package] || supported[e.VersionName] {
+			continue
+		}
+		for version := range supported {
+			if compareVersions(version, e.VersionName) > 0 {
+				prunable = append(prunable, e)
+				break
+			}
+		}
+	}
+	return prunable, nil
+}
+
+// sortLibrary orders entries by app, newest version first.
+func sortLibrary(entries []LibraryEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Package != entries[j].Package {
+			return entries[i].Package < entries[j].Package
+		}
+		if entries[i].VersionCode != entries[j].VersionCode {
+			return entries[i].VersionCode > entries[j].VersionCode
+		}
+		return entries[i].AddedAt.After(entries[j].AddedAt)
+	})
+}
+
+func newLibraryTab(w fyne.Window) fyne.CanvasObject {
+	var entries []LibraryEntry
+	selected := -1
+
+	list := widget.NewList(
+		func() int {
+			return len(entries)
+		},
+		func() fyne.CanvasObject {
+			return widget.NewLabel("")
+		},
+		func(id widget.ListItemID, item fyne.CanvasObject) {
+			item.(*widget.Label).SetText(entries[id].String())
+		},
+	)
+	list.OnSelected = func(id widget.ListItemID) {
+		selected = id
+	}
+
+	refresh := func() {
+		library, err := loadLibrary()
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		entries = library.Entries
+		sortLibrary(entries)
+		selected = -1
+		list.UnselectAll()
+		list.Refresh()
+	}
+
+	current := func() (LibraryEntry, bool) {
+		if selected < 0 || selected >= len(entries) {
+			dialog.ShowInformation("Error", "No APK selected", w)
+			return LibraryEntry{}, false
+		}
+		return entries[selected], true
+	}
+
+	importButton := widget.NewButton("Import...", func() {
+		fd := dialog.NewFileOpen(func(file fyne.URIReadCloser, err error) {
+			if err != nil || file == nil {
+				return
+			}
+			file.Close()
+			if _, err := addToLibrary(file.URI().Path(), "file"); err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
+			refresh()
+		}, w)
+		fd.Resize(fyne.NewSize(800, 700))
+		fd.Show()
+	})
+
+	revealButton := widget.NewButton("Reveal", func() {
+		if e, ok := current(); ok {
+			if err := revealFile(e.Path); err != nil {
+				dialog.ShowError(err, w)
+			}
+		}
+	})
+
+	inspectButton := widget.NewButton("Inspect", func() {
+		if e, ok := current(); ok {
+			showApkInspector(w, e.Path)
+		}
+	})
+
+	deleteButton := widget.NewButton("Delete", func() {
+		e, ok := current()
+		if !ok {
+			return
+		}
+		dialog.ShowConfirm("Delete APK", "Delete "+filepath.Base(e.Path)+"?", func(ok bool) {
+			if !ok {
+				return
+			}
+			if err := removeFromLibrary(e); err != nil {
+				dialog.ShowError(err, w)
+			}
+			refresh()
+		}, w)
+	})
+
+	pruneButton := widget.NewButton("Prune...", func() {
+		progress := dialog.NewCustomWithoutButtons("Prune", widget.NewProgressBarInfinite(), w)
+		progress.Show()
+		go func() {
+			library, err := loadLibrary()
+			var prunable []LibraryEntry
+			if err == nil {
+				prunable, err = prunableEntries(library)
+			}
+			fyne.Do(func() {
+				progress.Hide()
+				if err != nil {
+					dialog.ShowError(err, w)
+					return
+				}
+				if len(prunable) == 0 {
+					dialog.ShowInformation("Prune", "Every APK is of a supported version.", w)
+					return
+				}
+				var lines []string
+				for _, e := range prunable {
+					lines = append(lines, e.String())
+				}
+				text := container.NewVScroll(widget.NewLabel(strings.Join(lines, "\n")))
+				text.SetMinSize(fyne.NewSize(600, 250))
+				dialog.ShowCustomConfirm("Delete APKs no bundle supports?", "Delete", "Cancel", text, func(ok bool) {
+					if !ok {
+						return
+					}
+					for _, e := range prunable {
+						if err := removeFromLibrary(e); err != nil {
+							dialog.ShowError(err, w)
+							break
+						}
+					}
+					refresh()
+				}, w)
+			})
+		}()
+	})
+
+	refreshButton := widget.NewButton("Refresh", refresh)
+
+	refresh()
+
+	listScroller := container.NewVScroll(list)
+	listScroller.SetMinSize(fyne.NewSize(100, 500))
+
+	return container.NewVBox(
+		widget.NewLabel("Original APKs in "+libraryDir+", and the downloaded and pulled ones"),
+		listScroller,
+		container.New(&horizontalCustomLayout{
+			widths:  []float32{128, 128, 128, 128, 128, 128},
+			heights: []float32{50, 50, 50, 50, 50, 50},
+			tabbing: []float32{5, 5, 5, 5, 5, 0},
+		}, importButton, revealButton, inspectButton, deleteButton, pruneButton, refreshButton),
+	)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+var logsDir = "logs"
+var runLogsDir = "logs/runs"
+var appLogPath = "logs/gorevancify.log"
+
+// Rotation and retention of logsDir.
+const (
+	appLogMaxSize    = 5 * 1024 * 1024
+	appLogBackups    = 3
+	runLogsMaxCount  = 100
+	runLogsMaxAgeDay = 30
+)
+
+// logger is the application log. It writes to appLogPath and stderr until
+// initLogging replaces the default that only writes to stderr.
+var logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+func logLevel() slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(readSetting("logLevel", "INFO"))); err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// initLogging rotates the application log, prunes old run logs and opens
+// the application log.
+func initLogging() {
+	if err := os.MkdirAll(runLogsDir, 0755); err != nil {
+		logger.Error("creating logs directory", "err", err)
+		return
+	}
+	rotateAppLog()
+	pruneRunLogs()
+
+	f, err := os.OpenFile(appLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logger.Error("opening application log", "path", appLogPath, "err", err)
+		return
+	}
+	logger = slog.New(slog.NewTextHandler(io.MultiWriter(f, os.Stderr), &slog.HandlerOptions{Level: logLevel()}))
+}
+
+// rotateAppLog shifts gorevancify.log to gorevancify.log.1 and so on once
+// it grows past appLogMaxSize.
+func rotateAppLog() {
+	info, err := os.Stat(appLogPath)
+	if err != nil || info.Size() < appLogMaxSize {
+		return
+	}
+	os.Remove(fmt.Sprintf("%s.%d", appLogPath, appLogBackups))
+	for i := appLogBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", appLogPath, i), fmt.Sprintf("%s.%d", appLogPath, i+1))
+	}
+	os.Rename(appLogPath, appLogPath+".1")
+}
+
+// pruneRunLogs keeps the newest runLogsMaxCount run logs that are younger
+// than runLogsMaxAgeDay days.
+func pruneRunLogs() {
+	files, err := listLogFiles(runLogsDir)
+	if err != nil {
+		return
+	}
+	maxAge := time.Now().AddDate(0, 0, -runLogsMaxAgeDay)
+	for i, file := range files {
+		if i >= runLogsMaxCount || file.ModTime().Before(maxAge) {
+			os.Remove(filepath.Join(runLogsDir, file.Name()))
+		}
+	}
+}
+
+// listLogFiles returns the regular files of dir, newest first.
+func listLogFiles(dir string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []os.FileInfo
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			files = append(files, info)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+	return files, nil
+}
+
+// RunLog is the log of one patch run, named by its start time and app.
+type RunLog struct {
+	*slog.Logger
+	Path string
+	file *os.File
+}
+
+func startRunLog(app string) (*RunLog, error) {
+	if err := os.MkdirAll(runLogsDir, 0755); err != nil {
+		return nil, err
+	}
+	name := sanitizeFileName(time.Now().Format("2006-01-02T15-04-05") + "-" + app)
+	path := filepath.Join(runLogsDir, name+".log")
+	// Queued jobs of the same app can start within the same second.
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	for i := 2; os.IsExist(err); i++ {
+		path = filepath.Join(runLogsDir, fmt.Sprintf("%s-%d.log", name, i))
+		f, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &RunLog{
+		Logger: slog.New(slog.NewTextHandler(f, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		Path:   path,
+		file:   f,
+	}, nil
+}
+
+func (r *RunLog) Close() error {
+	return r.file.Close()
+}
+
+// exportLogs writes every log file under logsDir into a zip archive.
+func exportLogs(w io.Writer) error {
+	zw := zip.NewWriter(w)
+	err := filepath.Walk(logsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(logsDir, path)
+		if err != nil {
+			return err
+		}
+		dst, err := zw.Create(filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(dst, src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func newLogsTab(w fyne.Window) fyne.CanvasObject {
+	var paths []string
+	selected := ""
+
+	content := widget.NewLabel("")
+	content.Wrapping = fyne.TextWrapWord
+	contentScroller := container.NewVScroll(content)
+	contentScroller.SetMinSize(fyne.NewSize(100, 350))
+
+	list := widget.NewList(
+		func() int {
+			return len(paths)
+		},
+		func() fyne.CanvasObject {
+			return widget.NewLabel("")
+		},
+		func(id widget.ListItemID, item fyne.CanvasObject) {
+			rel, _ := filepath.Rel(logsDir, paths[id])
+			item.(*widget.Label).SetText(rel)
+		},
+	)
+	list.OnSelected = func(id widget.ListItemID) {
+		selected = paths[id]
+		data, err := os.ReadFile(selected)
+		if err != nil {
+			content.SetText(err.Error())
+			return
+		}
+		content.SetText(string(data))
+		contentScroller.ScrollToBottom()
+	}
+
+	refresh := func() {
+		paths = nil
+		for _, dir := range []string{runLogsDir, logsDir} {
+			files, _ := listLogFiles(dir)
+			for _, file := range files {
+				paths = append(paths, filepath.Join(dir, file.Name()))
+			}
+		}
+		selected = ""
+		content.SetText("")
+		list.UnselectAll()
+		list.Refresh()
+	}
+
+	exportButton := widget.NewButton("Export log...", func() {
+		if selected == "" {
+			dialog.ShowInformation("Error", "No log selected", w)
+			return
+		}
+		fd := dialog.NewFileSave(func(file fyne.URIWriteCloser, err error) {
+			if err != nil || file == nil {
+				return
+			}
+			defer file.Close()
+			src, err := os.Open(selected)
+			if err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
+			defer src.Close()
+			if _, err := io.Copy(file, src); err != nil {
+				dialog.ShowError(err, w)
+			}
+		}, w)
+		fd.SetFileName(filepath.Base(selected))
+		fd.Resize(fyne.NewSize(800, 700))
+		fd.Show()
+	})
+
+	exportAllButton := widget.NewButton("Export all (zip)...", func() {
+		fd := dialog.NewFileSave(func(file fyne.URIWriteCloser, err error) {
+			if err != nil || file == nil {
+				return
+			}
+			defer file.Close()
+			if err := exportLogs(file); err != nil {
+				dialog.ShowError(err, w)
+			}
+		}, w)
+		fd.SetFileName("gorevancify-logs-" + time.Now().Format("2006-01-02") + ".zip")
+		fd.Resize(fyne.NewSize(800, 700))
+		fd.Show()
+	})
+
+	refreshButton := widget.NewButton("Refresh", refresh)
+
+	refresh()
+
+	listScroller := container.NewVScroll(list)
+	listScroller.SetMinSize(fyne.NewSize(100, 150))
+
+	return container.NewVBox(
+		listScroller,
+		container.New(&horizontalCustomLayout{
+			widths:  []float32{260, 260, 260},
+			heights: []float32{40, 40, 40},
+			tabbing: []float32{5, 5, 0},
+		}, exportButton, exportAllButton, refreshButton),
+		contentScroller,
+	)
+}
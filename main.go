@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,15 +12,14 @@ import (
 	"runtime"
 	"sort"
 	"strings"
+	"sync"
 
 	"os"
 	"os/exec"
-	"time"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
 	"fyne.io/fyne/v2/container"
-	"fyne.io/fyne/v2/data/binding"
 	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/widget"
 )
@@ -183,9 +183,7 @@ var patchTable *widget.Table = loadPatchNames()
 var patchScroller = container.NewVScroll(patchTable)
 
 var patchesNames []string
-var currentPatchesSelected []string
 var desc []string
-var include []bool
 var supportedVersions []string
 var nameLength int
 var descLength int
@@ -213,18 +211,16 @@ var customPackageName string = "com.google.android.youtube"
 var ApkLabel string
 
 // Console
-var logLabel = widget.NewLabelWithData(logData)
-var logData = binding.NewString()
-var consoleLog = container.NewVScroll(logLabel)
+var console = newConsole(consoleMaxLines)
 
 var patching bool = false
+var headless bool = false
 var patchOptionsPath = "patches/patches-to-use.txt"
 
 func clearTable() {
 	supportedVersions = []string{}
 	patchesNames = []string{}
 	desc = []string{}
-	include = []bool{}
 }
 
 func getOrgNames(sources map[string]Source) []string {
@@ -243,12 +239,12 @@ func writePatchesTXT() error {
 
 	patchesToSave := ""
 
-	for _, patch := range currentPatchesSelected {
+	for _, patch := range currentSelection() {
 		patchesToSave = patchesToSave + "\"" + patch + "\" "
 	}
 
 	if err := os.WriteFile(patchOptionsPath, []byte(patchesToSave), 0666); err != nil {
-		fmt.Print(err)
+		logger.Error("writing selected patches", "path", patchOptionsPath, "err", err)
 	}
 	writePatchesOptionsJson()
 	return nil
@@ -288,8 +284,8 @@ func writePatchesOptionsJson() error {
 	// }
 
 	file, _ := json.Marshal(patchOptionJson)
-	if err := os.WriteFile("patches/gorevancify-patch-options.json", file, 0666); err != nil {
-		fmt.Print(err)
+	if err := os.WriteFile(patchOptionsJsonPath, file, 0666); err != nil {
+		logger.Error("writing patch options", "path", patchOptionsJsonPath, "err", err)
 	}
 	return nil
 }
@@ -377,12 +373,13 @@ func unmarshalJson() {
 	//fmt.Printf("patchJsonFile: %v \n", patchJsonFile)
 	data, err := os.ReadFile(patchJsonFile)
 	if err != nil {
-		fmt.Printf("error patchJsonFile: %s\n", err)
+		logger.Error("reading patch catalog", "path", patchJsonFile, "err", err)
 		return
 	}
 
 	err = json.Unmarshal(data, &patches)
 	if err != nil {
+		logger.Error("unmarshalling patch catalog", "path", patchJsonFile, "err", err)
 		return
 	}
 }
@@ -411,12 +408,14 @@ func processPatchData() ([]string, error) {
 
 				patchesNames = append(patchesNames, patch.Name)
 				desc = append(desc, patch.Description)
-				include = append(include, patch.Use)
 			}
 
 		}
 	}
 
+	applySelection(recommendedPatches())
+	currentProfile = presetRecommended
+	profilePatches = currentSelection()
 	setTableCellsLength()
 
 	return supportedVersions, nil
@@ -444,32 +443,9 @@ func loadPatchNames() *widget.Table {
 			switch id.Col {
 			case 0: // Columna 0: Checkbox
 				check := widget.NewCheck("", func(checked bool) {
-					include[row] = checked
-
-					// Agregar a currentPatchesSelected si el checkbox está activado y el parche no está ya presente
-					if checked {
-						exists := false
-						for _, name := range currentPatchesSelected {
-							if name == patchesNames[row] {
-								exists = true
-								break
-							}
-						}
-						if !exists {
-							currentPatchesSelected = append(currentPatchesSelected, patchesNames[row])
-						}
-					} else {
-						// Remover si el checkbox se desactiva
-						for i, name := range currentPatchesSelected {
-							if name == patchesNames[row] {
-								currentPatchesSelected = append(currentPatchesSelected[:i], currentPatchesSelected[i+1:]...)
-								break
-							}
-						}
-					}
-
+					setPatchSelected(patchesNames[row], checked)
 				})
-				check.SetChecked(include[row])
+				check.SetChecked(isPatchSelected(patchesNames[row]))
 
 				container.Add(check)
 
@@ -516,7 +492,7 @@ func prepareOptionsAndPatchesJson(projName string) {
 	latestPatch, err := getLatestPatchFile(projName)
 
 	if err != nil {
-		fmt.Println("Error:", err)
+		logger.Error("resolving patch bundle", "source", projName, "err", err)
 		return
 	}
 
@@ -528,12 +504,21 @@ func prepareOptionsAndPatchesJson(projName string) {
 }
 
 func getLatestPatchFile(projName string) (string, error) {
+	files, err := listPatchFiles(projName)
+	if err != nil {
+		return "", err
+	}
+	return files[len(files)-1], nil
+}
+
+// listPatchFiles returns the downloaded bundles of projName, oldest first.
+func listPatchFiles(projName string) ([]string, error) {
 	dir := fmt.Sprintf("patches/%s", projName)
 	var files []fs.FileInfo
 
 	entries, err := os.ReadDir(dir)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	for _, entry := range entries {
@@ -546,7 +531,7 @@ func getLatestPatchFile(projName string) (string, error) {
 	}
 
 	if len(files) == 0 {
-		return "", fmt.Errorf("no patch files found")
+		return nil, fmt.Errorf("no patch files found")
 	}
 
 	// Ordenar por fecha de modificación (más reciente al final)
@@ -554,8 +539,11 @@ func getLatestPatchFile(projName string) (string, error) {
 		return files[i].ModTime().Before(files[j].ModTime())
 	})
 
-	latest := files[len(files)-1]
-	return filepath.Join(dir, latest.Name()), nil
+	paths := make([]string, len(files))
+	for i, file := range files {
+		paths[i] = filepath.Join(dir, file.Name())
+	}
+	return paths, nil
 }
 
 func getAvailableAppsNamesByPkg() {
@@ -591,54 +579,95 @@ func getPackageNamesByAppName(appName string) string {
 }
 
 func readSettings() bool {
-	data, err := os.ReadFile("settings.txt")
-	if err != nil {
-		return false
-	}
-	content := string(data)
-	return content == "updateOnStart=true\n"
+	return readSetting("updateOnStart", "false") == "true"
 }
 
 func main() {
+	initLogging()
+	jvmSlots.setMax(maxJVMs())
+	jobQueue.SetParallelism(queueParallelism())
+
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	var a = app.New()
 	var w = a.NewWindow("GoRevancify " + version)
 	var appAPK string
 
 	prepareDict()
 
-	// console log
-	logData.Set("")
-	logLabel.Wrapping = fyne.TextWrapWord
-
-	consoleLog.SetMinSize(fyne.NewSize(200, 500))
-	consoleLog.Refresh()
-	logLabel.Refresh()
-
 	// Load projects from JSON file
 	sources := loadSourcesFromFile("patches/sources.json")
 	orgNames = getOrgNames(sources)
 
 	//LoadSettings
+	var updatedBundles map[string]string
 	if readSettings() {
-		updatePatches()
+		updatedBundles = updatePatches()
 	}
 
 	updateOnStart := widget.NewCheck("Update patches on start", func(checked bool) {
 		// write settings.txt
-		err := os.WriteFile("settings.txt", []byte(fmt.Sprintf("updateOnStart=%t\n", checked)), 0644)
+		err := writeSetting("updateOnStart", fmt.Sprintf("%t", checked))
 		if err != nil {
-			fmt.Println("Error writing the file:", err)
+			logger.Error("writing settings", "err", err)
 		}
 	})
 	updateOnStart.Checked = readSettings()
+
+	checkAppUpdate := widget.NewCheck("Check for GoRevancify updates on start", func(checked bool) {
+		if err := writeSetting("checkAppUpdate", fmt.Sprintf("%t", checked)); err != nil {
+			logger.Error("writing settings", "err", err)
+		}
+	})
+	checkAppUpdate.Checked = checkAppUpdateOnStart()
+
+	installAfterPatch := widget.NewCheck("Install on a connected device after patching (adb)", func(checked bool) {
+		if err := writeSetting("installAfterPatch", fmt.Sprintf("%t", checked)); err != nil {
+			logger.Error("writing settings", "err", err)
+		}
+	})
+	installAfterPatch.Checked = readSetting("installAfterPatch", "false") == "true"
+
+	patchSucceeded := func(outputPath string) {
+		dialog.ShowInformation("Success", "APK patched successfully! \n"+outputPath, w)
+		if installAfterPatch.Checked {
+			m, _ := loadBuildManifest(manifestPath(outputPath))
+			showInstallDialog(outputPath, m, w)
+		}
+	}
+	// apkFromLibrary is set while appAPK is the library APK of the selected
+	// version rather than one the user picked.
+	var apkFromLibrary bool
+	var openApkFileButton *widget.Button
+
 	// Dropdown versions
 	var versionOptions []string
 	dropdownVer := widget.NewSelect(versionOptions, func(selected string) {
 		apkDownloadVersion = selected
+		if appAPK != "" && !apkFromLibrary {
+			return
+		}
+		appAPK, apkFromLibrary = "", false
+		openApkFileButton.SetText("Select APK... \n(Apk not selected)")
+		if apk := libraryAPK(packageName, selected); apk != "" {
+			appAPK, apkFromLibrary = "file://"+apk, true
+			openApkFileButton.SetText("APK from library \n(" + filepath.Base(apk) + ")")
+		}
 	})
 	dropdownVer.PlaceHolder = "Select version"
 	dropdownVer.Alignment = fyne.TextAlignCenter
 
+	// Presets for the selected app
+	presetSelect := widget.NewSelect(nil, nil)
+	presetSelect.PlaceHolder = "Select preset"
+	refreshPresets := func() {
+		presetSelect.ClearSelected()
+		presetSelect.Options = presetNames(packageName)
+		presetSelect.Refresh()
+	}
+
 	// Dropdown App to patch
 	patchName := widget.NewLabel("")
 	var appOptions []string
@@ -658,6 +687,7 @@ func main() {
 		}
 
 		loadSourcesFromFileOptions("options.json")
+		refreshPresets()
 
 		patchChosen = selected
 
@@ -701,13 +731,17 @@ func main() {
 	nameEntry := widget.NewEntry()
 	nameEntry.SetPlaceHolder("Enter output name")
 
-	var openApkFileButton *widget.Button
 	openApkFileButton = widget.NewButton("Select APK... \n(Apk not selected)", func() {
 		fd := dialog.NewFileOpen(func(file fyne.URIReadCloser, err error) {
 			if err != nil || file == nil {
 				return
 			}
-			appAPK = file.URI().String()
+			appAPK, apkFromLibrary = file.URI().String(), false
+			if entry, err := addToLibrary(file.URI().Path(), "file"); err != nil {
+				logger.Warn("adding apk to library", "path", file.URI().Path(), "err", err)
+			} else {
+				appAPK = "file://" + entry.Path
+			}
 			selectedApkName := strings.Split(appAPK, "/")
 			openApkFileButton.SetText("APK Selected \n(" + selectedApkName[len(selectedApkName)-1] + ")")
 		}, w)
@@ -715,24 +749,56 @@ func main() {
 		fd.Show()
 	})
 
-	downloadApkButton := widget.NewButton("Download (ApkMirror)", func() {
+	downloadApkButton := widget.NewButton("Download APK", func() {
 		if patchChosen == "" {
 			dialog.ShowInformation("Error", "Patch not chosen", w)
 			return
 		}
-		url := fmt.Sprint("https://www.apkmirror.com/?post_type=app_release&searchtype=apk&bundles%5B%5D=apkm_bundles&bundles%5B%5D=apk_files&s=" + appToPatch + " " + apkDownloadVersion)
-		openBrowser(url)
+		if apkDownloadVersion == "" {
+			// Without a version there is nothing to pick from, so search.
+			openBrowser(apkMirrorSearchURL(appToPatch, ""))
+			return
+		}
+		showDownloadApkDialog(w, appToPatch, apkDownloadVersion, func(apk string) {
+			appAPK, apkFromLibrary = "file://"+apk, false
+			openApkFileButton.SetText("APK Selected \n(" + filepath.Base(apk) + ")")
+		})
+	})
 
+	pullApkButton := widget.NewButton("Pull from device", func() {
+		if len(supportedApp) == 0 {
+			dialog.ShowInformation("Error", "Patch not selected", w)
+			return
+		}
+		showPullDialog(w, func(app, apk, version string) {
+			dropdownApp.SetSelected(app)
+			appAPK, apkFromLibrary = "file://"+apk, false
+			openApkFileButton.SetText("APK Selected \n(" + filepath.Base(apk) + ")")
+
+			supported := false
+			for _, v := range dropdownVer.Options {
+				if v == version {
+					supported = true
+				}
+			}
+			if supported {
+				dropdownVer.SetSelected(version)
+			} else {
+				dropdownVer.ClearSelected()
+				apkDownloadVersion = version
+				dialog.ShowInformation("Pull from device", "Pulled "+app+" "+version+".\nThis version is not listed as supported by the patches.", w)
+			}
+		})
 	})
 
 	apkPartLabel := widget.NewLabel("\nOR...")
 	apkPartLabel.Alignment = fyne.TextAlignCenter
 	apkPartLabel.TextStyle = fyne.TextStyle{Bold: true}
 	apkPart := container.New(&horizontalCustomLayout{
-		widths:  []float32{376, 50, 376},
-		heights: []float32{100, 100, 100},
-		tabbing: []float32{0, 0, 0},
-	}, openApkFileButton, apkPartLabel, downloadApkButton)
+		widths:  []float32{250, 50, 250, 250},
+		heights: []float32{100, 100, 100, 100},
+		tabbing: []float32{0, 0, 2, 0},
+	}, openApkFileButton, apkPartLabel, downloadApkButton, pullApkButton)
 
 	patchButton := widget.NewButton("Patch APK", func() {
 		if patching {
@@ -745,32 +811,199 @@ func main() {
 		}
 		patch := strings.Split(patchName.Text, " ")[2]
 
-		patchesSource := "patches/" + patch + "/patches-*.rvp"
-
-		if appAPK == "" {
+		if appAPK == "" && cachedAPK(packageName, apkDownloadVersion) == "" {
 			dialog.ShowInformation("Error", "No APK selected!", w)
 			return
 		} else if nameEntry.Text == "" || nameEntry.Text == "Enter output name" {
 			dialog.ShowInformation("Error", "Name not valid", w)
 			return
 		} else {
+			input := strings.TrimPrefix(appAPK, "file://")
+			if input == "" {
+				input = cachedAPK(packageName, apkDownloadVersion)
+			}
+			confirmInput(w, packageName, input, func(apk string) {
+				if apk != input {
+					appAPK, apkFromLibrary = "file://"+apk, false
+					openApkFileButton.SetText("APK Selected \n(" + filepath.Base(apk) + ")")
+				}
+				go func() {
+					//fmt.Println("patchesJson: " + patchesJson)
+					outputPath, err := PatchApp(appAPK, patch, nameEntry.Text, console, w)
+					fyne.Do(func() {
+						if err != nil {
+							dialog.ShowError(err, w)
+						} else if outputPath != "" {
+							patchSucceeded(outputPath)
+						}
+					})
+				}()
+			})
+		}
+	})
+
+	modeSelect := widget.NewSelect(patchModes, func(selected string) {
+		patchMode = PatchMode(selected)
+	})
+	modeSelect.SetSelected(string(patchMode))
 
+	runPlanAsync := func(plan *PatchPlan) {
+		confirmInput(w, plan.Package, plan.InputAPK, func(apk string) {
+			plan.InputAPK = apk
 			go func() {
-				//fmt.Println("patchesJson: " + patchesJson)
-				err := PatchApp(appAPK, cliSource, patch, nameEntry.Text, patchesSource, logData, w)
-				if err != nil {
-					dialog.ShowError(err, w)
-				} else {
-					dialog.ShowInformation("Success", "APK patched successfully! \n"+fmt.Sprintf("apps/patched/%s-patched-%s.apk", nameEntry.Text, patch), w)
+				err := runPlan(plan, console)
+				fyne.Do(func() {
+					if err != nil {
+						dialog.ShowError(err, w)
+					} else {
+						patchSucceeded(plan.OutputPath)
+					}
+				})
+			}()
+		})
+	}
+
+	planButton := widget.NewButton("Plan", func() {
+		if patchName.Text == "" {
+			dialog.ShowCustom("error", "close", widget.NewLabel("Patch not selected"), w)
+			return
+		}
+		patch := strings.Split(patchName.Text, " ")[2]
+		plan, err := buildPatchPlan(appAPK, patch, nameEntry.Text, outputTemplate())
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+
+		planScroll := container.NewVScroll(widget.NewLabel(plan.String()))
+		planScroll.SetMinSize(fyne.NewSize(600, 400))
+		planDialog := dialog.NewCustomWithoutButtons("Patch plan", planScroll, w)
+		planDialog.SetButtons([]fyne.CanvasObject{
+			widget.NewButton("Close", planDialog.Hide),
+			widget.NewButton("Save...", func() {
+				fd := dialog.NewFileSave(func(file fyne.URIWriteCloser, err error) {
+					if err != nil || file == nil {
+						return
+					}
+					defer file.Close()
+					data, _ := json.MarshalIndent(plan, "", "  ")
+					if _, err := file.Write(data); err != nil {
+						dialog.ShowError(err, w)
+					}
+				}, w)
+				fd.SetFileName("plan.json")
+				fd.Resize(fyne.NewSize(800, 700))
+				fd.Show()
+			}),
+			widget.NewButton("Execute", func() {
+				planDialog.Hide()
+				runPlanAsync(plan)
+			}),
+		})
+		planDialog.Show()
+	})
+
+	runSavedPlanButton := widget.NewButton("Run saved plan...", func() {
+		fd := dialog.NewFileOpen(func(file fyne.URIReadCloser, err error) {
+			if err != nil || file == nil {
+				return
+			}
+			defer file.Close()
+			plan, err := loadPlan(file.URI().Path())
+			if err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
+			dialog.ShowConfirm("Run saved plan", plan.String(), func(ok bool) {
+				if ok {
+					runPlanAsync(plan)
 				}
+			}, w)
+		}, w)
+		fd.Resize(fyne.NewSize(800, 700))
+		fd.Show()
+	})
+
+	rebuildButton := widget.NewButton("Rebuild from manifest...", func() {
+		fd := dialog.NewFileOpen(func(file fyne.URIReadCloser, err error) {
+			if err != nil || file == nil {
+				return
+			}
+			file.Close()
+			go func() {
+				result, err := rebuildFromManifest(file.URI().Path(), console)
+				fyne.Do(func() {
+					if err != nil {
+						dialog.ShowError(err, w)
+						return
+					}
+					dialog.ShowInformation("Rebuild", result, w)
+				})
 			}()
+		}, w)
+		fd.Resize(fyne.NewSize(800, 700))
+		fd.Show()
+	})
+
+	dryRunButton := widget.NewButton("Dry run", func() {
+		summary, err := resolvePatchSelection(patchMode, recommendedPatches(), universalPatches(), currentSelection())
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		summaryLabel := widget.NewLabel(summary.String())
+		summaryScroll := container.NewVScroll(summaryLabel)
+		summaryScroll.SetMinSize(fyne.NewSize(500, 400))
+		dialog.ShowCustom("Dry run", "close", summaryScroll, w)
+	})
+
+	queueButton := widget.NewButton("Add to queue", func() {
+		if patchName.Text == "" {
+			dialog.ShowCustom("error", "close", widget.NewLabel("Patch not selected"), w)
+			return
+		}
+		patch := strings.Split(patchName.Text, " ")[2]
+		plan, err := buildPatchPlan(appAPK, patch, nameEntry.Text, outputTemplate())
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		job, err := jobQueue.Add(plan)
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		dialog.ShowInformation("Queue", fmt.Sprintf("Added job #%d, see the Queue tab", job.ID), w)
+	})
+
+	modePart := container.New(&horizontalCustomLayout{
+		widths:  []float32{290, 165, 165, 165},
+		heights: []float32{40, 40, 40, 40},
+		tabbing: []float32{5, 5, 5, 0},
+	}, modeSelect, dryRunButton, planButton, queueButton)
+
+	inspectButton := widget.NewButton("Inspect APK", func() {
+		input := strings.TrimPrefix(appAPK, "file://")
+		if input == "" {
+			input = cachedAPK(packageName, apkDownloadVersion)
+		}
+		if input == "" {
+			dialog.ShowInformation("Error", "No APK selected!", w)
+			return
 		}
+		showApkInspector(w, input)
 	})
 
+	planPart := container.New(&horizontalCustomLayout{
+		widths:  []float32{260, 260, 270},
+		heights: []float32{40, 40, 40},
+		tabbing: []float32{5, 5, 0},
+	}, runSavedPlanButton, rebuildButton, inspectButton)
+
 	patchAndConsole := container.New(&verticalCustomLayout{
-		widths:  []float32{800, 50, 800},
-		heights: []float32{100, 50, 300},
-	}, patchButton, widget.NewLabel("Console Log"), consoleLog)
+		widths:  []float32{800, 800, 800, 800},
+		heights: []float32{45, 45, 100, 350},
+	}, modePart, planPart, patchButton, newConsoleView(console, w, nil))
 
 	nameEntry.Resize(fyne.NewSize(100, 50))
 
@@ -782,6 +1015,8 @@ func main() {
 
 	form := container.NewVBox(
 		updateOnStart,
+		checkAppUpdate,
+		installAfterPatch,
 		widget.NewLabel(""),
 		patchPart,
 		apkPart,
@@ -806,23 +1041,53 @@ func main() {
 	pkgName.SetPlaceHolder("Enter pkg name.. Default: " + customPackageName)
 
 	selectAllOptions := widget.NewButton("Select All", func() {
-		for i := 0; i < len(patchesNames); i++ {
-			include[i] = true
-			id := widget.TableCellID{Row: i, Col: 0} // Set the include state to true for all patches
-			patchTable.Select(id)
-			currentPatchesSelected = append(currentPatchesSelected, patchesNames[i]) // Select the checkbox in the first column
-		}
+		selectAllPatches()
+		patchTable.Refresh()
 	})
 
 	unselectAllOptions := widget.NewButton("Unselect All", func() {
-		for i := 0; i < len(patchesNames); i++ {
-			include[i] = false
-			id := widget.TableCellID{Row: i, Col: 0} // Set the include state to false for all patches
-			patchTable.Unselect(id)                  // Unselect the checkbox in the first column
-			currentPatchesSelected = append(currentPatchesSelected, patchesNames[i])
+		unselectAllPatches()
+		patchTable.Refresh()
+	})
+
+	presetSelect.OnChanged = func(selected string) {
+		if selected == "" {
+			return
 		}
+		if err := applyPreset(packageName, selected); err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		patchTable.Refresh()
+	}
 
-		currentPatchesSelected = []string{}
+	savePresetButton := widget.NewButton("Save as preset", func() {
+		if packageName == "" {
+			dialog.ShowInformation("Error", "App not selected", w)
+			return
+		}
+		presetName := widget.NewEntry()
+		dialog.ShowForm("Save preset", "Save", "Cancel", []*widget.FormItem{
+			widget.NewFormItem("Name", presetName),
+		}, func(ok bool) {
+			if !ok {
+				return
+			}
+			if err := saveUserPreset(packageName, presetName.Text, currentSelection()); err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
+			refreshPresets()
+			presetSelect.SetSelected(presetName.Text)
+		}, w)
+	})
+
+	deletePresetButton := widget.NewButton("Delete preset", func() {
+		if err := deleteUserPreset(packageName, presetSelect.Selected); err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		refreshPresets()
 	})
 
 	patchOptionsTab := container.NewVBox(
@@ -834,6 +1099,12 @@ func main() {
 			tabbing: []float32{10, 0},
 		},
 			selectAllOptions, unselectAllOptions),
+		container.New(&horizontalCustomLayout{
+			widths:  []float32{300, 300, 300},
+			heights: []float32{40, 40, 40},
+			tabbing: []float32{5, 5, 0},
+		},
+			presetSelect, savePresetButton, deletePresetButton),
 		patchScroller,
 		widget.NewLabel(""),
 		container.New(&horizontalCustomLayout{
@@ -862,26 +1133,39 @@ func main() {
 	app := container.NewAppTabs(
 		container.NewTabItem("Patching", form),
 		container.NewTabItem("Patch options", patchOptionsTab),
+		container.NewTabItem("Signing", newSigningTab(w)),
+		container.NewTabItem("Queue", newQueueTab(w)),
+		container.NewTabItem("History", newHistoryTab(w)),
+		container.NewTabItem("Library", newLibraryTab(w)),
+		container.NewTabItem("Releases", newReleasesTab(w)),
+		container.NewTabItem("Logs", newLogsTab(w)),
 	)
 
+	w.SetMainMenu(fyne.NewMainMenu(
+		fyne.NewMenu("Patches",
+			fyne.NewMenuItem("Compare bundles...", func() { showCompareBundlesDialog(w) }),
+		),
+		fyne.NewMenu("Help",
+			fyne.NewMenuItem("Check for updates...", func() { checkSelfUpdateNow(w) }),
+		),
+	))
 	w.SetContent(app)
 	w.Resize(fyne.NewSize(800, 650))
-	w.ShowAndRun()
-}
-
-func getCurrentFileLocation() (string, error) {
-	_, filename, _, ok := runtime.Caller(0)
-	if !ok {
-		return "", fmt.Errorf("failed to get main.go location")
+	if checkAppUpdate.Checked {
+		go checkSelfUpdateOnStart(w)
+	}
+	if len(updatedBundles) > 0 {
+		go showUpdatedBundleDiffs(updatedBundles, w)
 	}
-	mainDir := filepath.Dir(filename)
-	return mainDir, nil
+	w.ShowAndRun()
 }
 
-func OpenFileManager() error {
+func OpenFileManager(dir string) error {
 	var cmd *exec.Cmd
-	path, _ := getCurrentFileLocation()
-	path += "\\apps\\patched"
+	path, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
 
 	switch runtime.GOOS {
 	case "windows":
@@ -897,7 +1181,7 @@ func OpenFileManager() error {
 		return fmt.Errorf("unsupported platform: %s", runtime.GOOS)
 	}
 
-	err := cmd.Run()
+	err = cmd.Run()
 	if err != nil {
 		return fmt.Errorf("failed to open file manager: %w", err)
 	}
@@ -908,13 +1192,13 @@ func OpenFileManager() error {
 func loadSourcesFromFile(filename string) map[string]Source {
 	file, err := os.ReadFile(filename)
 	if err != nil {
-		fmt.Println("Error reading sources file:", err)
+		logger.Error("reading sources file", "path", filename, "err", err)
 		return nil
 	}
 
 	var sources map[string]Source
 	if err := json.Unmarshal(file, &sources); err != nil {
-		fmt.Println("Error unmarshalling sources JSON:", err)
+		logger.Error("unmarshalling sources", "path", filename, "err", err)
 		return nil
 	}
 	return sources
@@ -922,11 +1206,11 @@ func loadSourcesFromFile(filename string) map[string]Source {
 
 func loadSourcesFromFileOptions(filename string) map[string]PatchOptionsJSON {
 	file, _ := os.ReadFile(filename)
-	fmt.Printf("file: %s\n", filename)
+	logger.Debug("loading patch options", "path", filename)
 	var options map[string]PatchOptionsJSON
 	//fmt.Println("patchOptionJson:", patchOptionJson)
 	if err := json.Unmarshal(file, &patchOptionJson); err != nil {
-		fmt.Println("Error unmarshalling PatchOptionsJSON:", err)
+		logger.Error("unmarshalling patch options", "path", filename, "err", err)
 		return nil
 	}
 
@@ -934,244 +1218,265 @@ func loadSourcesFromFileOptions(filename string) map[string]PatchOptionsJSON {
 }
 
 func executePatching(cmd *exec.Cmd) error {
-	if err := cmd.Run(); err != nil {
-		logError(err)
+	jvmSlots.acquire()
+	defer jvmSlots.release()
+	out, err := cmd.CombinedOutput()
+	logger.Debug("cli", "args", redactArgs(cmd.Args), "output", string(out))
+	if err != nil {
+		logger.Error("cli failed", "args", redactArgs(cmd.Args), "err", err, "output", string(out))
+		return fmt.Errorf("error running patch command: %v", err)
+	}
+	return nil
+}
+
+// runPatchCommand runs cmd, streaming its stdout and stderr to the console
+// and to runLog.
+func runPatchCommand(cmd *exec.Cmd, console *Console, runLog *RunLog) error {
+	wait, err := writeLogs(cmd, console, runLog)
+	if err != nil {
+		return err
+	}
+	jvmSlots.acquire()
+	defer jvmSlots.release()
+	runLog.Info("cli started", "args", redactArgs(cmd.Args))
+	if err := cmd.Start(); err != nil {
+		runLog.Error("cli failed to start", "err", err)
+		return fmt.Errorf("error running patch command: %v", err)
+	}
+	wait()
+	if err := cmd.Wait(); err != nil {
+		runLog.Error("cli failed", "err", err)
+		logger.Error("cli failed", "args", redactArgs(cmd.Args), "err", err, "log", runLog.Path)
 		return fmt.Errorf("error running patch command: %v", err)
 	}
+	runLog.Info("cli finished")
 	return nil
 }
 
 func checkPatchPreRequisites(appName, apk string, w fyne.Window) bool {
 	if appName == "" {
-		dialog.ShowCustom("error", "close", widget.NewLabel("Invalid app name"), w)
+		fyne.Do(func() { dialog.ShowCustom("error", "close", widget.NewLabel("Invalid app name"), w) })
 		return false
 	}
 	if apk == "Apk not selected..." {
-		dialog.ShowCustom("error", "close", widget.NewLabel("Apk not selected"), w)
+		fyne.Do(func() { dialog.ShowCustom("error", "close", widget.NewLabel("Apk not selected"), w) })
 		return false
 	}
 	return true
 }
 
-func PatchApp(apk, cliSource, source, appName, patchesSource string, logData binding.String, w fyne.Window) error {
+// PatchApp patches apk with the current selection and returns the path of
+// the patched APK.
+func PatchApp(apk, source, appName string, console *Console, w fyne.Window) (string, error) {
 
 	if !checkPatchPreRequisites(appName, apk, w) {
-		return nil
+		return "", nil
 	}
 
-	// Open the file for reading
-	file, err := os.Open(patchOptionsPath)
+	plan, err := buildPatchPlan(apk, source, appName, outputTemplate())
 	if err != nil {
-		return fmt.Errorf("error opening file: %v", err)
+		return "", err
 	}
-	defer file.Close()
-
-	apk = strings.Split(apk, "file://")[1]
-
-	outputPath := fmt.Sprintf("apps/patched/%s-patched-%s-%v.apk", appName, source, version)
-	patching = true
+	return plan.OutputPath, runPlan(plan, console)
+}
 
-	//Include patches
-	var patchArgs []string
-	for _, patch := range currentPatchesSelected {
-		//patchArgs = append(patchArgs, "-e", fmt.Sprintf("\"%s\"", patch))
-		patchArgs = append(patchArgs, "-e", patch)
+// runPlan executes plan unless another run is in progress and opens the
+// output folder on success.
+func runPlan(plan *PatchPlan, console *Console) error {
+	if patching {
+		return fmt.Errorf("already patching")
 	}
-	patchesSourceSlice := strings.Split(patchesSource, "/")
-
-	cmdArgs := []string{
-		"-jar", cliSource, "patch",
-		apk,
-		"--patches", "patches/" + patchesSourceSlice[1] + "/patches-*.rvp",
-		"--out", outputPath,
-		"-O", "patches/gorevancify-patch-options.json",
-		"--exclusive",
+	if err := savePreviousRun(plan.Package, plan.Patches.Applied); err != nil {
+		logger.Error("saving previous run", "err", err)
 	}
-	cmdArgs = append(cmdArgs, patchArgs...)
-	cmd := exec.Command("java", cmdArgs...)
-
-	writeLogs(cmd, logData)
-	executePatching(cmd)
-
-	deleteTempFiles(appName, source)
+	patching = true
+	defer func() { patching = false }()
 
-	// verify if apk patched succesfully
-	if _, err := os.Stat(fmt.Sprintf("apps/patched/%s-patched-%s-%v.apk", appName, source, version)); os.IsNotExist(err) {
-		patching = false
-		return fmt.Errorf("patching failed")
-	} else {
-		OpenFileManager()
+	if err := executePlan(plan, console); err != nil {
+		return err
+	}
+	if !headless {
+		OpenFileManager(filepath.Dir(plan.OutputPath))
 	}
-	patching = false
-
 	return nil
 }
 
-func deleteTempFiles(appName, source string) {
+func deleteTempFiles(outputPath string, console *Console) {
 
-	filepath := fmt.Sprintf("apps/patched/%s-patched-%s-%v-temporary-files", appName, source, version)
-	addLogText("REMOVING: " + filepath)
+	filepath := strings.TrimSuffix(outputPath, ".apk") + "-temporary-files"
+	addLogText(console, "REMOVING: "+filepath)
 
 	if err := os.RemoveAll(filepath); err != nil {
-		addLogText("error removing folder" + filepath + ": " + err.Error())
+		addLogText(console, "error removing folder"+filepath+": "+err.Error())
 	} else {
-		addLogText("Folder removed successfully.")
+		addLogText(console, "Folder removed successfully.")
 	}
-	filepath = fmt.Sprintf("apps/patched/%s-patched-%s-%v.keystore", appName, source, version)
-	addLogText("REMOVING: " + filepath)
+	// Keystores generated per run are thrown away, the managed one lives in keystoreDir.
+	filepath = strings.TrimSuffix(outputPath, ".apk") + ".keystore"
+	addLogText(console, "REMOVING: "+filepath)
 	os.Remove(filepath)
 	if err := os.RemoveAll(filepath); err != nil {
-		addLogText("error removing folder" + filepath + ": " + err.Error())
+		addLogText(console, "error removing folder"+filepath+": "+err.Error())
 	} else {
-		addLogText("Folder removed successfully.")
+		addLogText(console, "Folder removed successfully.")
 	}
 
 	filepath = "revancify.keystore"
-	addLogText("REMOVING: " + filepath)
+	addLogText(console, "REMOVING: "+filepath)
 	os.Remove(filepath)
 	if err := os.RemoveAll(filepath); err != nil {
-		addLogText("error removing folder" + filepath + ": " + err.Error())
+		addLogText(console, "error removing folder"+filepath+": "+err.Error())
 	} else {
-		addLogText("Folder removed successfully.")
+		addLogText(console, "Folder removed successfully.")
 	}
 
 	filepath = "revx.keystore"
-	addLogText("REMOVING: " + filepath)
+	addLogText(console, "REMOVING: "+filepath)
 	os.Remove(filepath)
 	if err := os.RemoveAll(filepath); err != nil {
-		addLogText("error removing folder" + filepath + ": " + err.Error())
+		addLogText(console, "error removing folder"+filepath+": "+err.Error())
 	} else {
-		addLogText("Folder removed successfully.")
+		addLogText(console, "Folder removed successfully.")
 	}
 }
 
-func writeLogs(cmd *exec.Cmd, logData binding.String) error {
-
+// writeLogs copies the output of cmd to the console and runLog. The returned
+// function waits until both streams are drained and must be called before
+// cmd.Wait.
+func writeLogs(cmd *exec.Cmd, console *Console, runLog *RunLog) (func(), error) {
 	stdoutPipe, err := cmd.StdoutPipe()
 	if err != nil {
-		return fmt.Errorf("error creating stdout pipe: %v", err)
+		return nil, fmt.Errorf("error creating stdout pipe: %v", err)
 	}
 
 	stderrPipe, err := cmd.StderrPipe()
 	if err != nil {
-		return fmt.Errorf("error creating stderr pipe: %v", err)
+		return nil, fmt.Errorf("error creating stderr pipe: %v", err)
 	}
-	// Show cli output
-	go func() {
-		scanner := bufio.NewScanner(stdoutPipe)
-		for scanner.Scan() {
-			currentLog, _ := logData.Get()
-			newLog := currentLog + fmt.Sprintf(" %s\n", scanner.Text())
 
-			logData.Set(newLog)
-			consoleLog.ScrollToBottom()
+	var wg sync.WaitGroup
+	stream := func(name string, pipe io.Reader) {
+		defer wg.Done()
+		scanner := bufio.NewScanner(pipe)
+		for scanner.Scan() {
+			line := ansiRegexp.ReplaceAllString(scanner.Text(), "")
+			runLog.Log(context.Background(), lineSeverity(line), "cli output", "stream", name, "line", line)
+			if headless {
+				fmt.Fprintln(consoleWriter(name), scanner.Text())
+				continue
+			}
+			console.Write(name, scanner.Text())
 		}
-	}()
+	}
 
+	wg.Add(2)
+	// Show cli output
+	go stream(streamStdout, stdoutPipe)
 	// Show cli error
-	go func() {
-		scanner := bufio.NewScanner(stderrPipe)
-		for scanner.Scan() {
-			currentLog, _ := logData.Get()
-			newLog := currentLog + fmt.Sprintf(" %s\n", scanner.Text())
-			logData.Set(newLog)
-			consoleLog.ScrollToBottom()
-		}
-	}()
-	return nil
+	go stream(streamStderr, stderrPipe)
+	return wg.Wait, nil
 }
-func addLogText(text string) {
-	currentLog, _ := logData.Get()
-	newLog := currentLog + fmt.Sprintf(" %s\n", text)
-	logData.Set(newLog)
-	consoleLog.ScrollToBottom()
-}
-
-func logError(err error) {
 
-	f, fileErr := os.OpenFile("logs/error_log.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if fileErr != nil {
-		fmt.Println("Error opening log:", fileErr)
+func addLogText(console *Console, text string) {
+	if headless {
+		fmt.Println(text)
 		return
 	}
-	defer f.Close()
-
-	if _, fileErr = f.WriteString(fmt.Sprintf("[%s] %v\n", time.Now().Format(time.RFC3339), err)); fileErr != nil {
-		fmt.Println("Error writing log:", fileErr)
-	}
+	console.Write(streamApp, text)
 }
 
-func getLatestReleaseURL(org, repo string) (string, string, error) {
-
-	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/releases/latest", org, repo)
-	resp, err := http.Get(url)
-	if err != nil {
-		return "", "", err
-	}
-	defer resp.Body.Close()
-
-	var data struct {
-		TagName string `json:"tag_name"`
-		Assets  []struct {
-			Name               string `json:"name"`
-			BrowserDownloadURL string `json:"browser_download_url"`
-		} `json:"assets"`
-	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-		return "", "", err
-	}
-
-	for _, asset := range data.Assets {
+// bundleAsset returns the .rvp asset of release.
+func bundleAsset(release *GitHubRelease) (*GitHubAsset, error) {
+	for i, asset := range release.Assets {
 		if strings.HasSuffix(asset.Name, ".rvp") {
-			return asset.BrowserDownloadURL, data.TagName, nil
+			return &release.Assets[i], nil
 		}
 	}
 
-	return "", "", fmt.Errorf("no .rvp asset found in latest release")
+	return nil, fmt.Errorf("no .rvp asset found in release %s", release.TagName)
 }
 
-func updatePatches() {
+// updatePatches downloads the latest bundle of every source and returns
+// the new ones by source.
+func updatePatches() map[string]string {
+	updated := make(map[string]string)
 	for _, org := range orgNames {
-		dirPath := "patches/" + org + "/"
-
-		if _, err := os.Stat(dirPath); os.IsNotExist(err) {
-			if err := os.MkdirAll(dirPath, 0755); err != nil {
-				fmt.Println("Error creating folder:", err)
-				continue
-			}
-		}
-
-		downloadURL, version, err := getLatestReleaseURL(org, "revanced-patches")
+		path, downloaded, err := updatePatchSource(org)
 		if err != nil {
-			fmt.Println("Error getting latest release for", org, ":", err)
-			continue
+			logger.Error("updating patches", "org", org, "err", err)
+		} else if downloaded {
+			updated[org] = path
 		}
+	}
+	return updated
+}
 
-		dest := filepath.Join(dirPath, "patches-"+version+".rvp")
+// updatePatchSource downloads the latest bundle of org unless it is already
+// there, and returns its path and whether it was downloaded.
+func updatePatchSource(org string) (string, bool, error) {
+	dirPath := "patches/" + org + "/"
 
-		// Descargar si no existe
-		if _, err := os.Stat(dest); os.IsNotExist(err) {
-			fmt.Println("Downloading latest patch:", downloadURL)
-			if err := DownloadFile(dest, downloadURL); err != nil {
-				fmt.Println("Download error:", err)
-			} else {
-				fmt.Println("Downloaded:", dest)
-			}
-		} else {
-			fmt.Println("Latest patch already exists:", dest)
+	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
+		if err := os.MkdirAll(dirPath, 0755); err != nil {
+			return "", false, fmt.Errorf("error creating folder: %v", err)
 		}
 	}
+
+	release, err := getLatestRelease(org, patchesRepo)
+	if err != nil {
+		return "", false, fmt.Errorf("error getting latest release: %v", err)
+	}
+	asset, err := bundleAsset(release)
+	if err != nil {
+		return "", false, err
+	}
+	downloadURL := mirrorURL(asset.BrowserDownloadURL)
+
+	dest := filepath.Join(dirPath, "patches-"+release.TagName+".rvp")
+	if err := saveBundleRelease(dest, release); err != nil {
+		logger.Warn("saving release notes", "path", bundleReleasePath(dest), "err", err)
+	}
+
+	// Descargar si no existe
+	if _, err := os.Stat(dest); err == nil {
+		logger.Debug("latest patch already exists", "path", dest)
+		return dest, false, nil
+	}
+	logger.Info("downloading latest patch", "org", org, "tag", release.TagName, "url", downloadURL)
+	// Download next to it first so that a partial file is never taken for
+	// the latest bundle.
+	if err := DownloadFile(dest+".part", downloadURL); err != nil {
+		os.Remove(dest + ".part")
+		return "", false, fmt.Errorf("error downloading patch: %v", err)
+	}
+	if err := os.Rename(dest+".part", dest); err != nil {
+		return "", false, err
+	}
+	logger.Info("downloaded patch", "path", dest)
+	return dest, true, nil
 }
 
 func DownloadFile(filepath string, url string) error {
-	fmt.Println("Downloading from:", url)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	return downloadRequest(http.DefaultClient, req, filepath, nil)
+}
+
+// downloadRequest saves the response to req in filepath, reporting the
+// bytes written and the total, -1 when unknown, to progress if not nil.
+func downloadRequest(client *http.Client, req *http.Request, filepath string, progress func(done, total int64)) error {
+	logger.Debug("downloading", "url", req.URL.String())
 	// Get the data
-	resp, err := http.Get(url)
+	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error downloading %s: %s", req.URL, resp.Status)
+	}
 
 	// Create the file
 	out, err := os.Create(filepath)
@@ -1181,6 +1486,24 @@ func DownloadFile(filepath string, url string) error {
 	defer out.Close()
 
 	// Write the body to file
-	_, err = io.Copy(out, resp.Body)
+	var w io.Writer = out
+	if progress != nil {
+		w = &progressWriter{w: out, total: resp.ContentLength, progress: progress}
+	}
+	_, err = io.Copy(w, resp.Body)
 	return err
 }
+
+type progressWriter struct {
+	w        io.Writer
+	done     int64
+	total    int64
+	progress func(done, total int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.done += int64(n)
+	p.progress(p.done, p.total)
+	return n, err
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// BuildManifest records everything that produced a patched APK. It is
+// written next to the output as <output>.manifest.json.
+type BuildManifest struct {
+	Tool       string    `json:"tool"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+
+	Input struct {
+		Path    string `json:"path"`
+		Package string `json:"package"`
+		Version string `json:"version"`
+		SHA256  string `json:"sha256"`
+	} `json:"input"`
+
+	Bundle struct {
+		Source string `json:"source"`
+		Tag    string `json:"tag"`
+		Path   string `json:"path"`
+		SHA256 string `json:"sha256"`
+	} `json:"bundle"`
+
+	CLI struct {
+		Path    string `json:"path"`
+		Version string `json:"version"`
+		SHA256  string `json:"sha256"`
+	} `json:"cli"`
+
+	Signing struct {
+		Keystore string `json:"keystore"`
+		Alias    string `json:"alias,omitempty"`
+		SHA256   string `json:"sha256,omitempty"`
+	} `json:"signing"`
+
+	Patches []string           `json:"patches"`
+	Options []PatchOptionsJSON `json:"options"`
+
+	Output struct {
+		Path   string `json:"path"`
+		Size   int64  `json:"size"`
+		SHA256 string `json:"sha256"`
+	} `json:"output"`
+
+	Plan PatchPlan `json:"plan"`
+}
+
+var cliVersionRegexp = regexp.MustCompile(`revanced-cli-(.+?)(-all)?\.jar$`)
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// bundleTag returns the release tag of a patches-<tag>.rvp file.
+func bundleTag(bundle string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(filepath.Base(bundle), "patches-"), ".rvp")
+}
+
+func cliVersion(jar string) string {
+	match := cliVersionRegexp.FindStringSubmatch(filepath.Base(jar))
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+func manifestPath(outputPath string) string {
+	return strings.TrimSuffix(outputPath, ".apk") + ".manifest.json"
+}
+
+// writeBuildManifest hashes the inputs and the output of a finished run of
+// plan and writes its manifest.
+func writeBuildManifest(plan *PatchPlan, startedAt time.Time) (*BuildManifest, error) {
+	m := &BuildManifest{
+		Tool:       "GoRevancify " + version,
+		StartedAt:  startedAt,
+		FinishedAt: time.Now(),
+		Patches:    plan.Patches.Applied,
+		Options:    plan.Options,
+		Plan:       *plan,
+	}
+	var err error
+
+	m.Input.Path = plan.InputAPK
+	m.Input.Package = plan.Package
+	m.Input.Version = plan.AppVersion
+	if m.Input.SHA256, err = fileSHA256(plan.InputAPK); err != nil {
+		return nil, fmt.Errorf("error hashing input APK: %v", err)
+	}
+
+	m.Bundle.Source = plan.Source
+	m.Bundle.Tag = bundleTag(plan.PatchBundle)
+	m.Bundle.Path = plan.PatchBundle
+	if m.Bundle.SHA256, err = fileSHA256(plan.PatchBundle); err != nil {
+		return nil, fmt.Errorf("error hashing patch bundle: %v", err)
+	}
+
+	m.CLI.Path = plan.CLIJar
+	m.CLI.Version = cliVersion(plan.CLIJar)
+	if m.CLI.SHA256, err = fileSHA256(plan.CLIJar); err != nil {
+		return nil, fmt.Errorf("error hashing CLI: %v", err)
+	}
+
+	m.Signing.Keystore = plan.Keystore
+	m.Signing.Alias = plan.KeystoreAlias
+	if identity, _ := loadSigningIdentity(); identity != nil && identity.Keystore == plan.Keystore {
+		m.Signing.SHA256, _ = keystoreFingerprint(identity.Keystore, identity.Alias, identity.Password)
+	}
+
+	info, err := os.Stat(plan.OutputPath)
+	if err != nil {
+		return nil, err
+	}
+	m.Output.Path = plan.OutputPath
+	m.Output.Size = info.Size()
+	if m.Output.SHA256, err = fileSHA256(plan.OutputPath); err != nil {
+		return nil, fmt.Errorf("error hashing output: %v", err)
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(manifestPath(plan.OutputPath), data, 0666); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func loadBuildManifest(path string) (*BuildManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m BuildManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("error unmarshalling manifest: %v", err)
+	}
+	return &m, nil
+}
+
+// rebuildPlan returns the plan recorded in m after checking that the input
+// APK, the patch bundle and the CLI are still the ones that were used.
+func rebuildPlan(m *BuildManifest) (*PatchPlan, error) {
+	checks := []struct {
+		what, path, sha256 string
+	}{
+		{"input APK", m.Input.Path, m.Input.SHA256},
+		{"patch bundle", m.Bundle.Path, m.Bundle.SHA256},
+		{"CLI", m.CLI.Path, m.CLI.SHA256},
+	}
+	for _, check := range checks {
+		sum, err := fileSHA256(check.path)
+		if err != nil {
+			return nil, fmt.Errorf("%s not available: %v", check.what, err)
+		}
+		if sum != check.sha256 {
+			return nil, fmt.Errorf("%s %s changed since the build (sha256 %s, expected %s)", check.what, check.path, sum, check.sha256)
+		}
+	}
+
+	plan := m.Plan
+	plan.CreatedAt = time.Now()
+	return &plan, nil
+}
+
+// rebuildFromManifest recreates the APK described by the manifest at path
+// next to it and reports whether the new output is byte-identical to the
+// recorded one. The recorded build is left untouched: an identical rebuild
+// is discarded, a different one is kept under a new name.
+func rebuildFromManifest(path string, console *Console) (string, error) {
+	m, err := loadBuildManifest(path)
+	if err != nil {
+		return "", err
+	}
+	plan, err := rebuildPlan(m)
+	if err != nil {
+		return "", err
+	}
+	recorded := plan.OutputPath
+	plan.OutputPath = strings.TrimSuffix(recorded, ".apk") + "-rebuild-" + time.Now().Format("20060102-150405") + ".apk"
+	if plan.KeystoreAlias == "" {
+		plan.Keystore = strings.TrimSuffix(plan.OutputPath, ".apk") + ".keystore"
+	}
+	if err := runPlan(plan, console); err != nil {
+		return "", err
+	}
+
+	sum, err := fileSHA256(plan.OutputPath)
+	if err != nil {
+		return "", err
+	}
+	if sum == m.Output.SHA256 {
+		os.Remove(plan.OutputPath)
+		os.Remove(manifestPath(plan.OutputPath))
+		return fmt.Sprintf("Rebuilt %s, identical to the recorded build.", recorded), nil
+	}
+	return fmt.Sprintf("Rebuilt %s with the same inputs; the output differs from the recorded build and was kept as %s (sha256 %s).", recorded, plan.OutputPath, sum), nil
+}
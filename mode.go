@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PatchMode decides how the selection is turned into CLI arguments.
+type PatchMode string
+
+const (
+	// modeDefaults lets the CLI apply the bundle defaults (use=true) only.
+	modeDefaults PatchMode = "Defaults only"
+	// modeDefaultsChanges applies the defaults, enabling selected patches that
+	// are off by default and disabling unselected patches that are on.
+	modeDefaultsChanges PatchMode = "Defaults + changes"
+	// modeExclusive applies exactly the selected patches.
+	modeExclusive PatchMode = "Exclusive"
+)
+
+var patchModes = []string{string(modeDefaults), string(modeDefaultsChanges), string(modeExclusive)}
+
+var patchMode = modeDefaultsChanges
+
+// PatchSelectionSummary is what a run will do with the patches: the ones that
+// end up applied and the explicit -e/-d flags needed to get there.
+type PatchSelectionSummary struct {
+	Mode     PatchMode `json:"mode"`
+	Applied  []string  `json:"applied"`
+	Included []string  `json:"included"`
+	Excluded []string  `json:"excluded"`
+}
+
+// resolvePatchSelection computes the summary for mode from the bundle
+// defaults and the user selection. Universal patches, the use=true patches
+// without compatible packages, are applied by the CLI unless the mode is
+// exclusive.
+func resolvePatchSelection(mode PatchMode, defaults, universal, selected []string) (PatchSelectionSummary, error) {
+	summary := PatchSelectionSummary{Mode: mode}
+
+	switch mode {
+	case modeDefaults:
+		summary.Applied = append(append([]string{}, defaults...), universal...)
+	case modeDefaultsChanges:
+		summary.Applied = append(append([]string{}, selected...), universal...)
+		summary.Included = missingFrom(selected, defaults)
+		summary.Excluded = missingFrom(defaults, selected)
+	case modeExclusive:
+		if len(selected) == 0 {
+			return summary, fmt.Errorf("exclusive mode needs at least one selected patch")
+		}
+		summary.Applied = selected
+		summary.Included = selected
+	default:
+		return summary, fmt.Errorf("unknown patch mode %q", mode)
+	}
+	return summary, nil
+}
+
+// missingFrom returns the names of a that are not in b, keeping a's order.
+func missingFrom(a, b []string) []string {
+	var names []string
+	for _, name := range a {
+		found := false
+		for _, other := range b {
+			if name == other {
+				found = true
+				break
+			}
+		}
+		if !found {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// args returns the patch arguments for the CLI patch command.
+func (s PatchSelectionSummary) args() []string {
+	var args []string
+	if s.Mode == modeExclusive {
+		args = append(args, "--exclusive")
+	}
+	for _, patch := range s.Included {
+		args = append(args, "-e", patch)
+	}
+	for _, patch := range s.Excluded {
+		args = append(args, "-d", patch)
+	}
+	return args
+}
+
+func (s PatchSelectionSummary) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Mode: %s\n", s.Mode)
+	fmt.Fprintf(&b, "\nPatches applied (%d):\n", len(s.Applied))
+	for _, patch := range s.Applied {
+		fmt.Fprintf(&b, "  %s\n", patch)
+	}
+	if len(s.Included) > 0 {
+		fmt.Fprintf(&b, "\nExplicitly included (-e):\n")
+		for _, patch := range s.Included {
+			fmt.Fprintf(&b, "  %s\n", patch)
+		}
+	}
+	if len(s.Excluded) > 0 {
+		fmt.Fprintf(&b, "\nExplicitly excluded (-d):\n")
+		for _, patch := range s.Excluded {
+			fmt.Fprintf(&b, "  %s\n", patch)
+		}
+	}
+	return b.String()
+}
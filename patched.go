@@ -0,0 +1,245 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// revancedClassPrefix is the package of the extension classes, formerly
+// integrations, that patches add to the dex files.
+const revancedClassPrefix = "Lapp/revanced/"
+
+// PatchedCheck lists the signs that an APK is the output of a patch run.
+type PatchedCheck struct {
+	Package string
+	Version string
+	SHA256  string
+	// OriginalPackage is the package of the app it was patched from.
+	OriginalPackage string
+	// Manifest is the GoRevancify build manifest of the APK, if found.
+	Manifest *BuildManifest
+	Reasons  []string
+}
+
+// Patched reports whether the APK looks patched.
+func (c *PatchedCheck) Patched() bool {
+	return len(c.Reasons) > 0
+}
+
+func (c *PatchedCheck) String() string {
+	return "- " + strings.Join(c.Reasons, "\n- ")
+}
+
+// detectPatched looks for signs that apk was already patched: a build
+// manifest, ReVanced classes and a package other than expected, the one of
+// the selected app. A signer other than the publisher is only reported
+// along with one of them, as mirrors re-sign APKs too.
+func detectPatched(apk, expected string) (*PatchedCheck, error) {
+	info, err := readApkInfo(apk)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := fileSHA256(apk)
+	if err != nil {
+		return nil, err
+	}
+	check := &PatchedCheck{
+		Package:         info.Package,
+		Version:         info.VersionName,
+		SHA256:          sum,
+		OriginalPackage: info.Package,
+	}
+
+	if m := findBuildManifest(apk, sum); m != nil {
+		check.Manifest = m
+		check.OriginalPackage = m.Input.Package
+		check.Reasons = append(check.Reasons, fmt.Sprintf("It was built by GoRevancify on %s from %s %s.",
+			m.FinishedAt.Local().Format("2006-01-02 15:04"), m.Plan.App, m.Input.Version))
+	}
+	found, err := dexContains(apk, []byte(revancedClassPrefix))
+	if err != nil {
+		logger.Warn("reading dex files", "apk", apk, "err", err)
+	}
+	if found {
+		check.Reasons = append(check.Reasons, "It contains ReVanced extension classes (app.revanced).")
+	}
+	if expected != "" && expected != "nil" && info.Package != expected {
+		if check.Manifest == nil {
+			check.OriginalPackage = expected
+		}
+		check.Reasons = append(check.Reasons, fmt.Sprintf("Its package is %s instead of %s.", info.Package, expected))
+	}
+
+	if check.Patched() {
+		if certs, err := checkSigningCert(check.OriginalPackage, apk); err == nil && certs.Mismatch() {
+			check.Reasons = append(check.Reasons, "It is not signed by the publisher.")
+		}
+	}
+	return check, nil
+}
+
+// findBuildManifest returns the build manifest of the APK with sha256,
+// either next to it or of a build in the output directory it was copied
+// from.
+func findBuildManifest(apk, sha256 string) *BuildManifest {
+	if m, err := loadBuildManifest(manifestPath(apk)); err == nil && (m.Output.SHA256 == "" || m.Output.SHA256 == sha256) {
+		return m
+	}
+	history, err := loadHistory(outputDir())
+	if err != nil {
+		return nil
+	}
+	for _, h := range history {
+		if h.Manifest != nil && h.Manifest.Output.SHA256 == sha256 {
+			return h.Manifest
+		}
+	}
+	return nil
+}
+
+// dexContains reports whether any dex file of apk contains s, which for a
+// class descriptor means that the class is there.
+func dexContains(apk string, s []byte) (bool, error) {
+	r, err := zip.OpenReader(apk)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if path.Dir(f.Name) != "." || !strings.HasPrefix(f.Name, "classes") || path.Ext(f.Name) != ".dex" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return false, err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return false, err
+		}
+		if bytes.Contains(data, s) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// originalAPK returns the APK the patched one of check was built from: the
+// input of its build manifest, or the library APK of the same version of
+// the original app.
+func originalAPK(check *PatchedCheck) string {
+	if check.Manifest != nil {
+		return buildInputAPK(check.Manifest)
+	}
+	library, err := loadLibrary()
+	if err != nil {
+		logger.Warn("loading library", "err", err)
+		return ""
+	}
+	if e := library.find(check.OriginalPackage, check.Version); e != nil && e.SHA256 != check.SHA256 {
+		return e.Path
+	}
+	return ""
+}
+
+// buildInputAPK returns the input APK of the build of m, found in the
+// library by hash or where it was, else the library APK of its version.
+func buildInputAPK(m *BuildManifest) string {
+	library, err := loadLibrary()
+	if err != nil {
+		logger.Warn("loading library", "err", err)
+		library = &Library{}
+	}
+	if e := library.byHash(m.Input.SHA256); e != nil {
+		return e.Path
+	}
+	if sum, err := fileSHA256(m.Input.Path); err == nil && sum == m.Input.SHA256 {
+		return m.Input.Path
+	}
+	if e := library.find(m.Input.Package, m.Input.Version); e != nil {
+		return e.Path
+	}
+	return ""
+}
+
+// warnIfPatched logs when the input of plan looks patched, for the runs
+// that nobody is asked about.
+func warnIfPatched(plan *PatchPlan) {
+	check, err := detectPatched(plan.InputAPK, plan.Package)
+	if err != nil || !check.Patched() {
+		return
+	}
+	logger.Warn("input apk looks already patched", "apk", plan.InputAPK, "reasons", check.Reasons)
+}
+
+// confirmUnpatchedInput calls proceed with apk unless it looks already
+// patched, in which case the user can cancel, patch it anyway or patch the
+// original APK from the library instead.
+func confirmUnpatchedInput(w fyne.Window, pkg, apk string, proceed func(apk string)) {
+	check, err := detectPatched(apk, pkg)
+	if err != nil {
+		logger.Warn("checking input apk", "apk", apk, "err", err)
+		proceed(apk)
+		return
+	}
+	if !check.Patched() {
+		proceed(apk)
+		return
+	}
+
+	title := widget.NewRichText(&widget.TextSegment{
+		Text: "This APK looks already patched",
+		Style: widget.RichTextStyle{
+			ColorName: theme.ColorNameWarning,
+			SizeName:  theme.SizeNameSubHeadingText,
+			TextStyle: fyne.TextStyle{Bold: true},
+		},
+	})
+	text := "Patching a patched APK usually gives a broken app.\n\n" + check.String()
+	original := originalAPK(check)
+	if original != "" {
+		text += "\n\nThe original APK is in the library:\n" + original
+	} else {
+		text += "\n\nThe original APK is not in the library. Download or select the APK of the app itself."
+	}
+
+	d := dialog.NewCustomWithoutButtons("Input APK", container.NewVBox(title, widget.NewLabel(text)), w)
+	buttons := []fyne.CanvasObject{
+		widget.NewButton("Cancel", d.Hide),
+		widget.NewButton("Patch anyway", func() {
+			d.Hide()
+			proceed(apk)
+		}),
+	}
+	if original != "" {
+		useOriginal := widget.NewButton("Use the original", func() {
+			d.Hide()
+			proceed(original)
+		})
+		useOriginal.Importance = widget.HighImportance
+		buttons = append(buttons, useOriginal)
+	}
+	d.SetButtons(buttons)
+	d.Show()
+}
+
+// confirmInput runs the checks of the input APK before patching, then
+// proceed with the APK to patch.
+func confirmInput(w fyne.Window, pkg, apk string, proceed func(apk string)) {
+	confirmUnpatchedInput(w, pkg, apk, func(input string) {
+		confirmInputCert(w, pkg, input, func() {
+			proceed(input)
+		})
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+var savedOptionsDir = "patches/options"
+
+// savedOptionsPath is where the option values saved for pkg are kept. They
+// override the defaults of the bundle in plans built for pkg.
+func savedOptionsPath(pkg string) string {
+	return filepath.Join(savedOptionsDir, sanitizeFileName(pkg)+".json")
+}
+
+func loadSavedOptions(pkg string) ([]PatchOptionsJSON, error) {
+	data, err := os.ReadFile(savedOptionsPath(pkg))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var options []PatchOptionsJSON
+	if err := json.Unmarshal(data, &options); err != nil {
+		return nil, fmt.Errorf("error unmarshalling saved options: %v", err)
+	}
+	return options, nil
+}
+
+func saveOptions(pkg string, options []PatchOptionsJSON) error {
+	if err := os.MkdirAll(savedOptionsDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(options, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(savedOptionsPath(pkg), data, 0666)
+}
+
+// copyOptions returns a copy of options that can be changed without
+// touching them.
+func copyOptions(options []PatchOptionsJSON) []PatchOptionsJSON {
+	copied := make([]PatchOptionsJSON, len(options))
+	for i, patch := range options {
+		copied[i] = PatchOptionsJSON{PatchName: patch.PatchName, Options: append([]OptionsPatch(nil), patch.Options...)}
+	}
+	return copied
+}
+
+// withSavedOptions returns options with the values saved for pkg set.
+func withSavedOptions(pkg string, options []PatchOptionsJSON) ([]PatchOptionsJSON, error) {
+	saved, err := loadSavedOptions(pkg)
+	if err != nil {
+		return nil, err
+	}
+	for _, patch := range saved {
+		i := -1
+		for j := range options {
+			if options[j].PatchName == patch.PatchName {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			options = append(options, PatchOptionsJSON{PatchName: patch.PatchName})
+			i = len(options) - 1
+		}
+		for _, option := range patch.Options {
+			setOption(&options[i], option)
+		}
+	}
+	return options, nil
+}
+
+func setOption(patch *PatchOptionsJSON, option OptionsPatch) {
+	for i := range patch.Options {
+		if patch.Options[i].Key == option.Key {
+			patch.Options[i].Value = option.Value
+			return
+		}
+	}
+	patch.Options = append(patch.Options, option)
+}
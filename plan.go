@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PatchPlan holds every input of a patch run. It is built from the current
+// state, can be reviewed and saved, and executePlan runs it as is.
+type PatchPlan struct {
+	CreatedAt   time.Time             `json:"createdAt"`
+	Source      string                `json:"source"`
+	App         string                `json:"app"`
+	Package     string                `json:"package"`
+	Profile     string                `json:"profile"`
+	AppVersion  string                `json:"appVersion"`
+	InputAPK    string                `json:"inputApk"`
+	CLIJar      string                `json:"cliJar"`
+	PatchBundle string                `json:"patchBundle"`
+	OptionsFile string                `json:"optionsFile"`
+	Options     []PatchOptionsJSON    `json:"options"`
+	Patches     PatchSelectionSummary `json:"patches"`
+	OutputPath  string                `json:"outputPath"`
+	Keystore    string                `json:"keystore"`
+	// KeystoreAlias is set when signing with the managed keystore; the
+	// password is read from its config at run time and never saved in plans.
+	KeystoreAlias string `json:"keystoreAlias,omitempty"`
+}
+
+var patchOptionsJsonPath = "patches/gorevancify-patch-options.json"
+
+// planSpec is what a plan is built from, taken from the state of the GUI or
+// from the catalog of a job.
+type planSpec struct {
+	APK        string
+	Source     string
+	Bundle     string
+	App        string
+	Package    string
+	Version    string
+	Profile    string
+	OutputName string
+	Template   string
+	Patches    PatchSelectionSummary
+	Options    []PatchOptionsJSON
+}
+
+// buildPatchPlan assembles a plan from the loaded catalog, the selection and
+// the options of the current app.
+func buildPatchPlan(apk, source, outputName, template string) (*PatchPlan, error) {
+	summary, err := resolvePatchSelection(patchMode, recommendedPatches(), universalPatches(), currentSelection())
+	if err != nil {
+		return nil, err
+	}
+
+	writePatchesOptionsJson()
+	options := copyOptions(patchOptionJson)
+
+	return newPatchPlan(planSpec{
+		APK:        apk,
+		Source:     source,
+		App:        appToPatch,
+		Package:    packageName,
+		Version:    apkDownloadVersion,
+		Profile:    currentProfile,
+		OutputName: outputName,
+		Template:   template,
+		Patches:    summary,
+		Options:    options,
+	})
+}
+
+// newPatchPlan resolves the input APK, the output path and, unless it is
+// set, the latest bundle of spec into a plan. The option values saved for
+// the package override the ones of spec.
+func newPatchPlan(spec planSpec) (*PatchPlan, error) {
+	apk := spec.APK
+	if apk == "" {
+		// Without one, the APK downloaded for the selected version is used.
+		apk = cachedAPK(spec.Package, spec.Version)
+	}
+	if apk == "" {
+		return nil, fmt.Errorf("no APK selected")
+	}
+	if spec.OutputName == "" {
+		return nil, fmt.Errorf("output name not valid")
+	}
+
+	bundle := spec.Bundle
+	if bundle == "" {
+		var err error
+		if bundle, err = getLatestPatchFile(spec.Source); err != nil {
+			return nil, fmt.Errorf("error resolving patch bundle: %v", err)
+		}
+	}
+
+	options, err := withSavedOptions(spec.Package, spec.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	outputName := renderOutputName(spec.Template, map[string]string{
+		"name":    spec.OutputName,
+		"app":     spec.App,
+		"package": spec.Package,
+		"version": spec.Version,
+		"source":  spec.Source,
+		"tag":     bundleTag(bundle),
+		"date":    time.Now().Format("2006-01-02"),
+		"profile": spec.Profile,
+	})
+	outputPath := filepath.Join(outputDir(), outputName+".apk")
+
+	plan := &PatchPlan{
+		CreatedAt:   time.Now(),
+		Source:      spec.Source,
+		App:         spec.App,
+		Package:     spec.Package,
+		Profile:     spec.Profile,
+		AppVersion:  spec.Version,
+		InputAPK:    strings.TrimPrefix(apk, "file://"),
+		CLIJar:      cliSource,
+		PatchBundle: bundle,
+		OptionsFile: patchOptionsJsonPath,
+		Options:     options,
+		Patches:     spec.Patches,
+		OutputPath:  outputPath,
+		Keystore:    strings.TrimSuffix(outputPath, ".apk") + ".keystore",
+	}
+	identity, err := loadSigningIdentity()
+	if err != nil {
+		return nil, err
+	}
+	if identity != nil {
+		plan.Keystore = identity.Keystore
+		plan.KeystoreAlias = identity.Alias
+	}
+	return plan, nil
+}
+
+func (p *PatchPlan) cliArgs() ([]string, error) {
+	args := []string{
+		"-jar", p.CLIJar, "patch",
+		p.InputAPK,
+		"--patches", p.PatchBundle,
+		"--out", p.OutputPath,
+		"-O", p.OptionsFile,
+	}
+	signing, err := signingArgs(p)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, signing...)
+	return append(args, p.Patches.args()...), nil
+}
+
+func (p *PatchPlan) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "App: %s (%s) %s\n", p.App, p.Package, p.AppVersion)
+	fmt.Fprintf(&b, "Input APK: %s\n", p.InputAPK)
+	fmt.Fprintf(&b, "Patch source: %s\n", p.Source)
+	fmt.Fprintf(&b, "Patch bundle: %s\n", p.PatchBundle)
+	fmt.Fprintf(&b, "CLI: %s\n", p.CLIJar)
+	fmt.Fprintf(&b, "Options: %s (%d patches with options)\n", p.OptionsFile, len(p.Options))
+	fmt.Fprintf(&b, "Output: %s\n", p.OutputPath)
+	if p.KeystoreAlias != "" {
+		fmt.Fprintf(&b, "Keystore: %s (alias %s)\n\n", p.Keystore, p.KeystoreAlias)
+	} else {
+		fmt.Fprintf(&b, "Keystore: %s (generated for this run)\n\n", p.Keystore)
+	}
+	b.WriteString(p.Patches.String())
+	return b.String()
+}
+
+func savePlan(plan *PatchPlan, path string) error {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0666)
+}
+
+func loadPlan(path string) (*PatchPlan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var plan PatchPlan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("error unmarshalling plan: %v", err)
+	}
+	return &plan, nil
+}
+
+// executePlan runs the CLI for plan and verifies the output.
+func executePlan(plan *PatchPlan, console *Console) (err error) {
+	if plan.Patches.Mode == modeExclusive && len(plan.Patches.Applied) == 0 {
+		return fmt.Errorf("exclusive mode needs at least one selected patch")
+	}
+	if err := verifyInputCert(plan); err != nil {
+		return err
+	}
+	warnIfPatched(plan)
+
+	args, err := plan.cliArgs()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(plan.OutputPath), 0755); err != nil {
+		return fmt.Errorf("error creating output directory: %v", err)
+	}
+
+	options, err := json.Marshal(plan.Options)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(plan.OptionsFile, options, 0666); err != nil {
+		return fmt.Errorf("error writing options: %v", err)
+	}
+
+	runLog, err := startRunLog(plan.App)
+	if err != nil {
+		return fmt.Errorf("error creating run log: %v", err)
+	}
+	defer runLog.Close()
+	runLog.Info("patch run started", "app", plan.App, "package", plan.Package, "version", plan.AppVersion,
+		"input", plan.InputAPK, "source", plan.Source, "bundle", plan.PatchBundle, "mode", plan.Patches.Mode,
+		"patches", plan.Patches.Applied, "output", plan.OutputPath)
+	logger.Info("patch run started", "app", plan.App, "output", plan.OutputPath, "log", runLog.Path)
+
+	// A previous build at the output path is moved aside so that a failed
+	// run can't pass for it, and put back unless the run succeeds.
+	previous := plan.OutputPath + ".previous"
+	os.Remove(previous)
+	if moveErr := os.Rename(plan.OutputPath, previous); moveErr == nil {
+		defer func() {
+			if err == nil {
+				os.Remove(previous)
+			} else if err := os.Rename(previous, plan.OutputPath); err != nil {
+				logger.Error("restoring the previous output", "path", previous, "err", err)
+			}
+		}()
+	} else if !os.IsNotExist(moveErr) {
+		return fmt.Errorf("error moving the previous output aside: %v", moveErr)
+	}
+
+	startedAt := time.Now()
+	cmd := exec.Command("java", args...)
+	err = runPatchCommand(cmd, console, runLog)
+	deleteTempFiles(plan.OutputPath, console)
+	if err != nil {
+		runLog.Error("patch run failed", "reason", err.Error())
+		return fmt.Errorf("patching failed: %v, see %s", err, runLog.Path)
+	}
+
+	if err := verifyOutputAPK(plan); err != nil {
+		runLog.Error("patch run failed", "reason", err.Error())
+		return fmt.Errorf("patching failed: %v, see %s", err, runLog.Path)
+	}
+	if _, err := writeBuildManifest(plan, startedAt); err != nil {
+		runLog.Error("patch run failed", "reason", "build manifest", "err", err)
+		return fmt.Errorf("error writing build manifest: %v", err)
+	}
+	runLog.Info("patch run finished", "output", plan.OutputPath, "duration", time.Since(startedAt))
+	logger.Info("patch run finished", "output", plan.OutputPath)
+	return nil
+}
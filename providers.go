@@ -0,0 +1,567 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"github.com/PuerkitoBio/goquery"
+)
+
+// ApkProvider gets the APK of a version of an app from somewhere.
+type ApkProvider interface {
+	Name() string
+	// Download saves version of pkg in dest, as an APK or as a bundle of
+	// split APKs.
+	Download(pkg, version, dest string, progress func(done, total int64)) error
+}
+
+// apkCacheDirFor is the folder of the cached APKs of version of pkg.
+func apkCacheDirFor(pkg, version string) string {
+	return filepath.Join(apkCacheDir, sanitizeFileName(pkg), sanitizeFileName(version))
+}
+
+// cachedAPK returns the library APK of version of pkg, or the most recent
+// one cached for it before the library existed, or "".
+func cachedAPK(pkg, version string) string {
+	if pkg == "" || version == "" {
+		return ""
+	}
+	if apk := libraryAPK(pkg, version); apk != "" {
+		return apk
+	}
+	dir := apkCacheDirFor(pkg, version)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	var newest string
+	var newestTime time.Time
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || filepath.Ext(entry.Name()) != ".apk" {
+			continue
+		}
+		info, err := entry.Info()
+		if err == nil && (newest == "" || info.ModTime().After(newestTime)) {
+			newest, newestTime = filepath.Join(dir, entry.Name()), info.ModTime()
+		}
+	}
+	return newest
+}
+
+// splitBundleExt returns the extension APKEditor expects for the bundle at
+// path, or "" when it is a plain APK.
+func splitBundleExt(path string) (string, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	apks := 0
+	ext := ".apkm"
+	for _, f := range r.File {
+		switch {
+		case f.Name == "AndroidManifest.xml":
+			return "", nil
+		case f.Name == "manifest.json":
+			ext = ".xapk"
+		case strings.HasSuffix(f.Name, ".apk"):
+			apks++
+		}
+	}
+	if apks == 0 {
+		return "", fmt.Errorf("neither an APK nor a bundle of APKs")
+	}
+	return ext, nil
+}
+
+// storeDownloadedAPK moves the download part to dest in the cache, merging
+// it first if it is a bundle, once it is known to be pkg, and adds it to the
+// library. It returns the path of the APK, which is the library's when it
+// already had it.
+func storeDownloadedAPK(part, dest, pkg, version, source string) (string, error) {
+	defer os.Remove(part)
+	ext, err := splitBundleExt(part)
+	if err != nil {
+		return "", fmt.Errorf("downloaded file is not valid: %v", err)
+	}
+	if ext != "" {
+		bundle := strings.TrimSuffix(dest, ".apk") + ext
+		if err := os.Rename(part, bundle); err != nil {
+			return "", err
+		}
+		defer os.Remove(bundle)
+		if err := mergeSplits(bundle, part); err != nil {
+			os.Remove(part)
+			return "", err
+		}
+	}
+	info, err := readApkInfo(part)
+	if err != nil {
+		return "", fmt.Errorf("downloaded file is not a valid APK: %v", err)
+	}
+	if info.Package != pkg {
+		return "", fmt.Errorf("downloaded APK is %s, not %s", info.Package, pkg)
+	}
+	if info.VersionName != version {
+		logger.Warn("downloaded version differs", "package", pkg, "want", version, "got", info.VersionName)
+	}
+	if err := os.Rename(part, dest); err != nil {
+		return "", err
+	}
+	logger.Info("downloaded apk", "path", dest)
+	entry, err := addToLibrary(dest, source)
+	if err != nil {
+		logger.Warn("adding apk to library", "path", dest, "err", err)
+		return dest, nil
+	}
+	return entry.Path, nil
+}
+
+// newProvider returns the provider cfg configures for pkg.
+func newProvider(cfg ProviderConfig, pkg string) (ApkProvider, error) {
+	switch cfg.Type {
+	case "apkmirror":
+		var m *ApkMirror
+		var err error
+		if cfg.URL != "" {
+			m, err = newApkMirror(cfg.URL)
+		} else {
+			m, err = defaultApkMirror()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if cfg.ID != "" {
+			m.setAppPath(pkg, "/"+strings.Trim(cfg.ID, "/")+"/")
+		}
+		return &apkMirrorProvider{m}, nil
+	case "apkpure":
+		s, err := newScraper(siteRoot(orDefault(cfg.URL, "https://apkpure.com")))
+		if err != nil {
+			return nil, err
+		}
+		return &apkPureProvider{scraper: s, id: cfg.ID}, nil
+	case "uptodown":
+		id := cfg.ID
+		if id == "" {
+			id = uptodownSlug(dict[pkg])
+		}
+		if id == "" {
+			return nil, fmt.Errorf("uptodown needs the id of %s in the registry", pkg)
+		}
+		base := strings.ReplaceAll(orDefault(cfg.URL, "https://{id}.en.uptodown.com"), "{id}", id)
+		s, err := newScraper(siteRoot(base))
+		if err != nil {
+			return nil, err
+		}
+		return &uptodownProvider{s}, nil
+	case "fdroid":
+		return &fdroidProvider{repo: strings.TrimRight(orDefault(cfg.URL, "https://f-droid.org/repo"), "/")}, nil
+	case "folder":
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("folder provider without a path")
+		}
+		return &folderProvider{dir: cfg.Path}, nil
+	}
+	return nil, fmt.Errorf("unknown APK provider %q", cfg.Type)
+}
+
+// siteRoot makes site end with a slash, so the pages of a site configured
+// under a path are resolved below it.
+func siteRoot(site string) string {
+	return strings.TrimRight(site, "/") + "/"
+}
+
+func orDefault(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+// fetchAPK returns the cached APK of version of pkg, or downloads it from
+// the providers of pkg in the registry, trying each in order until one has
+// it. progress is told the provider being tried.
+func fetchAPK(pkg, version string, progress func(provider string, done, total int64)) (string, error) {
+	if apk := cachedAPK(pkg, version); apk != "" {
+		logger.Info("apk in cache", "path", apk)
+		return apk, nil
+	}
+	registry, err := loadRegistry()
+	if err != nil {
+		return "", err
+	}
+	var errs []string
+	for _, cfg := range registry.providersFor(pkg) {
+		apk, err := fetchFromProvider(cfg, pkg, version, progress)
+		if err == nil {
+			return apk, nil
+		}
+		logger.Warn("apk provider failed", "provider", cfg.Type, "package", pkg, "version", version, "err", err)
+		errs = append(errs, cfg.Type+": "+err.Error())
+	}
+	// Only removed when empty, which it is unless another download is running.
+	os.Remove(apkCacheDirFor(pkg, version))
+	return "", fmt.Errorf("no provider could get %s %s:\n%s", pkg, version, strings.Join(errs, "\n"))
+}
+
+func fetchFromProvider(cfg ProviderConfig, pkg, version string, progress func(provider string, done, total int64)) (string, error) {
+	provider, err := newProvider(cfg, pkg)
+	if err != nil {
+		return "", err
+	}
+	dir := apkCacheDirFor(pkg, version)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	dest := filepath.Join(dir, provider.Name()+".apk")
+	part := dest + ".part"
+	if progress != nil {
+		progress(provider.Name(), 0, -1)
+	}
+	err = provider.Download(pkg, version, part, func(done, total int64) {
+		if progress != nil {
+			progress(provider.Name(), done, total)
+		}
+	})
+	if err != nil {
+		os.Remove(part)
+		return "", err
+	}
+	return storeDownloadedAPK(part, dest, pkg, version, provider.Name())
+}
+
+// apkMirrorProvider downloads the variant pickVariant prefers.
+type apkMirrorProvider struct {
+	m *ApkMirror
+}
+
+func (p *apkMirrorProvider) Name() string { return "apkmirror" }
+
+func (p *apkMirrorProvider) Download(pkg, version, dest string, progress func(done, total int64)) error {
+	variants, err := p.m.Variants(pkg, version)
+	if err != nil {
+		return err
+	}
+	i := pickVariant(variants, apkMirrorPrefs())
+	if i < 0 {
+		return fmt.Errorf("no variant of %s %s fits the device", pkg, version)
+	}
+	return p.m.downloadVariant(variants[i], dest, progress)
+}
+
+// apkPureProvider downloads from the version pages of APKPure, which serve
+// XAPK bundles for split apps.
+type apkPureProvider struct {
+	*scraper
+	id string
+}
+
+func (p *apkPureProvider) Name() string { return "apkpure" }
+
+// appPath returns the path of the APKPure page of pkg, "<slug>/<pkg>", or
+// its absolute path when found by searching.
+func (p *apkPureProvider) appPath(pkg string) (string, error) {
+	if p.id != "" {
+		return strings.Trim(p.id, "/"), nil
+	}
+	doc, err := p.page("search?q="+url.QueryEscape(pkg), "")
+	if err != nil {
+		return "", fmt.Errorf("error searching APKPure for %s: %v", pkg, err)
+	}
+	var path string
+	doc.Find("a[href]").EachWithBreak(func(_ int, a *goquery.Selection) bool {
+		href, _ := a.Attr("href")
+		if u, err := doc.Url.Parse(href); err == nil && strings.HasSuffix(strings.TrimSuffix(u.Path, "/"), "/"+pkg) {
+			path = strings.TrimSuffix(u.Path, "/")
+			return false
+		}
+		return true
+	})
+	if path == "" {
+		return "", fmt.Errorf("%s not found on APKPure", pkg)
+	}
+	return path, nil
+}
+
+func (p *apkPureProvider) Download(pkg, version, dest string, progress func(done, total int64)) error {
+	path, err := p.appPath(pkg)
+	if err != nil {
+		return err
+	}
+	doc, err := p.page(path+"/download/"+url.PathEscape(version), "")
+	if err != nil {
+		return fmt.Errorf("version %s of %s not found on APKPure: %v", version, pkg, err)
+	}
+	var href string
+	for _, selector := range []string{"a#download_link", "a.download-start-btn", `a[href*="d.apkpure"]`} {
+		if h, ok := doc.Find(selector).Attr("href"); ok && h != "" {
+			href = h
+			break
+		}
+	}
+	if href == "" {
+		return fmt.Errorf("no download link on %s", doc.Url)
+	}
+	return p.download(href, doc.Url.String(), dest, progress)
+}
+
+// uptodownProvider downloads from the version list of an app's Uptodown
+// site, which only has the most recent versions.
+type uptodownProvider struct {
+	*scraper
+}
+
+// uptodownFileURL is where Uptodown serves files, by their data-url.
+var uptodownFileURL = "https://dw.uptodown.com/dwn/"
+
+var slugRegexp = regexp.MustCompile(`[^a-z0-9]+`)
+
+// uptodownSlug guesses the Uptodown name of an app from its name.
+func uptodownSlug(name string) string {
+	return strings.Trim(slugRegexp.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+func (p *uptodownProvider) Name() string { return "uptodown" }
+
+func (p *uptodownProvider) Download(pkg, version, dest string, progress func(done, total int64)) error {
+	doc, err := p.page("android/versions", "")
+	if err != nil {
+		return err
+	}
+	var versionPage string
+	doc.Find("[data-url]").EachWithBreak(func(_ int, item *goquery.Selection) bool {
+		if strings.TrimSpace(item.Find(".version").First().Text()) == version {
+			versionPage, _ = item.Attr("data-url")
+			return false
+		}
+		return true
+	})
+	if versionPage == "" {
+		return fmt.Errorf("version %s of %s not found on Uptodown", version, pkg)
+	}
+	page, err := p.page(versionPage, doc.Url.String())
+	if err != nil {
+		return err
+	}
+	file, ok := page.Find("#detail-download-button").Attr("data-url")
+	if !ok {
+		return fmt.Errorf("no download button on %s", page.Url)
+	}
+	if u, err := url.Parse(file); err != nil || !u.IsAbs() {
+		file = uptodownFileURL + file
+	}
+	return p.download(file, page.Url.String(), dest, progress)
+}
+
+func (s *scraper) download(link, referer, dest string, progress func(done, total int64)) error {
+	req, err := s.request(link, referer)
+	if err != nil {
+		return err
+	}
+	return downloadRequest(s.client, req, dest, progress)
+}
+
+// fdroidProvider downloads from an F-Droid repository, checking the hash
+// its index gives.
+type fdroidProvider struct {
+	repo string
+}
+
+func (p *fdroidProvider) Name() string { return "fdroid" }
+
+type fdroidIndex struct {
+	Packages map[string][]struct {
+		VersionName string `json:"versionName"`
+		VersionCode int64  `json:"versionCode"`
+		ApkName     string `json:"apkName"`
+		Hash        string `json:"hash"`
+		HashType    string `json:"hashType"`
+	} `json:"packages"`
+}
+
+// fdroidIndexes caches repository indexes for an hour, they are large.
+var fdroidIndexes = struct {
+	sync.Mutex
+	byRepo map[string]*fdroidIndex
+	loaded map[string]time.Time
+}{byRepo: make(map[string]*fdroidIndex), loaded: make(map[string]time.Time)}
+
+func (p *fdroidProvider) index() (*fdroidIndex, error) {
+	fdroidIndexes.Lock()
+	defer fdroidIndexes.Unlock()
+	if index, ok := fdroidIndexes.byRepo[p.repo]; ok && time.Since(fdroidIndexes.loaded[p.repo]) < time.Hour {
+		return index, nil
+	}
+	resp, err := http.Get(p.repo + "/index-v1.json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error getting the index of %s: %s", p.repo, resp.Status)
+	}
+	var index fdroidIndex
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return nil, fmt.Errorf("error decoding the index of %s: %v", p.repo, err)
+	}
+	fdroidIndexes.byRepo[p.repo] = &index
+	fdroidIndexes.loaded[p.repo] = time.Now()
+	return &index, nil
+}
+
+func (p *fdroidProvider) Download(pkg, version, dest string, progress func(done, total int64)) error {
+	index, err := p.index()
+	if err != nil {
+		return err
+	}
+	packages := index.Packages[pkg]
+	sort.Slice(packages, func(i, j int) bool { return packages[i].VersionCode > packages[j].VersionCode })
+	for _, apk := range packages {
+		if apk.VersionName != version {
+			continue
+		}
+		req, err := http.NewRequest("GET", p.repo+"/"+url.PathEscape(apk.ApkName), nil)
+		if err != nil {
+			return err
+		}
+		if err := downloadRequest(http.DefaultClient, req, dest, progress); err != nil {
+			return err
+		}
+		if apk.HashType != "" && apk.HashType != "sha256" {
+			return nil
+		}
+		sum, err := fileSHA256(dest)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(sum, apk.Hash) {
+			return fmt.Errorf("hash of %s does not match the repository index", apk.ApkName)
+		}
+		return nil
+	}
+	return fmt.Errorf("version %s of %s not found in %s", version, pkg, p.repo)
+}
+
+// folderProvider copies APKs from a local folder, found by their manifest.
+type folderProvider struct {
+	dir string
+}
+
+func (p *folderProvider) Name() string { return "folder" }
+
+func (p *folderProvider) Download(pkg, version, dest string, progress func(done, total int64)) error {
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || filepath.Ext(entry.Name()) != ".apk" {
+			continue
+		}
+		path := filepath.Join(p.dir, entry.Name())
+		info, err := readApkInfo(path)
+		if err != nil || info.Package != pkg || info.VersionName != version {
+			continue
+		}
+		return copyFile(path, dest, 0644)
+	}
+	return fmt.Errorf("version %s of %s not found in %s", version, pkg, p.dir)
+}
+
+// showDownloadApkDialog gets version of app from the providers of the
+// registry, in order or from the one picked, and passes its path to
+// onDownloaded. Picking ApkMirror lets the user choose the variant.
+func showDownloadApkDialog(w fyne.Window, app, version string, onDownloaded func(apk string)) {
+	pkg := getPackageNamesByAppName(app)
+	if apk := cachedAPK(pkg, version); apk != "" {
+		onDownloaded(apk)
+		dialog.ShowInformation("Download APK", app+" "+version+" is already downloaded:\n"+apk, w)
+		return
+	}
+	registry, err := loadRegistry()
+	if err != nil {
+		dialog.ShowError(err, w)
+		return
+	}
+	const inOrder = "All, in order"
+	options := []string{inOrder}
+	configs := registry.providersFor(pkg)
+	for _, cfg := range configs {
+		options = append(options, cfg.Type)
+	}
+	choice := widget.NewRadioGroup(options, nil)
+	choice.SetSelected(inOrder)
+
+	dialog.ShowCustomConfirm("Download "+app+" "+version, "Download", "Cancel", container.NewVBox(
+		widget.NewLabel("Provider"),
+		choice,
+	), func(ok bool) {
+		if !ok || choice.Selected == "" {
+			return
+		}
+		if choice.Selected == "apkmirror" {
+			showApkMirrorDialog(w, app, version, onDownloaded)
+			return
+		}
+
+		bar := widget.NewProgressBar()
+		status := widget.NewLabel("Downloading " + app + " " + version)
+		progress := dialog.NewCustomWithoutButtons("Download APK", container.NewVBox(status, bar), w)
+		progress.Resize(fyne.NewSize(450, 150))
+		progress.Show()
+		go func() {
+			var shown int64
+			update := func(provider string, done, total int64) {
+				if done != 0 && done-shown < 256<<10 && done != total {
+					return
+				}
+				shown = done
+				fyne.Do(func() {
+					if total > 0 {
+						bar.SetValue(float64(done) / float64(total))
+					}
+					status.SetText(fmt.Sprintf("Downloading %s %s from %s\n%.1f MB", app, version, provider, float64(done)/(1<<20)))
+				})
+			}
+			var apk string
+			var err error
+			if choice.Selected == inOrder {
+				apk, err = fetchAPK(pkg, version, update)
+			} else {
+				for _, cfg := range configs {
+					if cfg.Type == choice.Selected {
+						apk, err = fetchFromProvider(cfg, pkg, version, update)
+						break
+					}
+				}
+			}
+			fyne.Do(func() {
+				progress.Hide()
+				if err != nil {
+					dialog.ShowConfirm("Download APK", err.Error()+"\n\nOpen the ApkMirror search in the browser?", func(ok bool) {
+						if ok {
+							openBrowser(apkMirrorSearchURL(app, version))
+						}
+					}, w)
+					return
+				}
+				onDownloaded(apk)
+			})
+		}()
+	}, w)
+}
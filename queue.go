@@ -0,0 +1,643 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+var queueDir = "patches/queue"
+
+// JobStatus is the state of a BatchJob.
+type JobStatus string
+
+const (
+	jobQueued  JobStatus = "Queued"
+	jobRunning JobStatus = "Running"
+	jobDone    JobStatus = "Done"
+	jobFailed  JobStatus = "Failed"
+)
+
+// JobSpec describes a job of the queue. Empty fields take the same defaults
+// as the plan command: the app name as output name, the default mode, the
+// recommended preset and the configured output template.
+type JobSpec struct {
+	APK      string `json:"apk"`
+	Source   string `json:"source"`
+	App      string `json:"app"`
+	Version  string `json:"version,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Mode     string `json:"mode,omitempty"`
+	Profile  string `json:"profile,omitempty"`
+	Template string `json:"template,omitempty"`
+}
+
+// BatchJob is a plan waiting in or run by the queue. Each job has its own
+// console and options file so that jobs can run side by side.
+type BatchJob struct {
+	ID         int
+	Plan       *PatchPlan
+	Status     JobStatus
+	Err        error
+	Console    *Console
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+func (j BatchJob) String() string {
+	s := fmt.Sprintf("#%d  %s %s  |  %s  |  %s  |  %s", j.ID, j.Plan.App, j.Plan.AppVersion, j.Plan.Source, j.Plan.Profile, j.Status)
+	switch j.Status {
+	case jobRunning:
+		s += " " + time.Since(j.StartedAt).Round(time.Second).String()
+	case jobDone:
+		s += "  |  " + filepath.Base(j.Plan.OutputPath)
+	case jobFailed:
+		s += "  |  " + j.Err.Error()
+	}
+	return s
+}
+
+// limiter bounds how many holders run at once. Unlike a buffered channel it
+// can be resized while in use.
+type limiter struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	used int
+	max  int
+}
+
+func newLimiter(max int) *limiter {
+	l := &limiter{max: max}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+func (l *limiter) acquire() {
+	l.mu.Lock()
+	for l.used >= l.max {
+		l.cond.Wait()
+	}
+	l.used++
+	l.mu.Unlock()
+}
+
+func (l *limiter) release() {
+	l.mu.Lock()
+	l.used--
+	l.cond.Broadcast()
+	l.mu.Unlock()
+}
+
+func (l *limiter) setMax(max int) {
+	l.mu.Lock()
+	l.max = max
+	l.cond.Broadcast()
+	l.mu.Unlock()
+}
+
+// jvmSlots limits the number of CLI processes, which each take a JVM worth
+// of memory, across the queue and single runs.
+var jvmSlots = newLimiter(2)
+
+func intSetting(key string, def int) int {
+	n, err := strconv.Atoi(readSetting(key, strconv.Itoa(def)))
+	if err != nil || n < 1 {
+		return def
+	}
+	return n
+}
+
+func maxJVMs() int {
+	return intSetting("maxJVMs", 2)
+}
+
+func queueParallelism() int {
+	return intSetting("queueParallelism", 2)
+}
+
+// JobQueue runs jobs in the order they were added, at most parallelism at a
+// time. Jobs writing the same output wait for each other.
+type JobQueue struct {
+	mu          sync.Mutex
+	cond        *sync.Cond
+	jobs        []*BatchJob
+	nextID      int
+	parallelism int
+	version     int
+}
+
+func newJobQueue(parallelism int) *JobQueue {
+	q := &JobQueue{nextID: 1, parallelism: parallelism}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+var jobQueue = newJobQueue(2)
+
+// planForJob builds the plan of spec without changing what the GUI shows.
+// Jobs get the default options of their bundle, with the values saved for
+// their app instead where there are any. Jobs without an APK get the one of
+// their version from the APK providers.
+func planForJob(spec JobSpec) (*PatchPlan, error) {
+	if spec.Name == "" {
+		spec.Name = spec.App
+	}
+	if spec.Mode == "" {
+		spec.Mode = string(modeDefaultsChanges)
+	}
+	if spec.Profile == "" {
+		spec.Profile = presetRecommended
+	}
+	if spec.Template == "" {
+		spec.Template = outputTemplate()
+	}
+	if spec.APK == "" && spec.Version != "" {
+		apk, err := fetchAPK(getPackageNamesByAppName(spec.App), spec.Version, nil)
+		if err != nil {
+			return nil, err
+		}
+		spec.APK = apk
+	}
+
+	return planFromFlags(spec.Source, spec.App, spec.Version, spec.APK, spec.Name, spec.Mode, spec.Profile, spec.Template)
+}
+
+func loadJobSpecs(path string) ([]JobSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var specs []JobSpec
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return nil, fmt.Errorf("error unmarshalling jobs: %v", err)
+	}
+	return specs, nil
+}
+
+// Add queues plan. The plan gets its own options file so that it doesn't
+// race with other jobs.
+func (q *JobQueue) Add(plan *PatchPlan) (*BatchJob, error) {
+	if err := os.MkdirAll(queueDir, 0755); err != nil {
+		return nil, err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job := &BatchJob{ID: q.nextID, Plan: plan, Status: jobQueued, Console: newConsole(consoleMaxLines)}
+	q.nextID++
+	plan.OptionsFile = filepath.Join(queueDir, fmt.Sprintf("job-%d-options.json", job.ID))
+	q.jobs = append(q.jobs, job)
+	q.changed()
+	return job, nil
+}
+
+// Retry queues a failed job again.
+func (q *JobQueue) Retry(id int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job := q.find(id)
+	if job == nil || job.Status != jobFailed {
+		return fmt.Errorf("job %d has not failed", id)
+	}
+	job.Status = jobQueued
+	job.Err = nil
+	job.Console.Write(streamApp, "Retrying")
+	q.changed()
+	return nil
+}
+
+// Remove drops a job that is not running.
+func (q *JobQueue) Remove(id int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, job := range q.jobs {
+		if job.ID != id {
+			continue
+		}
+		if job.Status == jobRunning {
+			return fmt.Errorf("job %d is running", id)
+		}
+		os.Remove(job.Plan.OptionsFile)
+		q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+		q.changed()
+		return nil
+	}
+	return fmt.Errorf("job %d not found", id)
+}
+
+// ClearFinished drops the jobs that are done.
+func (q *JobQueue) ClearFinished() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var jobs []*BatchJob
+	for _, job := range q.jobs {
+		if job.Status == jobDone {
+			os.Remove(job.Plan.OptionsFile)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	q.jobs = jobs
+	q.changed()
+}
+
+func (q *JobQueue) SetParallelism(n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.parallelism = n
+	q.changed()
+}
+
+// Jobs returns a copy of the jobs and the version of the queue.
+func (q *JobQueue) Jobs() ([]BatchJob, int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := make([]BatchJob, len(q.jobs))
+	for i, job := range q.jobs {
+		jobs[i] = *job
+	}
+	return jobs, q.version
+}
+
+// Wait blocks until no job is queued or running.
+func (q *JobQueue) Wait() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.pending() {
+		q.cond.Wait()
+	}
+}
+
+func (q *JobQueue) pending() bool {
+	for _, job := range q.jobs {
+		if job.Status == jobQueued || job.Status == jobRunning {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *JobQueue) find(id int) *BatchJob {
+	for _, job := range q.jobs {
+		if job.ID == id {
+			return job
+		}
+	}
+	return nil
+}
+
+// changed starts the jobs that can run and wakes up waiters. It must be
+// called with q.mu held.
+func (q *JobQueue) changed() {
+	q.version++
+	running := 0
+	outputs := make(map[string]bool)
+	for _, job := range q.jobs {
+		if job.Status == jobRunning {
+			running++
+			outputs[job.Plan.OutputPath] = true
+		}
+	}
+	for _, job := range q.jobs {
+		if running >= q.parallelism {
+			break
+		}
+		if job.Status != jobQueued || outputs[job.Plan.OutputPath] {
+			continue
+		}
+		job.Status = jobRunning
+		job.StartedAt = time.Now()
+		outputs[job.Plan.OutputPath] = true
+		running++
+		go q.run(job)
+	}
+	q.cond.Broadcast()
+}
+
+func (q *JobQueue) run(job *BatchJob) {
+	job.Console.Write(streamApp, fmt.Sprintf("Patching %s %s", job.Plan.App, job.Plan.AppVersion))
+	if err := savePreviousRun(job.Plan.Package, job.Plan.Patches.Applied); err != nil {
+		logger.Error("saving previous run", "job", job.ID, "err", err)
+	}
+	err := executePlan(job.Plan, job.Console)
+	if err != nil {
+		job.Console.Write(streamApp, "ERROR: "+err.Error())
+		logger.Error("queued job failed", "job", job.ID, "app", job.Plan.App, "err", err)
+	} else {
+		job.Console.Write(streamApp, "APK patched successfully: "+job.Plan.OutputPath)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job.FinishedAt = time.Now()
+	job.Err = err
+	job.Status = jobDone
+	if err != nil {
+		job.Status = jobFailed
+	}
+	q.changed()
+}
+
+// showAddJobDialog asks for a job spec and queues its plan.
+func showAddJobDialog(w fyne.Window) {
+	apkEntry := widget.NewEntry()
+	apkEntry.SetPlaceHolder("Input APK")
+	browseButton := widget.NewButton("Browse...", func() {
+		fd := dialog.NewFileOpen(func(file fyne.URIReadCloser, err error) {
+			if err != nil || file == nil {
+				return
+			}
+			file.Close()
+			apkEntry.SetText(file.URI().Path())
+		}, w)
+		fd.Resize(fyne.NewSize(800, 700))
+		fd.Show()
+	})
+
+	var apps []string
+	for _, name := range dict {
+		apps = append(apps, name)
+	}
+	sort.Strings(apps)
+
+	profileSelect := widget.NewSelect([]string{presetRecommended, presetNone}, nil)
+	profileSelect.SetSelected(presetRecommended)
+	appSelect := widget.NewSelect(apps, func(app string) {
+		profileSelect.Options = presetNames(getPackageNamesByAppName(app))
+		profileSelect.Refresh()
+	})
+	sourceSelect := widget.NewSelect(orgNames, nil)
+	versionEntry := widget.NewEntry()
+	versionEntry.SetPlaceHolder("Version of the APK")
+	modeSelect := widget.NewSelect(patchModes, nil)
+	modeSelect.SetSelected(string(modeDefaultsChanges))
+	templateEntry := widget.NewEntry()
+	templateEntry.SetText(outputTemplate())
+
+	dialog.ShowForm("Add job", "Add", "Cancel", []*widget.FormItem{
+		widget.NewFormItem("APK", container.NewBorder(nil, nil, nil, browseButton, apkEntry)),
+		widget.NewFormItem("Source", sourceSelect),
+		widget.NewFormItem("App", appSelect),
+		widget.NewFormItem("Version", versionEntry),
+		widget.NewFormItem("Mode", modeSelect),
+		widget.NewFormItem("Profile", profileSelect),
+		widget.NewFormItem("File name", templateEntry),
+	}, func(ok bool) {
+		if !ok {
+			return
+		}
+		spec := JobSpec{
+			APK:      apkEntry.Text,
+			Source:   sourceSelect.Selected,
+			App:      appSelect.Selected,
+			Version:  versionEntry.Text,
+			Mode:     modeSelect.Selected,
+			Profile:  profileSelect.Selected,
+			Template: templateEntry.Text,
+		}
+		queueJobSpecs([]JobSpec{spec}, w)
+	}, w)
+}
+
+// queueJobSpecs builds the plans of specs in the background and queues them.
+func queueJobSpecs(specs []JobSpec, w fyne.Window) {
+	progress := dialog.NewCustomWithoutButtons("Add jobs", widget.NewProgressBarInfinite(), w)
+	progress.Show()
+	go func() {
+		defer fyne.Do(progress.Hide)
+		var errs []string
+		for _, spec := range specs {
+			plan, err := planForJob(spec)
+			if err == nil {
+				_, err = jobQueue.Add(plan)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", spec.App, err))
+			}
+		}
+		if len(errs) > 0 {
+			fyne.Do(func() { dialog.ShowError(fmt.Errorf("%s", strings.Join(errs, "\n")), w) })
+		}
+	}()
+}
+
+func showJobLog(job BatchJob, w fyne.Window) {
+	done := make(chan struct{})
+	view := container.NewGridWrap(fyne.NewSize(760, 450), newConsoleView(job.Console, w, done))
+	logDialog := dialog.NewCustom(fmt.Sprintf("Job #%d: %s", job.ID, job.Plan.App), "close", view, w)
+	logDialog.SetOnClosed(func() { close(done) })
+	logDialog.Show()
+}
+
+func newQueueTab(w fyne.Window) fyne.CanvasObject {
+	var jobs []BatchJob
+	var mu sync.Mutex
+	selected := -1
+
+	list := widget.NewList(
+		func() int {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(jobs)
+		},
+		func() fyne.CanvasObject {
+			return widget.NewLabel("")
+		},
+		func(id widget.ListItemID, item fyne.CanvasObject) {
+			mu.Lock()
+			job := jobs[id]
+			mu.Unlock()
+			item.(*widget.Label).SetText(job.String())
+		},
+	)
+	list.OnSelected = func(id widget.ListItemID) {
+		selected = id
+	}
+
+	// Jobs change from their own goroutines, the list is only refreshed
+	// from this one.
+	go func() {
+		seen := -1
+		for range time.Tick(500 * time.Millisecond) {
+			snapshot, version := jobQueue.Jobs()
+			if version == seen && !jobsRunning(snapshot) {
+				continue
+			}
+			seen = version
+			fyne.Do(func() {
+				mu.Lock()
+				jobs = snapshot
+				mu.Unlock()
+				list.Refresh()
+			})
+		}
+	}()
+
+	current := func() (BatchJob, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if selected < 0 || selected >= len(jobs) {
+			dialog.ShowInformation("Error", "No job selected", w)
+			return BatchJob{}, false
+		}
+		return jobs[selected], true
+	}
+
+	counts := []string{"1", "2", "3", "4", "6", "8"}
+	parallelSelect := widget.NewSelect(counts, nil)
+	parallelSelect.SetSelected(strconv.Itoa(queueParallelism()))
+	parallelSelect.OnChanged = func(selected string) {
+		n, _ := strconv.Atoi(selected)
+		jobQueue.SetParallelism(n)
+		if err := writeSetting("queueParallelism", selected); err != nil {
+			logger.Error("writing settings", "err", err)
+		}
+	}
+	jvmSelect := widget.NewSelect(counts, nil)
+	jvmSelect.SetSelected(strconv.Itoa(maxJVMs()))
+	jvmSelect.OnChanged = func(selected string) {
+		n, _ := strconv.Atoi(selected)
+		jvmSlots.setMax(n)
+		if err := writeSetting("maxJVMs", selected); err != nil {
+			logger.Error("writing settings", "err", err)
+		}
+	}
+
+	addButton := widget.NewButton("Add job...", func() {
+		showAddJobDialog(w)
+	})
+
+	loadButton := widget.NewButton("Load jobs...", func() {
+		fd := dialog.NewFileOpen(func(file fyne.URIReadCloser, err error) {
+			if err != nil || file == nil {
+				return
+			}
+			file.Close()
+			specs, err := loadJobSpecs(file.URI().Path())
+			if err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
+			queueJobSpecs(specs, w)
+		}, w)
+		fd.Resize(fyne.NewSize(800, 700))
+		fd.Show()
+	})
+
+	logButton := widget.NewButton("Show log", func() {
+		if job, ok := current(); ok {
+			showJobLog(job, w)
+		}
+	})
+
+	retryButton := widget.NewButton("Retry", func() {
+		if job, ok := current(); ok {
+			if err := jobQueue.Retry(job.ID); err != nil {
+				dialog.ShowError(err, w)
+			}
+		}
+	})
+
+	removeButton := widget.NewButton("Remove", func() {
+		if job, ok := current(); ok {
+			if err := jobQueue.Remove(job.ID); err != nil {
+				dialog.ShowError(err, w)
+			}
+			list.UnselectAll()
+			selected = -1
+		}
+	})
+
+	revealButton := widget.NewButton("Reveal", func() {
+		job, ok := current()
+		if !ok {
+			return
+		}
+		if job.Status != jobDone {
+			dialog.ShowInformation("Error", "The job has no output yet", w)
+			return
+		}
+		if err := revealFile(job.Plan.OutputPath); err != nil {
+			dialog.ShowError(err, w)
+		}
+	})
+
+	clearButton := widget.NewButton("Clear finished", func() {
+		jobQueue.ClearFinished()
+		list.UnselectAll()
+		selected = -1
+	})
+
+	var apiServer *APIServer
+	apiLabel := widget.NewLabel("")
+	apiCheck := widget.NewCheck("Local API", func(checked bool) {
+		if err := writeSetting("apiEnabled", strconv.FormatBool(checked)); err != nil {
+			logger.Error("writing settings", "err", err)
+		}
+		if !checked {
+			if apiServer != nil {
+				apiServer.Stop()
+				apiServer = nil
+			}
+			apiLabel.SetText("")
+			return
+		}
+		server, err := startAPI(apiAddr(), jobQueue)
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		apiServer = server
+		apiLabel.SetText("http://" + apiAddr() + "/api/")
+	})
+	copyTokenButton := widget.NewButton("Copy token", func() {
+		token, err := apiToken()
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		w.Clipboard().SetContent(token)
+	})
+	apiCheck.SetChecked(readSetting("apiEnabled", "false") == "true")
+
+	listScroller := container.NewVScroll(list)
+	listScroller.SetMinSize(fyne.NewSize(100, 400))
+
+	return container.NewVBox(
+		container.New(&horizontalCustomLayout{
+			widths:  []float32{130, 70, 130, 70, 190, 190},
+			heights: []float32{40, 40, 40, 40, 40, 40},
+			tabbing: []float32{5, 10, 5, 10, 5, 0},
+		}, widget.NewLabel("Parallel jobs"), parallelSelect, widget.NewLabel("Max JVMs"), jvmSelect, addButton, loadButton),
+		container.New(&horizontalCustomLayout{
+			widths:  []float32{150, 480, 160},
+			heights: []float32{40, 40, 40},
+			tabbing: []float32{5, 5, 0},
+		}, apiCheck, apiLabel, copyTokenButton),
+		listScroller,
+		container.New(&horizontalCustomLayout{
+			widths:  []float32{155, 155, 155, 155, 155},
+			heights: []float32{50, 50, 50, 50, 50},
+			tabbing: []float32{5, 5, 5, 5, 0},
+		}, logButton, retryButton, removeButton, revealButton, clearButton),
+	)
+}
+
+func jobsRunning(jobs []BatchJob) bool {
+	for _, job := range jobs {
+		if job.Status == jobRunning {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+var registryPath = "patches/registry.json"
+
+// Registry is the on-disk format of registryPath: what GoRevancify knows
+// about each app, by package name, beyond what the patches say.
+type Registry struct {
+	// DefaultProviders are tried for apps without providers of their own.
+	DefaultProviders []ProviderConfig   `json:"defaultProviders,omitempty"`
+	Apps             map[string]AppInfo `json:"apps,omitempty"`
+}
+
+// AppInfo is the registry entry of an app.
+type AppInfo struct {
+	Name      string           `json:"name,omitempty"`
+	Providers []ProviderConfig `json:"providers,omitempty"`
+	// Certificates are the SHA-256 digests of the publisher's signing
+	// certificates, as apksigner verify --print-certs shows them.
+	Certificates []string `json:"certificates,omitempty"`
+}
+
+// ProviderConfig configures an APK provider for an app. Type is one of
+// apkmirror, apkpure, uptodown, fdroid and folder. ID is the provider's
+// name for the app when it can't be found by package name, URL replaces
+// the provider's site or repository and Path is the folder of a folder
+// provider.
+type ProviderConfig struct {
+	Type string `json:"type"`
+	ID   string `json:"id,omitempty"`
+	URL  string `json:"url,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+var defaultProviders = []ProviderConfig{
+	{Type: "apkmirror"},
+	{Type: "apkpure"},
+	{Type: "uptodown"},
+}
+
+// loadRegistry reads registryPath. Without one, every app uses the default
+// providers.
+func loadRegistry() (*Registry, error) {
+	registry := &Registry{}
+	data, err := os.ReadFile(registryPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, registry); err != nil {
+			return nil, fmt.Errorf("error unmarshalling registry: %v", err)
+		}
+	}
+	if len(registry.DefaultProviders) == 0 {
+		registry.DefaultProviders = defaultProviders
+	}
+	if registry.Apps == nil {
+		registry.Apps = make(map[string]AppInfo)
+	}
+	return registry, nil
+}
+
+// providersFor returns the providers to try for pkg, in order.
+func (r *Registry) providersFor(pkg string) []ProviderConfig {
+	if app, ok := r.Apps[pkg]; ok && len(app.Providers) > 0 {
+		return app.Providers
+	}
+	return r.DefaultProviders
+}
+
+// appName returns the name of pkg in the registry, or in the app list.
+func (r *Registry) appName(pkg string) string {
+	if app, ok := r.Apps[pkg]; ok && app.Name != "" {
+		return app.Name
+	}
+	if name, ok := dict[pkg]; ok {
+		return name
+	}
+	return pkg
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// patchesRepo is the repository every source releases its bundles from.
+const patchesRepo = "revanced-patches"
+
+// bundleReleasePath is where the GitHub release of bundle is kept, next
+// to it.
+func bundleReleasePath(bundle string) string {
+	return strings.TrimSuffix(bundle, ".rvp") + ".release.json"
+}
+
+func saveBundleRelease(bundle string, release *GitHubRelease) error {
+	data, err := json.MarshalIndent(release, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(bundleReleasePath(bundle), data, 0666)
+}
+
+// loadBundleRelease returns the release of bundle, fetching it by tag for
+// bundles downloaded before releases were kept.
+func loadBundleRelease(source, bundle string) (*GitHubRelease, error) {
+	data, err := os.ReadFile(bundleReleasePath(bundle))
+	if os.IsNotExist(err) {
+		release, err := getReleaseByTag(source, patchesRepo, bundleTag(bundle))
+		if err != nil {
+			return nil, fmt.Errorf("error getting release %s: %v", bundleTag(bundle), err)
+		}
+		if err := saveBundleRelease(bundle, release); err != nil {
+			logger.Warn("saving release notes", "path", bundleReleasePath(bundle), "err", err)
+		}
+		return release, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var release GitHubRelease
+	if err := json.Unmarshal(data, &release); err != nil {
+		return nil, fmt.Errorf("error unmarshalling release of %s: %v", bundle, err)
+	}
+	return &release, nil
+}
+
+// favoriteApps are the apps whose changes are highlighted in release notes,
+// kept comma separated in the favoriteApps setting.
+func favoriteApps() []string {
+	var apps []string
+	for _, app := range strings.Split(readSetting("favoriteApps", ""), ",") {
+		if app = strings.TrimSpace(app); app != "" {
+			apps = append(apps, app)
+		}
+	}
+	return apps
+}
+
+func setFavoriteApps(apps []string) error {
+	return writeSetting("favoriteApps", strings.Join(apps, ","))
+}
+
+// ReleaseHighlights are the parts of a release that need attention.
+type ReleaseHighlights struct {
+	Breaking    []string
+	Mentions    []string
+	NewVersions []VersionChange
+}
+
+var (
+	headingRegexp = regexp.MustCompile(`^#+\s*(.*)$`)
+	bulletRegexp  = regexp.MustCompile(`^\s*[-*+]\s+`)
+)
+
+// breakingChanges returns the lines of the "Breaking changes" sections of
+// notes, and any other line that says it is one.
+func breakingChanges(notes string) []string {
+	var found []string
+	inSection := false
+	for _, line := range strings.Split(notes, "\n") {
+		line = strings.TrimSpace(line)
+		if match := headingRegexp.FindStringSubmatch(line); match != nil {
+			inSection = strings.Contains(strings.ToLower(match[1]), "breaking")
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		if inSection || strings.Contains(strings.ToLower(line), "breaking change") {
+			found = append(found, bulletRegexp.ReplaceAllString(line, ""))
+		}
+	}
+	return found
+}
+
+// appMentions returns the lines of notes that name one of apps, such as the
+// "**youtube:**" scopes of the ReVanced changelogs.
+func appMentions(notes string, apps []string) []string {
+	var found []string
+	for _, line := range strings.Split(notes, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || headingRegexp.MatchString(line) {
+			continue
+		}
+		lower := strings.ToLower(line)
+		for _, app := range apps {
+			if strings.Contains(lower, strings.ToLower(app)) {
+				found = append(found, bulletRegexp.ReplaceAllString(line, ""))
+				break
+			}
+		}
+	}
+	return found
+}
+
+// releaseHighlights collects the breaking changes of release, the lines
+// naming favorite apps and the versions of favorite apps supported since
+// the bundle before it.
+func releaseHighlights(source, bundle string, release *GitHubRelease) ReleaseHighlights {
+	favorites := favoriteApps()
+	highlights := ReleaseHighlights{
+		Breaking: breakingChanges(release.Body),
+		Mentions: appMentions(release.Body, favorites),
+	}
+	if len(favorites) == 0 {
+		return highlights
+	}
+	previous := previousBundle(source, bundle)
+	if previous == "" {
+		return highlights
+	}
+	diff, err := diffBundles(source, previous, bundle)
+	if err != nil {
+		logger.Warn("comparing bundles", "old", previous, "new", bundle, "err", err)
+		return highlights
+	}
+	for _, change := range diff.Versions {
+		for _, app := range favorites {
+			if change.App == app && (len(change.Added) > 0 || change.NewAny) {
+				highlights.NewVersions = append(highlights.NewVersions, change)
+			}
+		}
+	}
+	return highlights
+}
+
+// Segments renders the highlights, or nothing when there are none.
+func (h ReleaseHighlights) Segments() []widget.RichTextSegment {
+	var segments []widget.RichTextSegment
+	section := func(title string, color fyne.ThemeColorName, items []string) {
+		if len(items) == 0 {
+			return
+		}
+		segments = append(segments, &widget.TextSegment{Text: title, Style: widget.RichTextStyle{
+			ColorName: color,
+			SizeName:  theme.SizeNameSubHeadingText,
+			TextStyle: fyne.TextStyle{Bold: true},
+		}})
+		list := &widget.ListSegment{}
+		for _, item := range items {
+			// Plain text, so the emphasis markers of the notes are dropped.
+			item = strings.NewReplacer("**", "", "__", "", "`", "").Replace(item)
+			list.Items = append(list.Items, &widget.TextSegment{Text: item, Style: widget.RichTextStyleParagraph})
+		}
+		segments = append(segments, list)
+	}
+
+	section("Breaking changes", theme.ColorNameError, h.Breaking)
+	var versions []string
+	for _, change := range h.NewVersions {
+		text := change.App + ": " + strings.Join(change.Added, ", ")
+		if change.NewAny {
+			text = change.App + ": any version"
+		}
+		versions = append(versions, text)
+	}
+	section("Newly supported versions of your apps", theme.ColorNameSuccess, versions)
+	section("Changes to your apps", theme.ColorNamePrimary, h.Mentions)
+	return segments
+}
+
+// showFavoriteAppsDialog edits the apps highlighted in release notes.
+func showFavoriteAppsDialog(w fyne.Window, onChanged func()) {
+	var names []string
+	for _, name := range dict {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	checks := widget.NewCheckGroup(names, nil)
+	checks.SetSelected(favoriteApps())
+	scroll := container.NewVScroll(checks)
+	scroll.SetMinSize(fyne.NewSize(300, 350))
+	dialog.ShowCustomConfirm("Favorite apps", "Save", "Cancel", scroll, func(ok bool) {
+		if !ok {
+			return
+		}
+		if err := setFavoriteApps(checks.Selected); err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		onChanged()
+	}, w)
+}
+
+// newReleasesTab shows the release notes of the downloaded bundles of a
+// source, newest first.
+func newReleasesTab(w fyne.Window) fyne.CanvasObject {
+	var source string
+	var bundles []string
+	var releases = make(map[string]*GitHubRelease)
+	var mu sync.Mutex
+
+	header := widget.NewLabel("")
+	header.Wrapping = fyne.TextWrapWord
+	highlights := widget.NewRichText()
+	highlights.Wrapping = fyne.TextWrapWord
+	notes := widget.NewRichText()
+	notes.Wrapping = fyne.TextWrapWord
+	details := container.NewVScroll(container.NewVBox(header, highlights, widget.NewSeparator(), notes))
+
+	label := func(bundle string) string {
+		mu.Lock()
+		release := releases[bundle]
+		mu.Unlock()
+		if release == nil {
+			return bundleTag(bundle)
+		}
+		text := release.TagName
+		if !release.PublishedAt.IsZero() {
+			text += "  " + release.PublishedAt.Local().Format("2006-01-02")
+		}
+		if release.Prerelease {
+			text += "  (prerelease)"
+		}
+		return text
+	}
+
+	list := widget.NewList(
+		func() int {
+			return len(bundles)
+		},
+		func() fyne.CanvasObject {
+			return widget.NewLabel("")
+		},
+		func(id widget.ListItemID, item fyne.CanvasObject) {
+			item.(*widget.Label).SetText(label(bundles[id]))
+		},
+	)
+
+	// Selections load in the background; only the latest one is shown.
+	var shown int
+	list.OnSelected = func(id widget.ListItemID) {
+		mu.Lock()
+		shown++
+		selection := shown
+		mu.Unlock()
+		bundle := bundles[id]
+		header.SetText("Loading " + bundleTag(bundle) + "...")
+		highlights.Segments = nil
+		highlights.Refresh()
+		notes.ParseMarkdown("")
+		go func() {
+			release, err := loadBundleRelease(source, bundle)
+			var h ReleaseHighlights
+			if err == nil {
+				h = releaseHighlights(source, bundle, release)
+			}
+			if err == nil {
+				mu.Lock()
+				releases[bundle] = release
+				mu.Unlock()
+			}
+			fyne.Do(func() {
+				mu.Lock()
+				current := selection == shown
+				mu.Unlock()
+				if !current {
+					return
+				}
+				if err != nil {
+					header.SetText(err.Error())
+					return
+				}
+				list.RefreshItem(id)
+
+				text := release.Name
+				if text == "" {
+					text = release.TagName
+				}
+				if !release.PublishedAt.IsZero() {
+					text += "\nPublished " + release.PublishedAt.Local().Format("2006-01-02 15:04")
+				}
+				if release.Prerelease {
+					text += "\nThis is a prerelease."
+				}
+				header.SetText(text)
+				highlights.Segments = h.Segments()
+				highlights.Refresh()
+				notes.ParseMarkdown(release.Body)
+			})
+		}()
+	}
+
+	load := func(org string) {
+		source = org
+		bundles, _ = listPatchFiles(org)
+		for i, j := 0, len(bundles)-1; i < j; i, j = i+1, j-1 {
+			bundles[i], bundles[j] = bundles[j], bundles[i]
+		}
+		mu.Lock()
+		for _, bundle := range bundles {
+			if _, ok := releases[bundle]; ok {
+				continue
+			}
+			// Only what is already on disk, the rest is fetched on selection.
+			if data, err := os.ReadFile(bundleReleasePath(bundle)); err == nil {
+				var release GitHubRelease
+				if json.Unmarshal(data, &release) == nil {
+					releases[bundle] = &release
+				}
+			}
+		}
+		mu.Unlock()
+		list.UnselectAll()
+		list.Refresh()
+		header.SetText("")
+		highlights.Segments = nil
+		highlights.Refresh()
+		notes.ParseMarkdown("")
+		if len(bundles) > 0 {
+			list.Select(0)
+		}
+	}
+
+	sourceSelect := widget.NewSelect(orgNames, load)
+	favoritesButton := widget.NewButton("Favorite apps...", func() {
+		showFavoriteAppsDialog(w, func() {
+			if source != "" {
+				load(source)
+			}
+		})
+	})
+	top := container.NewHBox(widget.NewLabel("Source"), sourceSelect, favoritesButton)
+	split := container.NewHSplit(list, details)
+	split.Offset = 0.3
+	if len(orgNames) > 0 {
+		sourceSelect.SetSelected(orgNames[0])
+	}
+	return container.NewBorder(top, nil, nil, nil, split)
+}
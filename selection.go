@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Built-in presets, always offered before the user-saved ones.
+const (
+	presetRecommended = "Recommended (use=true)"
+	presetNone        = "None"
+	presetPreviousRun = "Previous run"
+)
+
+var presetsPath = "patches/presets.json"
+
+// PatchPresets is the on-disk format of presetsPath. Both maps are keyed by
+// package name; Saved holds the user presets by name.
+type PatchPresets struct {
+	PreviousRun map[string][]string            `json:"previousRun"`
+	Saved       map[string]map[string][]string `json:"saved"`
+}
+
+// selectedPatches is the single source of truth for which patches of the
+// current app are selected. The table, the presets and PatchApp all read it.
+var selectedPatches = make(map[string]bool)
+
+// currentProfile is the name of the preset the selection was set from, or
+// "" once the selection no longer matches it. profilePatches is the
+// selection the preset gave.
+var currentProfile string
+var profilePatches []string
+
+// clearDivergedProfile forgets currentProfile when the selection was edited
+// away from its preset.
+func clearDivergedProfile() {
+	if currentProfile == "" {
+		return
+	}
+	selection := currentSelection()
+	if len(selection) != len(profilePatches) || len(missingFrom(selection, profilePatches)) > 0 {
+		currentProfile = ""
+		profilePatches = nil
+	}
+}
+
+func isPatchSelected(name string) bool {
+	return selectedPatches[name]
+}
+
+func setPatchSelected(name string, selected bool) {
+	if selected {
+		selectedPatches[name] = true
+	} else {
+		delete(selectedPatches, name)
+	}
+	clearDivergedProfile()
+}
+
+// applySelection replaces the selection with names, ignoring any patch that
+// is not available for the current app.
+func applySelection(names []string) {
+	selectedPatches = make(map[string]bool)
+	for _, name := range names {
+		for _, available := range patchesNames {
+			if name == available {
+				selectedPatches[name] = true
+				break
+			}
+		}
+	}
+}
+
+func selectAllPatches() {
+	applySelection(patchesNames)
+	clearDivergedProfile()
+}
+
+func unselectAllPatches() {
+	applySelection(nil)
+	clearDivergedProfile()
+}
+
+// currentSelection returns the selected patches in table order.
+func currentSelection() []string {
+	var names []string
+	for _, name := range patchesNames {
+		if selectedPatches[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// recommendedPatches returns the patches of the current app that the bundle
+// marks as use=true.
+func recommendedPatches() []string {
+	var names []string
+	for _, patch := range patches {
+		if len(patch.CompatiblePackages) > 0 && patch.CompatiblePackages[0].Name == packageName && patch.Use {
+			names = append(names, patch.Name)
+		}
+	}
+	return names
+}
+
+// universalPatches returns the patches for any app that the bundle marks as
+// use=true.
+func universalPatches() []string {
+	var names []string
+	for _, patch := range patches {
+		if len(patch.CompatiblePackages) == 0 && patch.Use {
+			names = append(names, patch.Name)
+		}
+	}
+	return names
+}
+
+// presetsMu serializes changes to the presets file, which queued jobs save
+// their previous run to.
+var presetsMu sync.Mutex
+
+func loadPresets() PatchPresets {
+	presets := PatchPresets{
+		PreviousRun: make(map[string][]string),
+		Saved:       make(map[string]map[string][]string),
+	}
+	data, err := os.ReadFile(presetsPath)
+	if err != nil {
+		return presets
+	}
+	if err := json.Unmarshal(data, &presets); err != nil {
+		logger.Error("unmarshalling presets", "path", presetsPath, "err", err)
+	}
+	if presets.PreviousRun == nil {
+		presets.PreviousRun = make(map[string][]string)
+	}
+	if presets.Saved == nil {
+		presets.Saved = make(map[string]map[string][]string)
+	}
+	return presets
+}
+
+func savePresets(presets PatchPresets) error {
+	data, err := json.MarshalIndent(presets, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(presetsPath, data, 0666)
+}
+
+// presetNames lists the presets available for pkg, built-in ones first.
+func presetNames(pkg string) []string {
+	names := []string{presetRecommended, presetNone}
+	presets := loadPresets()
+	if _, ok := presets.PreviousRun[pkg]; ok {
+		names = append(names, presetPreviousRun)
+	}
+	var saved []string
+	for name := range presets.Saved[pkg] {
+		saved = append(saved, name)
+	}
+	sort.Strings(saved)
+	return append(names, saved...)
+}
+
+// presetPatches resolves a preset name to its patch list for pkg, given the
+// recommended patches of pkg.
+func presetPatches(pkg, name string, recommended []string) ([]string, error) {
+	switch name {
+	case presetRecommended:
+		return recommended, nil
+	case presetNone:
+		return nil, nil
+	}
+	presets := loadPresets()
+	if name == presetPreviousRun {
+		if previous, ok := presets.PreviousRun[pkg]; ok {
+			return previous, nil
+		}
+		return nil, fmt.Errorf("no previous run for %s", pkg)
+	}
+	if saved, ok := presets.Saved[pkg][name]; ok {
+		return saved, nil
+	}
+	return nil, fmt.Errorf("preset %q not found", name)
+}
+
+func applyPreset(pkg, name string) error {
+	names, err := presetPatches(pkg, name, recommendedPatches())
+	if err != nil {
+		return err
+	}
+	applySelection(names)
+	currentProfile = name
+	profilePatches = currentSelection()
+	return nil
+}
+
+func saveUserPreset(pkg, name string, names []string) error {
+	presetsMu.Lock()
+	defer presetsMu.Unlock()
+	switch name {
+	case "", presetRecommended, presetNone, presetPreviousRun:
+		return fmt.Errorf("invalid preset name")
+	}
+	presets := loadPresets()
+	if presets.Saved[pkg] == nil {
+		presets.Saved[pkg] = make(map[string][]string)
+	}
+	presets.Saved[pkg][name] = names
+	return savePresets(presets)
+}
+
+func deleteUserPreset(pkg, name string) error {
+	presetsMu.Lock()
+	defer presetsMu.Unlock()
+	presets := loadPresets()
+	if _, ok := presets.Saved[pkg][name]; !ok {
+		return fmt.Errorf("preset %q not found", name)
+	}
+	delete(presets.Saved[pkg], name)
+	return savePresets(presets)
+}
+
+func savePreviousRun(pkg string, names []string) error {
+	presetsMu.Lock()
+	defer presetsMu.Unlock()
+	presets := loadPresets()
+	presets.PreviousRun[pkg] = names
+	return savePresets(presets)
+}
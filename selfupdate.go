@@ -0,0 +1,377 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// The GitHub repository GoRevancify is released from.
+const (
+	selfOrg  = "L-M022"
+	selfRepo = "ApkPatcher"
+)
+
+// compareVersions compares dotted versions such as "2.3" and "v2.10.1"
+// number by number, and returns -1, 0 or 1.
+func compareVersions(a, b string) int {
+	split := func(v string) []string {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+		// Anything after a "-" or "+" (rc1, build metadata) is ignored.
+		if i := strings.IndexAny(v, "-+"); i >= 0 {
+			v = v[:i]
+		}
+		return strings.Split(v, ".")
+	}
+	as, bs := split(a), split(b)
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// checkSelfUpdate returns the latest release of GoRevancify and whether it
+// is newer than the running version.
+func checkSelfUpdate() (*GitHubRelease, bool, error) {
+	release, err := getLatestRelease(selfOrg, selfRepo)
+	if err != nil {
+		return nil, false, fmt.Errorf("error checking for updates: %v", err)
+	}
+	return release, compareVersions(release.TagName, version) > 0, nil
+}
+
+// Names used in asset names for GOOS and GOARCH values.
+var (
+	osAliases = map[string][]string{
+		"windows": {"windows", "win", "win64", "win32"},
+		"darwin":  {"darwin", "macos", "mac", "osx"},
+		"linux":   {"linux"},
+	}
+	archAliases = map[string][]string{
+		"amd64": {"amd64", "x64", "64bit"},
+		"386":   {"386", "x86", "i386", "32bit"},
+		"arm64": {"arm64", "aarch64"},
+		"arm":   {"arm", "armv7"},
+	}
+)
+
+func hasAnyToken(tokens map[string]bool, names []string) bool {
+	for _, name := range names {
+		if tokens[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// fileExtension returns the extension of name, or "" when what follows its
+// last dot is part of a version, as in gorevancify-v2.4-linux-amd64.
+func fileExtension(name string) string {
+	ext := filepath.Ext(name)
+	if strings.ContainsAny(ext, "-_ ") || !strings.ContainsAny(ext, "abcdefghijklmnopqrstuvwxyz") {
+		return ""
+	}
+	return ext
+}
+
+// selfUpdateAsset returns the binary or zip archive of release built for
+// goos and goarch. Builds without a <asset>.sha256 checksum are not used.
+func selfUpdateAsset(release *GitHubRelease, goos, goarch string) (*GitHubAsset, error) {
+	for i, asset := range release.Assets {
+		name := strings.ToLower(asset.Name)
+		ext := fileExtension(name)
+		if ext != "" && ext != ".exe" && ext != ".zip" {
+			continue
+		}
+		name = strings.ReplaceAll(name, "x86_64", "amd64")
+		name = strings.ReplaceAll(name, "x86-64", "amd64")
+		tokens := make(map[string]bool)
+		for _, token := range strings.FieldsFunc(strings.TrimSuffix(name, ext), func(r rune) bool {
+			return r == '-' || r == '_' || r == '.' || r == ' '
+		}) {
+			tokens[token] = true
+		}
+		if !hasAnyToken(tokens, osAliases[goos]) {
+			continue
+		}
+		// A single build per OS doesn't always name its architecture.
+		if hasAnyToken(tokens, archAliases[goarch]) || goarch == "amd64" && !anyArch(tokens) {
+			if release.Asset(asset.Name+".sha256") == nil {
+				return nil, fmt.Errorf("release %s has no checksum for %s, it can't be installed safely", release.TagName, asset.Name)
+			}
+			return &release.Assets[i], nil
+		}
+	}
+	return nil, fmt.Errorf("release %s has no build for %s/%s", release.TagName, goos, goarch)
+}
+
+func anyArch(tokens map[string]bool) bool {
+	for _, names := range archAliases {
+		if hasAnyToken(tokens, names) {
+			return true
+		}
+	}
+	return false
+}
+
+// applySelfUpdate replaces the running executable with asset, and returns
+// the path of the backup of the old one. Running executables can be
+// renamed on every OS, Windows included, so the old binary is moved aside
+// and the new one put in its place; it is used from the next start.
+func applySelfUpdate(release *GitHubRelease, asset *GitHubAsset) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return "", err
+	}
+
+	download := exe + ".download"
+	logger.Info("downloading update", "tag", release.TagName, "asset", asset.Name)
+	if err := DownloadFile(download, mirrorURL(asset.BrowserDownloadURL)); err != nil {
+		os.Remove(download)
+		return "", fmt.Errorf("error downloading update: %v", err)
+	}
+	defer os.Remove(download)
+	if err := verifyReleaseChecksum(release, asset, download); err != nil {
+		return "", err
+	}
+
+	next := exe + ".new"
+	if strings.HasSuffix(strings.ToLower(asset.Name), ".zip") {
+		err = extractExecutable(download, next)
+	} else {
+		err = os.Rename(download, next)
+	}
+	if err != nil {
+		os.Remove(next)
+		return "", fmt.Errorf("error unpacking update: %v", err)
+	}
+	if err := os.Chmod(next, 0755); err != nil {
+		os.Remove(next)
+		return "", err
+	}
+
+	backup := exe + ".bak"
+	os.Remove(backup)
+	if err := os.Rename(exe, backup); err != nil {
+		os.Remove(next)
+		return "", fmt.Errorf("error backing up %s: %v", exe, err)
+	}
+	if err := os.Rename(next, exe); err != nil {
+		os.Rename(backup, exe)
+		os.Remove(next)
+		return "", fmt.Errorf("error replacing %s: %v", exe, err)
+	}
+	logger.Info("updated", "from", version, "to", release.TagName, "path", exe, "backup", backup)
+	return backup, nil
+}
+
+// verifyReleaseChecksum checks path against the <asset>.sha256 file of the
+// release, and fails without one. The release JSON may come from a proxy set
+// with githubApiUrl, so the checksum is only trusted from a release download
+// of selfRepo on github.com, fetched directly rather than through
+// githubMirror: neither a proxy nor a mirror can then serve a build and a
+// checksum that match each other. This needs github.com to be reachable.
+func verifyReleaseChecksum(release *GitHubRelease, asset *GitHubAsset, path string) error {
+	checksum := release.Asset(asset.Name + ".sha256")
+	if checksum == nil {
+		return fmt.Errorf("release %s has no checksum for %s, it can't be installed safely", release.TagName, asset.Name)
+	}
+	u, err := url.Parse(checksum.BrowserDownloadURL)
+	if err != nil || u.Scheme != "https" || u.Host != "github.com" ||
+		!strings.HasPrefix(u.Path, "/"+selfOrg+"/"+selfRepo+"/releases/download/") {
+		return fmt.Errorf("checksum of %s is not a GitHub release download of %s/%s (%s), not updating",
+			asset.Name, selfOrg, selfRepo, checksum.BrowserDownloadURL)
+	}
+	sumPath := path + ".sha256"
+	defer os.Remove(sumPath)
+	if err := DownloadFile(sumPath, u.String()); err != nil {
+		return fmt.Errorf("error downloading checksum from github.com, which self-update needs to reach directly even with githubMirror set: %v", err)
+	}
+	data, err := os.ReadFile(sumPath)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return fmt.Errorf("empty checksum file %s", checksum.Name)
+	}
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(fields[0], sum) {
+		return fmt.Errorf("checksum of %s does not match, the download may be corrupt", asset.Name)
+	}
+	return nil
+}
+
+// extractExecutable writes the executable of the zip archive at path, its
+// largest file, to dest.
+func extractExecutable(path, dest string) error {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var exe *zip.File
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if exe == nil || f.UncompressedSize64 > exe.UncompressedSize64 {
+			exe = f
+		}
+	}
+	if exe == nil {
+		return fmt.Errorf("empty archive")
+	}
+	rc, err := exe.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, rc); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func checkAppUpdateOnStart() bool {
+	return readSetting("checkAppUpdate", "true") == "true"
+}
+
+// checkSelfUpdateOnStart shows the changelog of a new release unless it was
+// skipped. Errors are only logged as nothing was asked for.
+func checkSelfUpdateOnStart(w fyne.Window) {
+	release, newer, err := checkSelfUpdate()
+	if err != nil {
+		logger.Warn("checking for updates", "err", err)
+		return
+	}
+	if !newer || readSetting("skippedAppVersion", "") == release.TagName {
+		return
+	}
+	fyne.Do(func() { showSelfUpdateDialog(release, w) })
+}
+
+// checkSelfUpdateNow checks for a new release on request and tells the
+// outcome either way.
+func checkSelfUpdateNow(w fyne.Window) {
+	progress := dialog.NewCustomWithoutButtons("Check for updates", widget.NewProgressBarInfinite(), w)
+	progress.Show()
+	go func() {
+		release, newer, err := checkSelfUpdate()
+		fyne.Do(func() {
+			progress.Hide()
+			if err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
+			if !newer {
+				dialog.ShowInformation("Check for updates", "GoRevancify "+version+" is the latest version.", w)
+				return
+			}
+			showSelfUpdateDialog(release, w)
+		})
+	}()
+}
+
+// showSelfUpdateDialog shows the changelog of release with buttons to
+// download it or skip it.
+func showSelfUpdateDialog(release *GitHubRelease, w fyne.Window) {
+	title := release.Name
+	if title == "" {
+		title = release.TagName
+	}
+	notes := widget.NewRichTextFromMarkdown(release.Body)
+	notes.Wrapping = fyne.TextWrapWord
+	scroll := container.NewVScroll(notes)
+	scroll.SetMinSize(fyne.NewSize(600, 350))
+
+	header := fmt.Sprintf("GoRevancify %s is available, you have %s.", release.TagName, version)
+	if !release.PublishedAt.IsZero() {
+		header += "\nPublished " + release.PublishedAt.Local().Format("2006-01-02")
+	}
+	content := container.NewBorder(widget.NewLabel(header), nil, nil, nil, scroll)
+
+	updateDialog := dialog.NewCustomWithoutButtons(title, content, w)
+	asset, assetErr := selfUpdateAsset(release, runtime.GOOS, runtime.GOARCH)
+	updateButton := widget.NewButton("Download and replace", func() {
+		updateDialog.Hide()
+		progress := dialog.NewCustomWithoutButtons("Updating", widget.NewProgressBarInfinite(), w)
+		progress.Show()
+		go func() {
+			backup, err := applySelfUpdate(release, asset)
+			fyne.Do(func() {
+				progress.Hide()
+				if err != nil {
+					dialog.ShowError(err, w)
+					return
+				}
+				dialog.ShowInformation("Updated",
+					"GoRevancify "+release.TagName+" is used from the next start.\nThe old version was kept as "+backup, w)
+			})
+		}()
+	})
+	if assetErr != nil {
+		updateButton.Disable()
+		logger.Info("no update for this platform", "err", assetErr)
+	}
+	updateDialog.SetButtons([]fyne.CanvasObject{
+		widget.NewButton("Close", updateDialog.Hide),
+		widget.NewButton("Skip this version", func() {
+			if err := writeSetting("skippedAppVersion", release.TagName); err != nil {
+				logger.Error("writing settings", "err", err)
+			}
+			updateDialog.Hide()
+		}),
+		widget.NewButton("Open release page", func() {
+			if err := openURL(release.HTMLURL); err != nil {
+				dialog.ShowError(err, w)
+			}
+		}),
+		updateButton,
+	})
+	updateDialog.Show()
+}
+
+// openURL opens link in the default browser.
+func openURL(link string) error {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return err
+	}
+	return fyne.CurrentApp().OpenURL(parsed)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+var settingsPath = "settings.txt"
+
+const defaultOutputDir = "apps/patched"
+
+// loadSettingsFile reads the key=value lines of settingsPath.
+func loadSettingsFile() map[string]string {
+	settings := make(map[string]string)
+	data, err := os.ReadFile(settingsPath)
+	if err != nil {
+		return settings
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if ok {
+			settings[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return settings
+}
+
+// readSetting returns the value of key, or def when it is not set.
+func readSetting(key, def string) string {
+	if value, ok := loadSettingsFile()[key]; ok && value != "" {
+		return value
+	}
+	return def
+}
+
+// writeSetting sets key and keeps the other settings as they are.
+func writeSetting(key, value string) error {
+	settings := loadSettingsFile()
+	settings[key] = value
+
+	var keys []string
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%s\n", k, settings[k])
+	}
+	return os.WriteFile(settingsPath, []byte(b.String()), 0644)
+}
+
+// outputDir is where patched APKs and their manifests are written.
+func outputDir() string {
+	return readSetting("outputDir", defaultOutputDir)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// Signature algorithms of the v2 and v3 schemes that can be verified.
+const (
+	sigRSAPSSSHA256   = 0x0101
+	sigRSAPSSSHA512   = 0x0102
+	sigRSAPKCS1SHA256 = 0x0103
+	sigRSAPKCS1SHA512 = 0x0104
+	sigECDSASHA256    = 0x0201
+	sigECDSASHA512    = 0x0202
+)
+
+// sigHash returns the hash of a signature algorithm, or 0 when it isn't
+// supported.
+func sigHash(algorithm uint32) crypto.Hash {
+	switch algorithm {
+	case sigRSAPSSSHA256, sigRSAPKCS1SHA256, sigECDSASHA256:
+		return crypto.SHA256
+	case sigRSAPSSSHA512, sigRSAPKCS1SHA512, sigECDSASHA512:
+		return crypto.SHA512
+	}
+	return 0
+}
+
+// expectedOutput returns the package name and app name the output of plan
+// should have, when the "Change package name" or "Custom branding" patches
+// are applied with them.
+func expectedOutput(plan *PatchPlan) (pkg, name string) {
+	applied := make(map[string]bool)
+	for _, patch := range plan.Patches.Applied {
+		applied[patch] = true
+	}
+	for _, patch := range plan.Options {
+		if !applied[patch.PatchName] {
+			continue
+		}
+		for _, option := range patch.Options {
+			value, ok := option.Value.(string)
+			if !ok || value == "" {
+				continue
+			}
+			switch {
+			case patch.PatchName == "Change package name" && option.Key == "packageName":
+				// The default value stands for the original package with
+				// a suffix.
+				if value == "Default" {
+					value = plan.Package + ".revanced"
+				}
+				pkg = value
+			case patch.PatchName == "Custom branding" && option.Key == "appName":
+				name = value
+			}
+		}
+	}
+	return pkg, name
+}
+
+// verifyOutputAPK checks that the output of plan is a complete, signed APK
+// with the package and app name it was patched to have.
+func verifyOutputAPK(plan *PatchPlan) error {
+	if _, err := os.Stat(plan.OutputPath); os.IsNotExist(err) {
+		return fmt.Errorf("no output written")
+	}
+	pkg, name := expectedOutput(plan)
+	return verifyAPK(plan.OutputPath, pkg, name)
+}
+
+// verifyAPK checks the zip entries and their alignment, the v2 and v3
+// signatures and the manifest of apk, and its package and app name unless
+// they are "".
+func verifyAPK(apk, expectedPackage, expectedName string) error {
+	f, err := os.Open(apk)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	r, err := zip.NewReader(f, stat.Size())
+	if err != nil {
+		return fmt.Errorf("not a valid APK: %v", err)
+	}
+	for _, file := range r.File {
+		if file.Method == zip.Store {
+			offset, err := file.DataOffset()
+			if err != nil {
+				return fmt.Errorf("corrupt entry %s: %v", file.Name, err)
+			}
+			if offset%4 != 0 {
+				return fmt.Errorf("entry %s is not 4-byte aligned", file.Name)
+			}
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return fmt.Errorf("corrupt entry %s: %v", file.Name, err)
+		}
+		_, err = io.Copy(io.Discard, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("corrupt entry %s: %v", file.Name, err)
+		}
+	}
+
+	if err := verifyApkSignature(f, stat.Size()); err != nil {
+		return err
+	}
+
+	data, err := readZipFile(r, "AndroidManifest.xml")
+	if err != nil || data == nil {
+		return fmt.Errorf("no manifest in the APK")
+	}
+	manifest, err := parseAXML(data)
+	if err != nil {
+		return fmt.Errorf("error parsing manifest: %v", err)
+	}
+	if pkg := manifest.Attr("package"); expectedPackage != "" && pkg != expectedPackage {
+		return fmt.Errorf("package name is %s instead of %s", pkg, expectedPackage)
+	}
+	if expectedName != "" {
+		table, err := readResourceTable(r)
+		if err != nil {
+			return fmt.Errorf("error reading resources: %v", err)
+		}
+		label := ""
+		for _, application := range manifest.Find("application") {
+			label = resolveLabel(application, table)
+		}
+		if label != expectedName {
+			return fmt.Errorf("app name is %q instead of %q", label, expectedName)
+		}
+	}
+	return nil
+}
+
+// verifyApkSignature checks every v2 and v3 signer of an APK: its
+// signatures over the signed data, its certificate, and the digests of the
+// APK contents. The APK must have one of the two.
+func verifyApkSignature(f io.ReaderAt, size int64) error {
+	start, centralDir, err := findSigningBlock(f, size)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	if start < 0 {
+		return fmt.Errorf("not signed with APK Signature Scheme v2 or v3")
+	}
+	blocks, err := signingBlockPairs(f, start, centralDir)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	eocd, err := findEOCD(f, size)
+	if err != nil {
+		return err
+	}
+
+	digests := make(map[crypto.Hash][]byte)
+	verified := 0
+	for _, scheme := range []struct {
+		name string
+		id   uint32
+	}{{"v2", apkSigV2BlockID}, {"v3", apkSigV3BlockID}} {
+		value, ok := blocks[scheme.id]
+		if !ok {
+			continue
+		}
+		signers, err := parseApkSigners(value, scheme.id == apkSigV3BlockID)
+		if err != nil {
+			return fmt.Errorf("invalid %s signature: %v", scheme.name, err)
+		}
+		if len(signers) == 0 {
+			return fmt.Errorf("invalid %s signature: no signers", scheme.name)
+		}
+		for _, signer := range signers {
+			if err := verifyApkSigner(signer, func(h crypto.Hash) ([]byte, error) {
+				if digest, ok := digests[h]; ok {
+					return digest, nil
+				}
+				digest, err := apkContentDigest(f, h, start, centralDir, eocd, size)
+				digests[h] = digest
+				return digest, err
+			}); err != nil {
+				return fmt.Errorf("invalid %s signature: %v", scheme.name, err)
+			}
+		}
+		verified++
+	}
+	if verified == 0 {
+		return fmt.Errorf("not signed with APK Signature Scheme v2 or v3")
+	}
+	return nil
+}
+
+// verifyApkSigner checks the supported signatures of signer and the
+// content digests they sign against contentDigest.
+func verifyApkSigner(signer apkSigner, contentDigest func(crypto.Hash) ([]byte, error)) error {
+	if len(signer.Certificates) == 0 {
+		return fmt.Errorf("no certificate")
+	}
+	cert, err := x509.ParseCertificate(signer.Certificates[0])
+	if err != nil {
+		return fmt.Errorf("error parsing certificate: %v", err)
+	}
+	if !bytes.Equal(cert.RawSubjectPublicKeyInfo, signer.PublicKey) {
+		return fmt.Errorf("public key does not match the certificate")
+	}
+
+	// The signed data starts with the digests, by algorithm.
+	list, _, err := lengthPrefixed(signer.SignedData)
+	if err != nil {
+		return err
+	}
+	items, err := lengthPrefixedList(list)
+	if err != nil {
+		return err
+	}
+	signed := make(map[uint32][]byte)
+	for _, item := range items {
+		if len(item) < 4 {
+			return fmt.Errorf("truncated digest")
+		}
+		digest, _, err := lengthPrefixed(item[4:])
+		if err != nil {
+			return err
+		}
+		signed[binary.LittleEndian.Uint32(item)] = digest
+	}
+
+	checked := 0
+	for _, sig := range signer.Signatures {
+		h := sigHash(sig.Algorithm)
+		if h == 0 {
+			continue
+		}
+		if err := verifySignature(cert.PublicKey, sig, h, signer.SignedData); err != nil {
+			return err
+		}
+		digest, ok := signed[sig.Algorithm]
+		if !ok {
+			return fmt.Errorf("no digest for algorithm 0x%04x", sig.Algorithm)
+		}
+		content, err := contentDigest(h)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(digest, content) {
+			return fmt.Errorf("APK contents do not match the signed digest")
+		}
+		checked++
+	}
+	if checked == 0 {
+		return fmt.Errorf("no supported signature algorithm")
+	}
+	return nil
+}
+
+// verifySignature checks sig over data with the public key of a
+// certificate.
+func verifySignature(key any, sig apkSignature, h crypto.Hash, data []byte) error {
+	hasher := h.New()
+	hasher.Write(data)
+	sum := hasher.Sum(nil)
+	switch sig.Algorithm {
+	case sigRSAPSSSHA256, sigRSAPSSSHA512, sigRSAPKCS1SHA256, sigRSAPKCS1SHA512:
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("RSA signature with a non-RSA key")
+		}
+		var err error
+		if sig.Algorithm == sigRSAPSSSHA256 || sig.Algorithm == sigRSAPSSSHA512 {
+			err = rsa.VerifyPSS(pub, h, sum, sig.Signature, &rsa.PSSOptions{SaltLength: h.Size()})
+		} else {
+			err = rsa.VerifyPKCS1v15(pub, h, sum, sig.Signature)
+		}
+		if err != nil {
+			return fmt.Errorf("signature does not verify: %v", err)
+		}
+	case sigECDSASHA256, sigECDSASHA512:
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("ECDSA signature with a non-ECDSA key")
+		}
+		if !ecdsa.VerifyASN1(pub, sum, sig.Signature) {
+			return fmt.Errorf("signature does not verify")
+		}
+	}
+	return nil
+}
+
+// apkContentDigest computes the chunked digest that v2 and v3 signatures
+// sign: the entries, the central directory and the end of central
+// directory, whose central directory offset points at the signing block.
+func apkContentDigest(f io.ReaderAt, h crypto.Hash, start, centralDir, eocd, size int64) ([]byte, error) {
+	end := make([]byte, size-eocd)
+	if _, err := f.ReadAt(end, eocd); err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint32(end[16:], uint32(start))
+	sections := []io.Reader{
+		io.NewSectionReader(f, 0, start),
+		io.NewSectionReader(f, centralDir, eocd-centralDir),
+		bytes.NewReader(end),
+	}
+
+	newHash := func() hash.Hash {
+		if h == crypto.SHA512 {
+			return sha512.New()
+		}
+		return sha256.New()
+	}
+	const chunkSize = 1 << 20
+	var chunks []byte
+	count := 0
+	buf := make([]byte, chunkSize)
+	var prefix [5]byte
+	prefix[0] = 0xa5
+	for _, section := range sections {
+		for {
+			n, err := io.ReadFull(section, buf)
+			if n > 0 {
+				binary.LittleEndian.PutUint32(prefix[1:], uint32(n))
+				chunk := newHash()
+				chunk.Write(prefix[:])
+				chunk.Write(buf[:n])
+				chunks = chunk.Sum(chunks)
+				count++
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	top := newHash()
+	prefix[0] = 0x5a
+	binary.LittleEndian.PutUint32(prefix[1:], uint32(count))
+	top.Write(prefix[:])
+	top.Write(chunks)
+	return top.Sum(nil), nil
+}
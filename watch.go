@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var watchConfigPath = "patches/watch.json"
+var watchStatePath = "patches/watch-state.json"
+
+const defaultWatchInputDir = "apps/watch"
+
+// watchOutputTemplate names the builds of profiles without a template. It
+// has the bundle tag so that a new patch release for the same app version
+// doesn't replace the previous build and its manifest.
+const watchOutputTemplate = defaultOutputTemplate + "-{tag}"
+
+// WatchConfig is the on-disk format of watchConfigPath. Profiles are jobs
+// without an APK; the newest APK of their app in InputDir is used. The
+// intervals are Go durations, "1h" and "1m" by default.
+type WatchConfig struct {
+	ReleaseInterval string    `json:"releaseInterval"`
+	InputInterval   string    `json:"inputInterval"`
+	InputDir        string    `json:"inputDir"`
+	Profiles        []JobSpec `json:"profiles"`
+}
+
+// WatchState records, per profile, the bundle and input APK of its last
+// successful build so that each change is only built once, and the failed
+// attempts at building the current ones.
+type WatchState struct {
+	Built  map[string]string        `json:"built"`
+	Failed map[string]*WatchFailure `json:"failed,omitempty"`
+}
+
+// WatchFailure counts the failed builds of a profile for one bundle and
+// input APK.
+type WatchFailure struct {
+	Build    string    `json:"build"`
+	Attempts int       `json:"attempts"`
+	Retry    time.Time `json:"retry"`
+}
+
+// A failed build is retried after watchRetryDelay, doubled on each
+// failure, and given up after watchMaxAttempts until the bundle or the
+// input APK changes.
+const (
+	watchRetryDelay  = 5 * time.Minute
+	watchMaxAttempts = 5
+)
+
+// shouldBuild reports whether profile should be built for build now.
+func (s *WatchState) shouldBuild(profile, build string, now time.Time) bool {
+	if s.Built[profile] == build {
+		return false
+	}
+	failure := s.Failed[profile]
+	if failure == nil || failure.Build != build {
+		return true
+	}
+	return failure.Attempts < watchMaxAttempts && !now.Before(failure.Retry)
+}
+
+// recordFailure counts a failed build of profile and returns the failure.
+func (s *WatchState) recordFailure(profile, build string, now time.Time) *WatchFailure {
+	failure := s.Failed[profile]
+	if failure == nil || failure.Build != build {
+		failure = &WatchFailure{Build: build}
+		s.Failed[profile] = failure
+	}
+	failure.Attempts++
+	failure.Retry = now.Add(watchRetryDelay << (failure.Attempts - 1))
+	return failure
+}
+
+func (s *WatchState) recordBuild(profile, build string) {
+	s.Built[profile] = build
+	delete(s.Failed, profile)
+}
+
+func loadWatchConfig(path string) (*WatchConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg WatchConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("error unmarshalling watch config: %v", err)
+	}
+	if cfg.InputDir == "" {
+		cfg.InputDir = defaultWatchInputDir
+	}
+	if len(cfg.Profiles) == 0 {
+		return nil, fmt.Errorf("no profiles in %s", path)
+	}
+	for _, spec := range cfg.Profiles {
+		if spec.Template != "" && !strings.Contains(spec.Template, "{tag}") {
+			return nil, fmt.Errorf("template %q of a %s profile in %s has no {tag}, the build of a new patch release would replace the previous one",
+				spec.Template, spec.App, path)
+		}
+	}
+	return &cfg, nil
+}
+
+func parseWatchInterval(value string, def, min time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < min {
+		return 0, fmt.Errorf("interval %q not valid, it must be a duration of at least %s", value, min)
+	}
+	return d, nil
+}
+
+func loadWatchState() *WatchState {
+	state := &WatchState{Built: make(map[string]string), Failed: make(map[string]*WatchFailure)}
+	data, err := os.ReadFile(watchStatePath)
+	if err != nil {
+		return state
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		logger.Error("unmarshalling watch state", "path", watchStatePath, "err", err)
+	}
+	if state.Built == nil {
+		state.Built = make(map[string]string)
+	}
+	if state.Failed == nil {
+		state.Failed = make(map[string]*WatchFailure)
+	}
+	return state
+}
+
+func saveWatchState(state *WatchState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(watchStatePath, data, 0666)
+}
+
+func watchProfileKey(spec JobSpec) string {
+	return strings.Join([]string{spec.Source, spec.App, spec.Name, spec.Mode, spec.Profile, spec.Template}, "|")
+}
+
+// WatchedAPK is an APK found in the input folder.
+type WatchedAPK struct {
+	Path    string
+	Info    *ApkInfo
+	Size    int64
+	ModTime time.Time
+}
+
+// inputHashes caches the SHA-256 of input APKs by path, size and
+// modification time so that unchanged APKs aren't hashed on every check.
+var inputHashes = make(map[string]string)
+
+func (a WatchedAPK) sha256() (string, error) {
+	key := fmt.Sprintf("%s|%d|%d", a.Path, a.Size, a.ModTime.UnixNano())
+	if sum, ok := inputHashes[key]; ok {
+		return sum, nil
+	}
+	sum, err := fileSHA256(a.Path)
+	if err != nil {
+		return "", err
+	}
+	inputHashes[key] = sum
+	return sum, nil
+}
+
+// scanInputDir returns the newest APK of each package in dir, by version
+// code and then by modification time.
+func scanInputDir(dir string) (map[string]WatchedAPK, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	newest := make(map[string]WatchedAPK)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || filepath.Ext(entry.Name()) != ".apk" {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		info, err := readApkInfo(path)
+		if err != nil {
+			// Likely still being copied, it is picked up on the next check.
+			logger.Warn("skipping input APK", "path", path, "err", err)
+			continue
+		}
+		stat, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		apk := WatchedAPK{Path: path, Info: info, Size: stat.Size(), ModTime: stat.ModTime()}
+		current, ok := newest[info.Package]
+		if !ok || info.VersionCode > current.Info.VersionCode ||
+			(info.VersionCode == current.Info.VersionCode && apk.ModTime.After(current.ModTime)) {
+			newest[info.Package] = apk
+		}
+	}
+	return newest, nil
+}
+
+// watchOnce optionally updates the bundles of the watched sources, then
+// queues every profile whose bundle or input APK changed since its last
+// build and waits for them. It returns the number of failed builds.
+func watchOnce(cfg *WatchConfig, state *WatchState, checkReleases bool) int {
+	updated := make(map[string]bool)
+	for _, spec := range cfg.Profiles {
+		if !checkReleases || updated[spec.Source] {
+			continue
+		}
+		updated[spec.Source] = true
+		if path, downloaded, err := updatePatchSource(spec.Source); err != nil {
+			logger.Error("checking for a new patch release", "source", spec.Source, "err", err)
+		} else if downloaded {
+			logger.Info("new patch release", "source", spec.Source, "bundle", path)
+		}
+	}
+
+	apks, err := scanInputDir(cfg.InputDir)
+	if err != nil {
+		logger.Error("reading input folder", "path", cfg.InputDir, "err", err)
+		return 0
+	}
+
+	queue := newJobQueue(0)
+	builds := make(map[int][2]string)
+	failed := 0
+	for _, spec := range cfg.Profiles {
+		pkg := getPackageNamesByAppName(spec.App)
+		apk, ok := apks[pkg]
+		if !ok {
+			logger.Debug("no input APK for profile", "app", spec.App, "package", pkg)
+			continue
+		}
+		bundle, err := getLatestPatchFile(spec.Source)
+		if err != nil {
+			logger.Error("resolving patch bundle", "source", spec.Source, "err", err)
+			continue
+		}
+		sum, err := apk.sha256()
+		if err != nil {
+			logger.Error("hashing input APK", "path", apk.Path, "err", err)
+			continue
+		}
+		profile := watchProfileKey(spec)
+		build := filepath.Base(bundle) + "|" + sum
+		if !state.shouldBuild(profile, build, time.Now()) {
+			continue
+		}
+
+		spec.APK = apk.Path
+		if spec.Version == "" {
+			spec.Version = apk.Info.VersionName
+		}
+		if spec.Template == "" {
+			spec.Template = watchOutputTemplate
+		}
+		logger.Info("building profile", "app", spec.App, "source", spec.Source, "profile", spec.Profile,
+			"apk", apk.Path, "version", spec.Version, "bundle", bundle)
+		plan, err := planForJob(spec)
+		if err != nil {
+			failure := state.recordFailure(profile, build, time.Now())
+			logger.Error("building plan", "app", spec.App, "attempts", failure.Attempts, "retry", failure.Retry, "err", err)
+			failed++
+			continue
+		}
+		job, err := queue.Add(plan)
+		if err != nil {
+			logger.Error("queueing job", "app", spec.App, "err", err)
+			continue
+		}
+		builds[job.ID] = [2]string{profile, build}
+	}
+	if len(builds) == 0 && failed == 0 {
+		logger.Debug("nothing changed")
+		return 0
+	}
+
+	queue.SetParallelism(queueParallelism())
+	queue.Wait()
+
+	jobs, _ := queue.Jobs()
+	for _, job := range jobs {
+		profile, build := builds[job.ID][0], builds[job.ID][1]
+		if job.Status != jobDone {
+			failed++
+			failure := state.recordFailure(profile, build, time.Now())
+			if failure.Attempts >= watchMaxAttempts {
+				logger.Error("watched build failed, giving up until the bundle or the APK changes", "app", job.Plan.App,
+					"attempts", failure.Attempts, "err", job.Err)
+			} else {
+				logger.Error("watched build failed", "app", job.Plan.App, "attempts", failure.Attempts,
+					"retry", failure.Retry, "err", job.Err)
+			}
+			continue
+		}
+		logger.Info("watched build finished", "app", job.Plan.App, "output", job.Plan.OutputPath,
+			"manifest", manifestPath(job.Plan.OutputPath))
+		state.recordBuild(profile, build)
+	}
+	if err := saveWatchState(state); err != nil {
+		logger.Error("saving watch state", "path", watchStatePath, "err", err)
+	}
+	return failed
+}
+
+// watch checks the input folder and the releases at the intervals of cfg
+// until ctx is done.
+func watch(ctx context.Context, cfg *WatchConfig) error {
+	releaseInterval, err := parseWatchInterval(cfg.ReleaseInterval, time.Hour, 5*time.Minute)
+	if err != nil {
+		return err
+	}
+	inputInterval, err := parseWatchInterval(cfg.InputInterval, time.Minute, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cfg.InputDir, 0755); err != nil {
+		return err
+	}
+	state := loadWatchState()
+	logger.Info("watching", "input", cfg.InputDir, "profiles", len(cfg.Profiles),
+		"releaseInterval", releaseInterval, "inputInterval", inputInterval)
+
+	ticker := time.NewTicker(inputInterval)
+	defer ticker.Stop()
+	var releasesChecked time.Time
+	for {
+		checkReleases := time.Since(releasesChecked) >= releaseInterval
+		if checkReleases {
+			releasesChecked = time.Now()
+		}
+		watchOnce(cfg, state, checkReleases)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}